@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/oleksiip-aiola/go-server/config"
+	"github.com/oleksiip-aiola/go-server/db"
+)
+
+const usage = `Usage:
+  go-server                     start the server
+  go-server migrate up          apply pending migrations to the primary and every shard, then backfill the shards
+  go-server migrate down [n]    revert the last n migrations (default 1) on the primary and every shard
+  go-server migrate status      list migrations and whether they are applied
+  go-server reshard [-dry-run] <shard-map.json>
+                                move users to the shard layout of the file, resumes an interrupted run
+  go-server reshard status      list resharding jobs
+  go-server reconcile [-dry-run]
+                                compare the shards with the primary and repair missing, stale and orphaned users
+  go-server backfill-shards [-dry-run]
+                                move mood records and refresh tokens left on the primary to the shards of their users`
+
+// runCommand runs a CLI subcommand instead of starting the server
+func runCommand(cfg config.Config, args []string) {
+	switch args[0] {
+	case "migrate":
+		runMigrateCommand(cfg, args[1:])
+	case "reshard":
+		runReshardCommand(cfg, args[1:])
+	case "reconcile":
+		runReconcileCommand(cfg, args[1:])
+	case "backfill-shards":
+		runBackfillCommand(cfg, args[1:])
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
+
+// connectDB opens the databases for a command, which only needs the database settings
+func connectDB(cfg config.DatabaseConfig) {
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	db.ConnectDB(cfg)
+}
+
+func runMigrateCommand(cfg config.Config, args []string) {
+	if len(args) == 0 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	connectDB(cfg.Database)
+
+	switch args[0] {
+	case "up":
+		for _, target := range db.GetMigrationTargets() {
+			count, err := db.MigrateUp(target.Conn, target.Dir)
+			if err != nil {
+				log.Fatalf("Migrating %s failed: %v", target.Name, err)
+			}
+			fmt.Printf("%s: applied %d migration(s)\n", target.Name, count)
+		}
+
+		// Mood records and refresh tokens are read from the shards only, the server does not start before they moved
+		report, err := db.BackfillShardData(false)
+		if err != nil {
+			log.Fatalf("Backfilling shards failed, run the command again to continue: %v", err)
+		}
+		fmt.Printf("backfill: moved %d mood record(s) and %d refresh token(s), skipped %d\n", report.MoodScores, report.RefreshTokens, report.Skipped)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			parsed, err := strconv.Atoi(args[1])
+			if err != nil || parsed < 1 {
+				log.Fatalf("Invalid number of migrations to revert: %s", args[1])
+			}
+			steps = parsed
+		}
+
+		for _, target := range db.GetMigrationTargets() {
+			count, err := db.MigrateDown(target.Conn, target.Dir, steps)
+			if err != nil {
+				log.Fatalf("Reverting %s failed: %v", target.Name, err)
+			}
+			fmt.Printf("%s: reverted %d migration(s)\n", target.Name, count)
+		}
+	case "status":
+		for _, target := range db.GetMigrationTargets() {
+			statuses, err := db.GetMigrationStatus(target.Conn, target.Dir)
+			if err != nil {
+				log.Fatalf("Reading migration status of %s failed: %v", target.Name, err)
+			}
+
+			fmt.Printf("%s:\n", target.Name)
+			for _, status := range statuses {
+				state := "pending"
+				if status.Applied {
+					state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+				}
+				if status.Modified {
+					state += " (modified since)"
+				}
+				fmt.Printf("  %04d_%s  %s\n", status.Version, status.Name, state)
+			}
+		}
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
+
+func runReshardCommand(cfg config.Config, args []string) {
+	flags := flag.NewFlagSet("reshard", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report which users would move")
+	flags.Usage = func() { fmt.Println(usage) }
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	connectDB(cfg.Database)
+
+	if err := db.CheckMigrations(db.GetDB(), db.PrimaryMigrations); err != nil {
+		log.Fatalf("Primary database is not migrated: %v", err)
+	}
+
+	if flags.Arg(0) == "status" {
+		jobs, err := db.GetReshardJobs()
+		if err != nil {
+			log.Fatalf("Reading reshard jobs failed: %v", err)
+		}
+
+		for _, job := range jobs {
+			fmt.Printf("%d  v%d -> v%d  %-9s  moved %d, deleted %d, skipped %d  updated %s\n",
+				job.ID, job.FromVersion, job.ToVersion, job.Phase, job.Moved, job.Deleted, job.Skipped, job.UpdatedAt.Format("2006-01-02 15:04:05"))
+			if job.LastError != "" {
+				fmt.Printf("    last error: %s\n", job.LastError)
+			}
+		}
+		return
+	}
+
+	shardMap, err := db.ReadShardMapFile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *dryRun {
+		plan, err := db.PlanReshard(shardMap)
+		if err != nil {
+			log.Fatalf("Planning reshard failed: %v", err)
+		}
+
+		fmt.Printf("From shard map version %d: %d of %d users move\n", plan.FromVersion, plan.Moved, plan.Users)
+		for _, move := range plan.SortedMoves() {
+			fmt.Printf("  %s: %d\n", move, plan.Moves[move])
+		}
+		for shard, count := range plan.PendingMigrations {
+			fmt.Printf("  %s has %d pending migration(s), applied when resharding\n", shard, count)
+		}
+		return
+	}
+
+	if _, err := db.RunReshard(shardMap); err != nil {
+		log.Fatalf("Resharding failed, run the command again to resume: %v", err)
+	}
+}
+
+func runReconcileCommand(cfg config.Config, args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report the drift")
+	flags.Usage = func() { fmt.Println(usage) }
+	flags.Parse(args)
+
+	connectDB(cfg.Database)
+
+	report, err := db.Reconcile(context.Background(), *dryRun)
+
+	if report != nil {
+		for _, shard := range report.Shards {
+			fmt.Printf("%s: %d checked, %d repaired, %d failed\n", shard.Shard, shard.Checked, shard.Repaired, shard.Failed)
+
+			for _, kind := range []string{db.DriftMissing, db.DriftStale, db.DriftOrphaned, db.DriftMisplaced} {
+				if shard.Drift[kind] == 0 {
+					continue
+				}
+				fmt.Printf("  %-9s %d  e.g. %s\n", kind, shard.Drift[kind], strings.Join(shard.Samples[kind], ", "))
+			}
+		}
+	}
+
+	if err != nil {
+		log.Fatalf("Reconciling failed: %v", err)
+	}
+}
+
+func runBackfillCommand(cfg config.Config, args []string) {
+	flags := flag.NewFlagSet("backfill-shards", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only count the rows to move")
+	flags.Usage = func() { fmt.Println(usage) }
+	flags.Parse(args)
+
+	connectDB(cfg.Database)
+
+	report, err := db.BackfillShardData(*dryRun)
+
+	fmt.Printf("Mood records: %d, refresh tokens: %d, skipped: %d\n", report.MoodScores, report.RefreshTokens, report.Skipped)
+
+	if err != nil {
+		log.Fatalf("Backfilling shards failed, run the command again to continue: %v", err)
+	}
+}
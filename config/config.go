@@ -1,6 +1,519 @@
 package config
 
-import "os"
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
-var JwtKey = []byte(os.Getenv("JWT_SECRET_KEY")) // Replace with a strong secret key
-var JwtRefreshKey = []byte(os.Getenv("JWT_REFRESH_KEY")) // Secret for refresh token
\ No newline at end of file
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is loaded once on startup by Load and passed to the packages that need it.
+// Every field can be set in the YAML file and overridden by the env var named in its comment
+type Config struct {
+	Env             string         `yaml:"env"`             // ENV, "development" keeps the access token cookie as long as the refresh token
+	Port            string         `yaml:"port"`            // PORT
+	ShutdownTimeout time.Duration  `yaml:"shutdownTimeout"` // SHUTDOWN_TIMEOUT, time in-flight requests and shard writes get on SIGTERM
+	PublicURL       string         `yaml:"publicUrl"`       // PUBLIC_URL, makes cookies secure and is allowed as origin
+	PublicDomain    string         `yaml:"publicDomain"`    // PUBLIC_DOMAIN, domain of the cookies when PUBLIC_URL is set
+	TLS             TLSConfig      `yaml:"tls"`
+	Log             LogConfig      `yaml:"log"`
+	Metrics         MetricsConfig  `yaml:"metrics"`
+	Tracing         TracingConfig  `yaml:"tracing"`
+	Cookies         CookieConfig   `yaml:"cookies"`
+	JWT             JWTConfig      `yaml:"jwt"`
+	WebAuthn        WebAuthnConfig `yaml:"webauthn"`
+	Database        DatabaseConfig `yaml:"database"`
+}
+
+// TLSConfig makes the server listen with HTTPS on PORT when the certificate and key files are set
+type TLSConfig struct {
+	CertFile       string        `yaml:"certFile"`       // TLS_CERT_FILE, PEM certificate chain
+	KeyFile        string        `yaml:"keyFile"`        // TLS_KEY_FILE, PEM private key of the certificate
+	MinVersion     string        `yaml:"minVersion"`     // TLS_MIN_VERSION, 1.2 or 1.3
+	CipherSuites   []string      `yaml:"cipherSuites"`   // TLS_CIPHER_SUITES, crypto/tls names for TLS 1.2, Go's defaults when empty
+	RedirectPort   string        `yaml:"redirectPort"`   // TLS_REDIRECT_PORT, plain HTTP port redirecting to HTTPS, none when empty
+	ReloadInterval time.Duration `yaml:"reloadInterval"` // TLS_RELOAD_INTERVAL, how often the files are checked for a new certificate
+}
+
+// Enabled is true when a certificate is configured
+func (cfg TLSConfig) Enabled() bool {
+	return cfg.CertFile != "" || cfg.KeyFile != ""
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`  // LOG_LEVEL, debug, info, warn or error
+	Format string `yaml:"format"` // LOG_FORMAT, text or json
+}
+
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled"` // METRICS_ENABLED
+	Path    string `yaml:"path"`    // METRICS_PATH, served without authentication, keep it off the public network
+}
+
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter"`    // TRACING_EXPORTER, none, stdout or otlp (configured by the OTEL_EXPORTER_OTLP_* env vars)
+	ServiceName string  `yaml:"serviceName"` // OTEL_SERVICE_NAME
+	SampleRatio float64 `yaml:"sampleRatio"` // TRACING_SAMPLE_RATIO, share of the traces started here that are kept
+}
+
+type CookieConfig struct {
+	AccessToken  string `yaml:"accessToken"`  // ACCESS_TOKEN_COOKIE_NAME
+	RefreshToken string `yaml:"refreshToken"` // JTI_COOKIE_NAME
+}
+
+type JWTConfig struct {
+	SigningKeys         []string      `yaml:"signingKeys"`         // JWT_SIGNING_KEYS, PEM files, the first one holds the active key
+	KeyRotationInterval time.Duration `yaml:"keyRotationInterval"` // JWT_KEY_ROTATION_INTERVAL, how often the files are reloaded
+	KeyRotatedAt        time.Time     `yaml:"keyRotatedAt"`        // JWT_KEY_ROTATED_AT, RFC 3339 time the first key became active, the others retire from then
+}
+
+type WebAuthnConfig struct {
+	RPID          string   `yaml:"rpId"`          // WEBAUTHN_RP_ID
+	RPDisplayName string   `yaml:"rpDisplayName"` // WEBAUTHN_RP_DISPLAY_NAME
+	RPOrigins     []string `yaml:"rpOrigins"`     // WEBAUTHN_RP_ORIGINS, localhost:3000 and PUBLIC_URL when empty
+}
+
+type DatabaseConfig struct {
+	Host              string        `yaml:"host"`              // DB_URL, host of the local databases
+	User              string        `yaml:"user"`              // DB_USER
+	Password          string        `yaml:"password"`          // DB_PASSWORD
+	Name              string        `yaml:"name"`              // DB_NAME
+	ProdURL           string        `yaml:"prodUrl"`           // POSTGRES_PROD_URL, used instead of the local databases when set
+	ProdShardURLs     []string      `yaml:"prodShardUrls"`     // POSTGRES_PROD_SHARD_<n>_URL for n = 1, 2, ...
+	Shards            []string      `yaml:"shards"`            // DB_SHARDS, local shard databases
+	ShardWeights      []int         `yaml:"shardWeights"`      // SHARD_WEIGHTS, one per shard, all 1 when empty
+	ShardPlacement    string        `yaml:"shardPlacement"`    // SHARD_PLACEMENT, modulo (placement before the ring) or ring, of the shards above
+	ShardMapFile      string        `yaml:"shardMapFile"`      // SHARD_MAP_FILE, replaces the shards above
+	ShardVirtualNodes int           `yaml:"shardVirtualNodes"` // SHARD_VIRTUAL_NODES
+	ReconcileInterval time.Duration `yaml:"reconcileInterval"` // RECONCILE_INTERVAL, 0 disables the reconciler
+	AdminEmails       []string      `yaml:"adminEmails"`       // ADMIN_EMAILS, users granted the admin role on startup
+}
+
+// Default returns the configuration used for everything not set in the YAML file or env
+func Default() Config {
+	return Config{
+		Port:            "8080",
+		ShutdownTimeout: 15 * time.Second,
+		TLS: TLSConfig{
+			MinVersion:     "1.2",
+			ReloadInterval: time.Minute,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Metrics: MetricsConfig{
+			Enabled: true,
+			Path:    "/metrics",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "go-server",
+			SampleRatio: 1,
+		},
+		Cookies: CookieConfig{
+			AccessToken:  "access_token",
+			RefreshToken: "refresh_token",
+		},
+		// No default signing key, every deployment has to generate its own
+		JWT: JWTConfig{
+			KeyRotationInterval: time.Hour,
+		},
+		WebAuthn: WebAuthnConfig{
+			RPID:          "localhost",
+			RPDisplayName: "go-server",
+		},
+		Database: DatabaseConfig{
+			Shards:            []string{"shard1", "shard2"},
+			ShardPlacement:    "modulo",
+			ShardVirtualNodes: 128,
+			ReconcileInterval: 15 * time.Minute,
+		},
+	}
+}
+
+// Load reads the configuration from the defaults, the YAML file in CONFIG_FILE (config.yaml when it
+// exists), .env and the env, later sources overriding earlier ones. It does not validate the result
+func Load() (Config, error) {
+	cfg := Default()
+
+	path := os.Getenv("CONFIG_FILE")
+	required := path != ""
+	if path == "" {
+		path = "config.yaml"
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return Config{}, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	} else if required || !errors.Is(err, os.ErrNotExist) {
+		return Config{}, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	// Variables already set in the env win over .env
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Config{}, fmt.Errorf("failed to load .env: %w", err)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return Config{}, err
+	}
+
+	if len(cfg.WebAuthn.RPOrigins) == 0 {
+		cfg.WebAuthn.RPOrigins = []string{"http://localhost:3000", "https://localhost:3000"}
+		if cfg.PublicURL != "" {
+			cfg.WebAuthn.RPOrigins = append(cfg.WebAuthn.RPOrigins, cfg.PublicURL)
+		}
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) applyEnv() error {
+	errs := []error{}
+
+	setString(&cfg.Env, "ENV")
+	setString(&cfg.Port, "PORT")
+	errs = append(errs, setDuration(&cfg.ShutdownTimeout, "SHUTDOWN_TIMEOUT"))
+	setString(&cfg.PublicURL, "PUBLIC_URL")
+	setString(&cfg.PublicDomain, "PUBLIC_DOMAIN")
+
+	setString(&cfg.TLS.CertFile, "TLS_CERT_FILE")
+	setString(&cfg.TLS.KeyFile, "TLS_KEY_FILE")
+	setString(&cfg.TLS.MinVersion, "TLS_MIN_VERSION")
+	setList(&cfg.TLS.CipherSuites, "TLS_CIPHER_SUITES")
+	setString(&cfg.TLS.RedirectPort, "TLS_REDIRECT_PORT")
+	errs = append(errs, setDuration(&cfg.TLS.ReloadInterval, "TLS_RELOAD_INTERVAL"))
+
+	setString(&cfg.Log.Level, "LOG_LEVEL")
+	setString(&cfg.Log.Format, "LOG_FORMAT")
+
+	errs = append(errs, setBool(&cfg.Metrics.Enabled, "METRICS_ENABLED"))
+	setString(&cfg.Metrics.Path, "METRICS_PATH")
+
+	setString(&cfg.Tracing.Exporter, "TRACING_EXPORTER")
+	setString(&cfg.Tracing.ServiceName, "OTEL_SERVICE_NAME")
+	if value := os.Getenv("TRACING_SAMPLE_RATIO"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid TRACING_SAMPLE_RATIO %q", value))
+		}
+		cfg.Tracing.SampleRatio = parsed
+	}
+
+	setString(&cfg.Cookies.AccessToken, "ACCESS_TOKEN_COOKIE_NAME")
+	setString(&cfg.Cookies.RefreshToken, "JTI_COOKIE_NAME")
+
+	setList(&cfg.JWT.SigningKeys, "JWT_SIGNING_KEYS")
+	errs = append(errs, setDuration(&cfg.JWT.KeyRotationInterval, "JWT_KEY_ROTATION_INTERVAL"))
+	errs = append(errs, setTime(&cfg.JWT.KeyRotatedAt, "JWT_KEY_ROTATED_AT"))
+
+	setString(&cfg.WebAuthn.RPID, "WEBAUTHN_RP_ID")
+	setString(&cfg.WebAuthn.RPDisplayName, "WEBAUTHN_RP_DISPLAY_NAME")
+	setList(&cfg.WebAuthn.RPOrigins, "WEBAUTHN_RP_ORIGINS")
+
+	database := &cfg.Database
+	setString(&database.Host, "DB_URL")
+	setString(&database.User, "DB_USER")
+	setString(&database.Password, "DB_PASSWORD")
+	setString(&database.Name, "DB_NAME")
+	setString(&database.ProdURL, "POSTGRES_PROD_URL")
+	setList(&database.Shards, "DB_SHARDS")
+	setString(&database.ShardPlacement, "SHARD_PLACEMENT")
+	setString(&database.ShardMapFile, "SHARD_MAP_FILE")
+	setList(&database.AdminEmails, "ADMIN_EMAILS")
+	errs = append(errs, setDuration(&database.ReconcileInterval, "RECONCILE_INTERVAL"))
+
+	prodShardURLs := []string{}
+	for n := 1; os.Getenv(fmt.Sprintf("POSTGRES_PROD_SHARD_%d_URL", n)) != ""; n++ {
+		prodShardURLs = append(prodShardURLs, os.Getenv(fmt.Sprintf("POSTGRES_PROD_SHARD_%d_URL", n)))
+	}
+	if len(prodShardURLs) > 0 {
+		database.ProdShardURLs = prodShardURLs
+	}
+
+	if value := os.Getenv("SHARD_VIRTUAL_NODES"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid SHARD_VIRTUAL_NODES %q", value))
+		}
+		database.ShardVirtualNodes = parsed
+	}
+
+	if value := os.Getenv("SHARD_WEIGHTS"); value != "" {
+		database.ShardWeights = nil
+
+		for _, weight := range splitList(value) {
+			parsed, err := strconv.Atoi(weight)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid weight %q in SHARD_WEIGHTS", weight))
+			}
+			database.ShardWeights = append(database.ShardWeights, parsed)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func setString(target *string, name string) {
+	if value := os.Getenv(name); value != "" {
+		*target = value
+	}
+}
+
+func setList(target *[]string, name string) {
+	if value := os.Getenv(name); value != "" {
+		*target = splitList(value)
+	}
+}
+
+func setBool(target *bool, name string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, value)
+	}
+
+	*target = parsed
+
+	return nil
+}
+
+func setDuration(target *time.Duration, name string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, value)
+	}
+
+	*target = parsed
+
+	return nil
+}
+
+func setTime(target *time.Time, name string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q, expected an RFC 3339 time", name, value)
+	}
+
+	*target = parsed
+
+	return nil
+}
+
+// splitList splits a comma separated value, dropping blank entries
+func splitList(value string) []string {
+	list := []string{}
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// Validate reports every setting the server cannot start with
+func (cfg Config) Validate() error {
+	errs := []error{}
+
+	if cfg.Port == "" {
+		errs = append(errs, errors.New("PORT is required"))
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("SHUTDOWN_TIMEOUT must be positive"))
+	}
+
+	if cfg.PublicURL != "" && cfg.PublicDomain == "" {
+		errs = append(errs, errors.New("PUBLIC_DOMAIN is required when PUBLIC_URL is set"))
+	}
+
+	if cfg.Cookies.AccessToken == "" || cfg.Cookies.RefreshToken == "" {
+		errs = append(errs, errors.New("ACCESS_TOKEN_COOKIE_NAME and JTI_COOKIE_NAME must not be empty"))
+	}
+
+	if cfg.Metrics.Enabled && !strings.HasPrefix(cfg.Metrics.Path, "/") {
+		errs = append(errs, fmt.Errorf("METRICS_PATH must start with /, got %q", cfg.Metrics.Path))
+	}
+
+	if cfg.TLS.RedirectPort != "" && cfg.TLS.RedirectPort == cfg.Port {
+		errs = append(errs, errors.New("TLS_REDIRECT_PORT must differ from PORT"))
+	}
+
+	errs = append(errs, cfg.TLS.Validate(), cfg.Log.Validate(), cfg.Tracing.Validate(), cfg.JWT.Validate(), cfg.Database.Validate())
+
+	if cfg.WebAuthn.RPID == "" {
+		errs = append(errs, errors.New("WEBAUTHN_RP_ID must not be empty"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// TLSVersions are the accepted TLS_MIN_VERSION values
+var TLSVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSCipherSuite returns the id of a cipher suite by its crypto/tls name, insecure ones are not accepted
+func TLSCipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// Validate refuses a missing certificate or key, the server could not accept a connection
+func (cfg TLSConfig) Validate() error {
+	errs := []error{}
+
+	if cfg.Enabled() {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+		}
+
+		for _, file := range []string{cfg.CertFile, cfg.KeyFile} {
+			if file == "" {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				errs = append(errs, fmt.Errorf("TLS file %s: %w", file, err))
+			}
+		}
+
+		if cfg.ReloadInterval <= 0 {
+			errs = append(errs, errors.New("TLS_RELOAD_INTERVAL must be positive"))
+		}
+	} else if cfg.RedirectPort != "" {
+		errs = append(errs, errors.New("TLS_REDIRECT_PORT requires TLS_CERT_FILE and TLS_KEY_FILE"))
+	}
+
+	if _, ok := TLSVersions[cfg.MinVersion]; !ok {
+		errs = append(errs, fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, got %q", cfg.MinVersion))
+	}
+
+	for _, name := range cfg.CipherSuites {
+		if _, ok := TLSCipherSuite(name); !ok {
+			errs = append(errs, fmt.Errorf("unknown or insecure cipher suite %q in TLS_CIPHER_SUITES", name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (cfg LogConfig) Validate() error {
+	errs := []error{}
+
+	if !slices.Contains([]string{"debug", "info", "warn", "error"}, strings.ToLower(cfg.Level)) {
+		errs = append(errs, fmt.Errorf("invalid LOG_LEVEL %q", cfg.Level))
+	}
+
+	if cfg.Format != "text" && cfg.Format != "json" {
+		errs = append(errs, fmt.Errorf("LOG_FORMAT must be text or json, got %q", cfg.Format))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (cfg TracingConfig) Validate() error {
+	errs := []error{}
+
+	if !slices.Contains([]string{"none", "stdout", "otlp"}, cfg.Exporter) {
+		errs = append(errs, fmt.Errorf("TRACING_EXPORTER must be none, stdout or otlp, got %q", cfg.Exporter))
+	}
+
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("TRACING_SAMPLE_RATIO must be between 0 and 1, got %v", cfg.SampleRatio))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate refuses a missing or empty signing key, tokens could not be signed with it, and previous keys
+// without the time they retired
+func (cfg JWTConfig) Validate() error {
+	if len(cfg.SigningKeys) == 0 {
+		return errors.New("JWT_SIGNING_KEYS is required, generate a key with: openssl genpkey -algorithm ed25519 -out key.pem")
+	}
+
+	errs := []error{}
+
+	for _, file := range cfg.SigningKeys {
+		info, err := os.Stat(file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("JWT signing key %s: %w", file, err))
+		} else if info.Size() == 0 {
+			errs = append(errs, fmt.Errorf("JWT signing key %s is empty", file))
+		}
+	}
+
+	if cfg.KeyRotationInterval <= 0 {
+		errs = append(errs, errors.New("JWT_KEY_ROTATION_INTERVAL must be positive"))
+	}
+
+	// File times change with every copy or image build, only the configured time says when the previous keys retired
+	if len(cfg.SigningKeys) > 1 && cfg.KeyRotatedAt.IsZero() {
+		errs = append(errs, errors.New("JWT_KEY_ROTATED_AT is required with more than one signing key, set it to the time the first key became active"))
+	}
+
+	if cfg.KeyRotatedAt.After(time.Now()) {
+		errs = append(errs, errors.New("JWT_KEY_ROTATED_AT must not be in the future"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the database settings, the CLI commands only need these
+func (cfg DatabaseConfig) Validate() error {
+	errs := []error{}
+
+	if cfg.ProdURL == "" && (cfg.Host == "" || cfg.Name == "") {
+		errs = append(errs, errors.New("POSTGRES_PROD_URL or DB_URL and DB_NAME are required"))
+	}
+
+	if cfg.ShardPlacement != "modulo" && cfg.ShardPlacement != "ring" {
+		errs = append(errs, fmt.Errorf("SHARD_PLACEMENT must be modulo or ring, got %q", cfg.ShardPlacement))
+	}
+
+	if cfg.ShardPlacement == "modulo" && slices.ContainsFunc(cfg.ShardWeights, func(weight int) bool { return weight != 1 }) {
+		errs = append(errs, errors.New("SHARD_WEIGHTS need SHARD_PLACEMENT=ring"))
+	}
+
+	if cfg.ShardVirtualNodes < 1 {
+		errs = append(errs, errors.New("SHARD_VIRTUAL_NODES must be at least 1"))
+	}
+
+	if cfg.ReconcileInterval < 0 {
+		errs = append(errs, errors.New("RECONCILE_INTERVAL must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
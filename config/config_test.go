@@ -0,0 +1,191 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// chdir moves into dir for the test, Load reads config.yaml and .env from the working directory
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+func TestEnvOverridesYamlOverridesDefaults(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+
+	key := writeFile(t, dir, "key.pem", "key")
+	writeFile(t, dir, "config.yaml", `
+port: "9000"
+publicUrl: https://example.com
+publicDomain: example.com
+jwt:
+  signingKeys: [`+key+`]
+  keyRotationInterval: 30m
+  keyRotatedAt: 2024-05-01T09:00:00Z
+database:
+  host: localhost
+  name: app
+  shards: [a, b, c]
+  shardPlacement: ring
+  reconcileInterval: 1h
+`)
+	writeFile(t, dir, ".env", "DB_USER=from-dotenv\nPORT=7000\n")
+
+	// .env is loaded into the env, unset what it adds once the test is done
+	t.Cleanup(func() { os.Unsetenv("DB_USER") })
+
+	t.Setenv("PORT", "8000")
+	t.Setenv("SHARD_WEIGHTS", "1, 2,3")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Port != "8000" {
+		t.Errorf("expected the env to win, got port %q", cfg.Port)
+	}
+	if cfg.Database.User != "from-dotenv" {
+		t.Errorf("expected the user from .env, got %q", cfg.Database.User)
+	}
+	if cfg.JWT.KeyRotationInterval != 30*time.Minute || cfg.Database.ReconcileInterval != time.Hour {
+		t.Errorf("durations from YAML not applied: %v %v", cfg.JWT.KeyRotationInterval, cfg.Database.ReconcileInterval)
+	}
+	if !cfg.JWT.KeyRotatedAt.Equal(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("rotation time from YAML not applied: %v", cfg.JWT.KeyRotatedAt)
+	}
+	if len(cfg.Database.Shards) != 3 || len(cfg.Database.ShardWeights) != 3 || cfg.Database.ShardWeights[1] != 2 {
+		t.Errorf("unexpected shards %v with weights %v", cfg.Database.Shards, cfg.Database.ShardWeights)
+	}
+	if cfg.Cookies.AccessToken != "access_token" || cfg.Database.ShardVirtualNodes != 128 {
+		t.Errorf("defaults not kept: %+v", cfg)
+	}
+	if origins := cfg.WebAuthn.RPOrigins; len(origins) != 3 || origins[2] != "https://example.com" {
+		t.Errorf("expected the public URL to be allowed as origin, got %v", origins)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected a valid config, got %v", err)
+	}
+}
+
+func TestInvalidEnvValues(t *testing.T) {
+	chdir(t, t.TempDir())
+
+	t.Setenv("RECONCILE_INTERVAL", "soon")
+	t.Setenv("SHARD_VIRTUAL_NODES", "many")
+	t.Setenv("METRICS_ENABLED", "maybe")
+	t.Setenv("JWT_KEY_ROTATED_AT", "yesterday")
+
+	_, err := Load()
+	if err == nil {
+		t.Fatal("expected invalid values to be reported")
+	}
+
+	for _, name := range []string{"RECONCILE_INTERVAL", "SHARD_VIRTUAL_NODES", "METRICS_ENABLED", "JWT_KEY_ROTATED_AT"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error does not mention %s: %v", name, err)
+		}
+	}
+}
+
+func TestRefusesEmptySigningKey(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := Default()
+	cfg.Database.Host = "localhost"
+	cfg.Database.Name = "app"
+
+	cfg.JWT.SigningKeys = []string{writeFile(t, dir, "empty.pem", "")}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "is empty") {
+		t.Errorf("expected an empty key to be refused, got %v", err)
+	}
+
+	cfg.JWT.SigningKeys = []string{filepath.Join(dir, "missing.pem")}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected a missing key to be refused")
+	}
+
+	// Previous keys retire at JWT_KEY_ROTATED_AT, not at a file time
+	cfg.JWT.SigningKeys = []string{writeFile(t, dir, "current.pem", "key"), writeFile(t, dir, "previous.pem", "key")}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "JWT_KEY_ROTATED_AT") {
+		t.Errorf("expected previous keys without JWT_KEY_ROTATED_AT to be refused, got %v", err)
+	}
+
+	cfg.JWT.KeyRotatedAt = time.Now().Add(-time.Hour)
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected previous keys with JWT_KEY_ROTATED_AT to be valid, got %v", err)
+	}
+
+	// Without JWT_SIGNING_KEYS there is no key, not even a default one
+	cfg.JWT.SigningKeys = Default().JWT.SigningKeys
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "JWT_SIGNING_KEYS") {
+		t.Errorf("expected missing keys to be refused, got %v", err)
+	}
+}
+
+func TestTLSSettings(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := Default().TLS
+	if cfg.Enabled() || cfg.Validate() != nil {
+		t.Fatal("expected TLS to be off and valid by default")
+	}
+
+	cfg.RedirectPort = "80"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "TLS_REDIRECT_PORT") {
+		t.Errorf("expected a redirect without a certificate to be refused, got %v", err)
+	}
+
+	cfg.CertFile = writeFile(t, dir, "server.crt", "cert")
+	cfg.KeyFile = writeFile(t, dir, "server.key", "key")
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected the certificate and key to be accepted, got %v", err)
+	}
+
+	cfg.KeyFile = ""
+	cfg.MinVersion = "1.0"
+	cfg.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+
+	err := cfg.Validate()
+	for _, name := range []string{"TLS_KEY_FILE", "TLS_MIN_VERSION", "TLS_CIPHER_SUITES"} {
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("error does not mention %s: %v", name, err)
+		}
+	}
+}
+
+func TestMissingConfigFile(t *testing.T) {
+	chdir(t, t.TempDir())
+	t.Setenv("CONFIG_FILE", "missing.yaml")
+
+	if _, err := Load(); err == nil {
+		t.Error("expected an explicitly configured file to be required")
+	}
+}
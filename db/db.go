@@ -1,146 +1,243 @@
 package db
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"sync"
+	"time"
 
-	"github.com/google/uuid"
+	"github.com/oleksiip-aiola/go-server/config"
+	"github.com/oleksiip-aiola/go-server/tracing"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
+	gormlogger "gorm.io/gorm/logger"
 )
 
 var DBConn *gorm.DB
-var shardDBs []*gorm.DB
-var shardWriteQueue = make(chan User, 100) // Channel for the task queue
 
-func InitDB() {
-	var err error
-
-	// Load .env file
+// Database settings given to ConnectDB, also read when the shard map is refreshed
+var settings config.DatabaseConfig
 
-	dbUrl := os.Getenv("DB_URL")
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
-	prodUrl := os.Getenv("POSTGRES_PROD_URL")
-	prodShard1Url := os.Getenv("POSTGRES_PROD_SHARD_1_URL")
-	prodShard2Url := os.Getenv("POSTGRES_PROD_SHARD_2_URL")
+// ConnectDB opens the primary and shard connections without touching the schema
+func ConnectDB(cfg config.DatabaseConfig) {
+	var err error
 
-	if prodUrl != "" {
-		fmt.Printf("Connecting to database %s", prodUrl)
-		DBConn, err = gorm.Open(postgres.Open(prodUrl), &gorm.Config{TranslateError: true})
+	settings = cfg
 
-		shardDBs = []*gorm.DB{
-			initShardDB(prodShard1Url),
-			initShardDB(prodShard2Url),
-			// Add more shards here
-		}
-	} else {
-		fmt.Printf("Connecting to database postgres://%s:%s@%s/%s?sslmode=disable", dbUser, dbPassword, dbUrl, dbName)
-		connStr := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", dbUser, dbPassword, dbUrl, dbName)
-		DBConn, err = gorm.Open(postgres.Open(connStr), &gorm.Config{TranslateError: true})
-
-		shardDBs = []*gorm.DB{
-			initShardDB(fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", dbUser, dbPassword, dbUrl, "shard1")),
-			initShardDB(fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", dbUser, dbPassword, dbUrl, "shard2")),
-			// Add more shards here
-		}
+	connStr := cfg.ProdURL
+	if connStr == "" {
+		connStr = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", cfg.User, cfg.Password, cfg.Host, cfg.Name)
 	}
 
-	go shardWorker()
+	// The DSN is logged without its password, see logger.Redact
+	slog.Info("Connecting to database", "dsn", connStr)
 
-	// Connection string (replace with your actual PostgreSQL credentials)
+	DBConn, err = gorm.Open(postgres.Open(connStr), gormConfig())
 
 	if err != nil {
+		slog.Error("Failed to connect to database", "error", err)
 		panic("Failed to connect to database!")
 	}
 
-	err = DBConn.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\"").Error
+	if err := DBConn.Use(tracing.GormPlugin("primary")); err != nil {
+		panic(err)
+	}
 
-	if err != nil {
-		panic("Failed to create extension!")
+	// Shards come from the active shard map, see shard_map.go
+	if err := connectShards(); err != nil {
+		slog.Error("Failed to connect to shards", "error", err)
+		panic(err)
+	}
+}
+
+// gormConfig logs slow and failed queries through slog, without their parameters
+// so passwords and tokens written by a query do not end up in the logs
+func gormConfig() *gorm.Config {
+	return &gorm.Config{
+		TranslateError: true,
+		Logger: gormlogger.New(slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn), gormlogger.Config{
+			SlowThreshold:             200 * time.Millisecond,
+			LogLevel:                  gormlogger.Warn,
+			IgnoreRecordNotFoundError: true,
+			ParameterizedQueries:      true,
+		}),
+	}
+}
+
+// InitDB connects and refuses to start while the primary or a shard has unapplied migrations
+func InitDB(cfg config.DatabaseConfig) {
+	ConnectDB(cfg)
+
+	for _, target := range GetMigrationTargets() {
+		if err := CheckMigrations(target.Conn, target.Dir); err != nil {
+			slog.Error("Database is not migrated", "database", target.Name)
+			panic(err)
+		}
 	}
 
-	err = DBConn.AutoMigrate(&User{}, &MoodScore{}, &RefreshToken{})
+	if err := CheckShardBackfill(); err != nil {
+		slog.Error("Shards are not backfilled, run migrate up or backfill-shards")
+		panic(err)
+	}
+
+	if err := generateUnknownUserHash(); err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backgroundCtx, stopBackground = ctx, cancel
+
+	runInBackground(func() { shardWorker(ctx) })
+	startShardMapRefresh(ctx, SHARD_MAP_REFRESH_INTERVAL)
+	startReconciler(ctx)
+
+	err := SeedRoles()
 
 	if err != nil {
-		fmt.Println("Failed to migrate database!")
+		slog.Error("Failed to seed roles", "error", err)
 		panic(err)
 	}
-	for _, shard := range shardDBs {
-		err = shard.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\"").Error
-		if err != nil {
-			panic("Failed to create extension!")
+}
+
+// Stops the shard worker, shard map refresh and reconciler started by InitDB, nil for the CLI commands
+var stopBackground context.CancelFunc
+var backgroundCtx = context.Background()
+var background sync.WaitGroup
+
+func runInBackground(run func()) {
+	background.Add(1)
+
+	go func() {
+		defer background.Done()
+		run()
+	}()
+}
+
+// Close stops the background work started by InitDB, delivers the shard writes that are due and closes
+// the primary and shard pools. Writes still pending when ctx is done stay in the outbox for the next start
+func Close(ctx context.Context) error {
+	if stopBackground != nil {
+		stopBackground()
+
+		// A batch in progress finishes first, a reconciliation stops after its current batch
+		done := make(chan struct{})
+		go func() {
+			background.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			drainOutbox(ctx)
+		case <-ctx.Done():
+			slog.Warn("Background work did not stop in time, closing the pools anyway")
 		}
-		err = shard.AutoMigrate(&User{}, &MoodScore{}, &RefreshToken{})
-		if err != nil {
-			fmt.Println("Failed to migrate shard database!")
-			panic(err)
+	}
+
+	return closePools()
+}
+
+func closePools() error {
+	if DBConn == nil {
+		return nil
+	}
+
+	errs := []error{}
+
+	sqlDB, err := DBConn.DB()
+	if err == nil {
+		err = sqlDB.Close()
+	}
+	errs = append(errs, err)
+
+	t := currentTopology()
+	closeRetiredTopologies(t)
+
+	if t != nil {
+		for i, conn := range t.conns {
+			sqlDB, err := conn.DB()
+			if err == nil {
+				err = sqlDB.Close()
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("closing shard %s failed: %w", t.shards[i].Name, err))
+			}
 		}
 	}
 
+	return errors.Join(errs...)
 }
 
-// Determine shard by using hash of UserId
-func determineShardByUserID(userID string) int {
-	uuid, err := uuid.Parse(userID)
+// Determine shard by placing the UserId on the consistent-hash ring, returns its connection bound to ctx and index
+func determineShardByUserID(ctx context.Context, userID string) (*gorm.DB, int, error) {
+	t := currentTopology()
+
+	shardID, err := t.shardFor(userID)
 	if err != nil {
-		fmt.Println("Failed to parse UUID", userID)
+		return nil, 0, err
 	}
-	hash := sha256.Sum256(uuid[:])
 
-	shardID := binary.BigEndian.Uint32(hash[:4]) % uint32(len(shardDBs))
-	return int(shardID)
+	return t.conns[shardID].WithContext(ctx), shardID, nil
 }
 
-// Queue a task for writing to the shard
-func QueueShardWrite(user User) {
-	select {
-	case shardWriteQueue <- user: // Enqueue the user to the shard write queue
-		fmt.Printf("User with ID %s enqueued for shard write\n", user.UserId)
-	default:
-		fmt.Println("Shard write queue is full. Task could not be enqueued.")
+// Name of the shard holding the user's data, empty when it cannot be routed
+func shardNameOf(userID string) string {
+	t := currentTopology()
+
+	shardID, err := t.shardFor(userID)
+	if err != nil {
+		return ""
 	}
+
+	return t.shards[shardID].Name
 }
 
-// Background worker that processes shard write tasks asynchronously
-func shardWorker() {
-	for user := range shardWriteQueue {
-		writeToShard(user)
+// Connection of the shard holding the user's data, for writes; fails with ErrShardReadOnly on a read-only shard
+// and for a user a fenced reshard is moving
+func getWritableShardByUserID(ctx context.Context, userID string) (*gorm.DB, error) {
+	t := currentTopology()
+
+	shardID, err := t.shardFor(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.shards[shardID].ReadOnly {
+		return nil, fmt.Errorf("shard %s: %w", t.shards[shardID].Name, ErrShardReadOnly)
 	}
-}
 
-// Write user to the appropriate shard
-func writeToShard(user User) {
-	shardID := determineShardByUserID(user.UserId)
-	shardDB := shardDBs[shardID]
-	// Write user data to the selected shard
-	if err := shardDB.Clauses(clause.OnConflict{DoNothing: true}).Save(&user).Error; err != nil {
-		log.Printf("Failed to write to shard DB %d: %v", shardID, err)
-	} else {
-		// @TODO Add exact shard name
-		fmt.Printf("User with ID %s written to shard of index %d with name \n", user.UserId, shardID)
+	fenced, err := t.fenced(userID, shardID)
+	if err != nil {
+		return nil, err
 	}
+
+	if fenced {
+		return nil, fmt.Errorf("user %s is moving off shard %s: %w", userID, t.shards[shardID].Name, ErrShardReadOnly)
+	}
+
+	return t.conns[shardID].WithContext(ctx), nil
 }
 
 // Read from the appropriate shard based on UserId
-func ReadFromShard(userID string) (User, error) {
-	shardID := determineShardByUserID(userID)
-	shardDB := shardDBs[shardID]
+func ReadFromShard(ctx context.Context, userID string) (User, error) {
+	shardDB, shardID, err := determineShardByUserID(ctx, userID)
+	if err != nil {
+		return User{}, err
+	}
 
 	var user User
 
-	err := shardDB.Model(&User{}).Where("user_id = ?", userID).First(&user).Error
+	err = shardDB.Model(&User{}).Where("user_id = ?", userID).First(&user).Error
 
 	if err != nil {
 		if err.Error() == "record not found" {
-			if err := DBConn.Model(&User{}).Where("user_id = ?", userID).First(&user).Error; err != nil {
+			if err := DBConn.WithContext(ctx).Model(&User{}).Where("user_id = ?", userID).First(&user).Error; err != nil {
 				return User{}, err
 			}
+			// Repaired by the outbox or the reconciler
+			slog.Warn("User missing on shard, read from primary", "user_id", userID, "shard", shardID)
 			return user, nil
 		}
 		return User{}, err
@@ -149,69 +246,48 @@ func ReadFromShard(userID string) (User, error) {
 	return user, nil
 }
 
-func initShardDB(dsn string) *gorm.DB {
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
+// tryAdvisoryLock takes a session-level advisory lock on a dedicated connection of the primary,
+// locked is false when another process holds it. Call unlock once done
+func tryAdvisoryLock(key int64) (unlock func(), locked bool, err error) {
+	sqlDB, err := DBConn.DB()
 	if err != nil {
-		log.Fatalf("Failed to connect to shard DB: %v", err)
+		return nil, false, err
 	}
-	return db
-}
 
-func CreateTable() {
-	query := `
-	CREATE TABLE IF NOT EXISTS users (
-		user_id SERIAL PRIMARY KEY,
-		first_name TEXT NOT NULL,
-		last_name TEXT NOT NULL,
-		password TEXT NOT NULL,
-		is_admin BOOLEAN NOT NULL,
-    	updated_at TIMESTAMPTZ NOT NULL,
-    	created_at TIMESTAMPTZ NOT NULL,
-		email TEXT NOT NULL UNIQUE
-	)`
-
-	if err := DBConn.Exec(query).Error; err != nil {
-		log.Fatal(err)
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, false, err
 	}
 
-	fmt.Println("Users Table created successfully!")
-}
-
-func CreateJTITable() {
-	query := `
-	CREATE TABLE IF NOT EXISTS refresh_tokens (
-    	id SERIAL PRIMARY KEY,
-    	user_id TEXT NOT NULL,
-    	jti UUID NOT NULL,
-    	expiry TIMESTAMPTZ NOT NULL,
-    	is_revoked BOOLEAN DEFAULT FALSE
-	);`
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
 
-	if err := DBConn.Exec(query).Error; err != nil {
-		log.Fatal(err)
+	if !locked {
+		conn.Close()
+		return nil, false, nil
 	}
 
-	fmt.Println("Refresh Tokens Table created successfully!")
+	return func() {
+		conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", key)
+		conn.Close()
+	}, true, nil
 }
 
-func CreateUserMoodRecordsTable() {
-	query := `
-	CREATE TABLE IF NOT EXISTS user_mood_records (
-    	id UUID NOT NULL,
-    	user_id TEXT NOT NULL,
-    	year INTEGER NOT NULL,
-    	month INTEGER NOT NULL,
-    	day INTEGER NOT NULL,
-    	mood_id INTEGER NOT NULL,
-		updated_at TIMESTAMPTZ NOT NULL,
-		created_at TIMESTAMPTZ NOT NULL
-	);`
+// isAdvisoryLockHeld tells whether any session of the primary holds the advisory lock, a bigint key
+// shows up in pg_locks split into its high (classid) and low (objid) 32 bits
+func isAdvisoryLockHeld(ctx context.Context, key int64) (bool, error) {
+	var held bool
 
-	if err := DBConn.Exec(query).Error; err != nil {
-		log.Fatal(err)
-	}
+	err := DBConn.WithContext(ctx).Raw(`SELECT EXISTS (
+		SELECT 1 FROM pg_locks
+		WHERE locktype = 'advisory' AND database = (SELECT oid FROM pg_database WHERE datname = current_database())
+			AND classid = ? AND objid = ? AND objsubid = 1 AND granted
+	)`, uint32(key>>32), uint32(key)).Scan(&held).Error
 
-	fmt.Println("user mood table created!")
+	return held, err
 }
 
 func GetDB() *gorm.DB {
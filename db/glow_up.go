@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"time"
 )
 
@@ -35,7 +36,7 @@ func (s *MoodScore) TableName() string {
 	return "user_mood_records"
 }
 
-func CreateMoodScore(userId string, year int32, month int32, day int32, moodId int32) (MoodScore, error) {
+func CreateMoodScore(ctx context.Context, userId string, year int32, month int32, day int32, moodId int32) (MoodScore, error) {
 	moodScore := MoodScore{
 		UserId: userId,
 		Year:   year,
@@ -44,27 +45,48 @@ func CreateMoodScore(userId string, year int32, month int32, day int32, moodId i
 		MoodId: moodId,
 	}
 
-	if err := DBConn.Create(&moodScore).Error; err != nil {
+	shardDB, err := getWritableShardByUserID(ctx, userId)
+	if err != nil {
+		return MoodScore{}, err
+	}
+
+	if err := shardDB.Create(&moodScore).Error; err != nil {
 		return MoodScore{}, err
 	}
 
 	return moodScore, nil
 }
 
-func UpdateMoodScore(id string, moodId int32) error {
+// UpdateMoodScore changes the mood of a record owned by the user, records of other users are reported as not found
+func UpdateMoodScore(ctx context.Context, userId string, id string, moodId int32) (MoodScore, error) {
+	var moodScore MoodScore
+
+	shardDB, err := getWritableShardByUserID(ctx, userId)
+	if err != nil {
+		return MoodScore{}, err
+	}
+
+	if err := shardDB.Where("id = ? AND user_id = ?", id, userId).First(&moodScore).Error; err != nil {
+		return MoodScore{}, err
+	}
 
-	if err := DBConn.Model(&MoodScore{}).Where("id = ?", id).Update("mood_id", moodId).Error; err != nil {
-		return err
+	if err := shardDB.Model(&moodScore).Update("mood_id", moodId).Error; err != nil {
+		return MoodScore{}, err
 	}
 
-	return nil
+	return moodScore, nil
 }
 
-func GetMoodScores(userId string, year int, month int) (map[int32]map[int32]map[int32]MoodScore, error) {
+func GetMoodScores(ctx context.Context, userId string, year int, month int) (map[int32]map[int32]map[int32]MoodScore, error) {
 	var moodScores []MoodScore
 	result := make(map[int32]map[int32]map[int32]MoodScore)
 
-	if err := DBConn.Model(&MoodScore{}).Where("user_id = ? AND (year = ? AND month = ?) OR (year = ? AND month = ?) OR (year = ? AND month = ?)", userId, year, month, year, month+1, year, month-1).Find(&moodScores).Error; err != nil {
+	shardDB, _, err := determineShardByUserID(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := shardDB.Model(&MoodScore{}).Where("user_id = ? AND ((year = ? AND month = ?) OR (year = ? AND month = ?) OR (year = ? AND month = ?))", userId, year, month, year, month+1, year, month-1).Find(&moodScores).Error; err != nil {
 		return nil, err
 	}
 
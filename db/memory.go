@@ -0,0 +1,660 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// In-memory implementation of the repositories for tests, it keeps the semantics of the Postgres
+// one: not found and duplicate errors, conditional token rotation and the default roles
+
+type memoryStore struct {
+	mu sync.Mutex
+
+	users       map[string]User
+	userRoles   map[string][]string
+	credentials []WebAuthnCredential
+	tokens      []RefreshToken
+	versions    map[string]int
+	moods       map[string]MoodScore
+	todos       []Todo
+	nextTodoId  int
+}
+
+type MemoryUserRepository struct{ store *memoryStore }
+type MemoryTokenRepository struct{ store *memoryStore }
+type MemoryMoodRepository struct{ store *memoryStore }
+type MemoryTodoRepository struct{ store *memoryStore }
+type MemoryAdminRepository struct{ store *memoryStore }
+
+func NewMemoryRepositories() Repositories {
+	store := &memoryStore{
+		users:      map[string]User{},
+		userRoles:  map[string][]string{},
+		versions:   map[string]int{},
+		moods:      map[string]MoodScore{},
+		nextTodoId: 1,
+	}
+
+	return Repositories{
+		Users:  MemoryUserRepository{store},
+		Tokens: MemoryTokenRepository{store},
+		Moods:  MemoryMoodRepository{store},
+		Todos:  MemoryTodoRepository{store},
+		Admin:  MemoryAdminRepository{store},
+	}
+}
+
+func (s *memoryStore) findUserByEmail(email string) (User, bool) {
+	for _, user := range s.users {
+		if user.Email == email {
+			return user, true
+		}
+	}
+
+	return User{}, false
+}
+
+func (s *memoryStore) insertUser(user *User) error {
+	if _, ok := s.findUserByEmail(user.Email); ok {
+		return gorm.ErrDuplicatedKey
+	}
+
+	if user.UserId == "" {
+		user.UserId = uuid.New().String()
+	}
+
+	now := time.Now()
+	user.IsAdmin = true
+	user.CreatedAt = &now
+	user.UpdatedAt = now
+
+	stored := *user
+	stored.Credentials = nil
+	s.users[user.UserId] = stored
+	s.userRoles[user.UserId] = []string{RoleUser}
+
+	return nil
+}
+
+func (s *memoryStore) userCredentials(userId string) []WebAuthnCredential {
+	credentials := []WebAuthnCredential{}
+
+	for _, credential := range s.credentials {
+		if credential.UserId == userId {
+			credentials = append(credentials, credential)
+		}
+	}
+
+	return credentials
+}
+
+func (r MemoryUserRepository) CreateUser(_ context.Context, email string, password string, firstName string, lastName string) (string, error) {
+	// The lowest cost keeps tests fast, the hash is still checked like the stored ones
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		return "", errors.New("failed to hash password")
+	}
+
+	user := User{
+		Email:     email,
+		Password:  string(hashedPassword),
+		FirstName: firstName,
+		LastName:  lastName,
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if err := r.store.insertUser(&user); err != nil {
+		return "", err
+	}
+
+	return user.UserId, nil
+}
+
+func (r MemoryUserRepository) CreateWebAuthnUser(_ context.Context, webAuthnUser *User, credential WebAuthnCredential) (string, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for _, stored := range r.store.credentials {
+		if bytes.Equal(stored.CredentialID, credential.CredentialID) {
+			return "", gorm.ErrDuplicatedKey
+		}
+	}
+
+	if err := r.store.insertUser(webAuthnUser); err != nil {
+		return "", err
+	}
+
+	credential.ID = uuid.New().String()
+	credential.UserId = webAuthnUser.UserId
+	credential.CreatedAt = time.Now()
+	credential.UpdatedAt = credential.CreatedAt
+
+	r.store.credentials = append(r.store.credentials, credential)
+	webAuthnUser.Credentials = []WebAuthnCredential{credential}
+
+	return webAuthnUser.UserId, nil
+}
+
+func (r MemoryUserRepository) Authenticate(_ context.Context, email string, password string) (*User, error) {
+	r.store.mu.Lock()
+	user, ok := r.store.findUserByEmail(email)
+	r.store.mu.Unlock()
+
+	if !ok || !user.IsAdmin {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("user not found"))
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("password is incorrect"))
+	}
+
+	return &user, nil
+}
+
+func (r MemoryUserRepository) GetUserById(_ context.Context, id string) (User, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return User{}, ErrInvalidUserID
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	user, ok := r.store.users[id]
+	if !ok {
+		return User{}, gorm.ErrRecordNotFound
+	}
+
+	return user, nil
+}
+
+func (r MemoryUserRepository) GetUserByEmail(_ context.Context, email string) (User, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	user, ok := r.store.findUserByEmail(email)
+	if !ok {
+		return User{}, gorm.ErrRecordNotFound
+	}
+
+	return user, nil
+}
+
+func (r MemoryUserRepository) GetWebAuthnUser(_ context.Context, id string) (*User, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	user, ok := r.store.users[id]
+	if !ok || !user.IsAdmin {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("user not found"))
+	}
+
+	user.Credentials = r.store.userCredentials(id)
+
+	return &user, nil
+}
+
+func (r MemoryUserRepository) GetWebAuthnCredentials(_ context.Context, userId string) ([]WebAuthnCredential, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	return r.store.userCredentials(userId), nil
+}
+
+func (r MemoryUserRepository) CreateWebAuthnCredential(_ context.Context, credential *WebAuthnCredential) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for _, stored := range r.store.credentials {
+		if bytes.Equal(stored.CredentialID, credential.CredentialID) {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+
+	credential.ID = uuid.New().String()
+	credential.CreatedAt = time.Now()
+	credential.UpdatedAt = credential.CreatedAt
+
+	r.store.credentials = append(r.store.credentials, *credential)
+
+	return nil
+}
+
+func (r MemoryUserRepository) UpdateWebAuthnCredentialUsage(_ context.Context, credential *webauthn.Credential) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	now := time.Now()
+
+	for i, stored := range r.store.credentials {
+		if !bytes.Equal(stored.CredentialID, credential.ID) {
+			continue
+		}
+
+		stored.SignCount = credential.Authenticator.SignCount
+		stored.CloneWarning = credential.Authenticator.CloneWarning
+		stored.UserPresent = credential.Flags.UserPresent
+		stored.UserVerified = credential.Flags.UserVerified
+		stored.BackupState = credential.Flags.BackupState
+		stored.LastUsedAt = &now
+		stored.UpdatedAt = now
+
+		r.store.credentials[i] = stored
+	}
+
+	return nil
+}
+
+func (r MemoryUserRepository) RenameWebAuthnCredential(_ context.Context, userId string, id string, name string) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for i, stored := range r.store.credentials {
+		if stored.ID == id && stored.UserId == userId {
+			r.store.credentials[i].Name = name
+			r.store.credentials[i].UpdatedAt = time.Now()
+			return nil
+		}
+	}
+
+	return gorm.ErrRecordNotFound
+}
+
+func (r MemoryUserRepository) DeleteWebAuthnCredential(_ context.Context, userId string, id string) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for i, stored := range r.store.credentials {
+		if stored.ID == id && stored.UserId == userId {
+			r.store.credentials = slices.Delete(r.store.credentials, i, i+1)
+			return nil
+		}
+	}
+
+	return gorm.ErrRecordNotFound
+}
+
+func (r MemoryUserRepository) GetRoles(_ context.Context) ([]Role, error) {
+	roles := []Role{}
+
+	for roleName, permissionNames := range defaultRoles {
+		role := Role{ID: roleName, Name: roleName, Description: roleDescriptions[roleName], Permissions: []Permission{}}
+
+		for _, permissionName := range permissionNames {
+			role.Permissions = append(role.Permissions, Permission{ID: permissionName, Name: permissionName})
+		}
+
+		roles = append(roles, role)
+	}
+
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+
+	return roles, nil
+}
+
+func (r MemoryUserRepository) GetUserRolesAndPermissions(_ context.Context, userId string) ([]string, []string, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	roleNames := slices.Clone(r.store.userRoles[userId])
+	permissionNames := []string{}
+
+	for _, roleName := range roleNames {
+		for _, permissionName := range defaultRoles[roleName] {
+			if !slices.Contains(permissionNames, permissionName) {
+				permissionNames = append(permissionNames, permissionName)
+			}
+		}
+	}
+
+	if roleNames == nil {
+		roleNames = []string{}
+	}
+
+	slices.Sort(roleNames)
+	slices.Sort(permissionNames)
+
+	return roleNames, permissionNames, nil
+}
+
+func (r MemoryUserRepository) SetUserRoles(_ context.Context, userId string, roleNames []string) error {
+	roles := []string{}
+
+	for _, roleName := range roleNames {
+		if _, ok := defaultRoles[roleName]; !ok {
+			return gorm.ErrRecordNotFound
+		}
+		if !slices.Contains(roles, roleName) {
+			roles = append(roles, roleName)
+		}
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	r.store.userRoles[userId] = roles
+
+	return nil
+}
+
+func (r MemoryTokenRepository) StoreRefreshToken(_ context.Context, token RefreshToken) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	token.ID = uuid.New().String()
+	r.store.tokens = append(r.store.tokens, token)
+
+	return nil
+}
+
+func (r MemoryTokenRepository) GetRefreshTokenByJTI(_ context.Context, userId string, jti string) (RefreshToken, error) {
+	if _, err := uuid.Parse(userId); err != nil {
+		return RefreshToken{}, ErrInvalidUserID
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for _, token := range r.store.tokens {
+		if token.JTI == jti && token.UserID == userId {
+			return token, nil
+		}
+	}
+
+	return RefreshToken{}, gorm.ErrRecordNotFound
+}
+
+func (r MemoryTokenRepository) RotateRefreshToken(_ context.Context, oldJTI string, newToken RefreshToken) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	rotated := false
+
+	for i, token := range r.store.tokens {
+		if token.JTI == oldJTI && !token.IsRevoked {
+			r.store.tokens[i].IsRevoked = true
+			r.store.tokens[i].ReplacedBy = newToken.JTI
+			rotated = true
+		}
+	}
+
+	if !rotated {
+		return ErrRefreshTokenRotated
+	}
+
+	newToken.ID = uuid.New().String()
+	r.store.tokens = append(r.store.tokens, newToken)
+
+	return nil
+}
+
+func (r MemoryTokenRepository) RevokeRefreshTokenFamily(_ context.Context, userId string, familyId string) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for i, token := range r.store.tokens {
+		if token.FamilyID == familyId {
+			r.store.tokens[i].IsRevoked = true
+		}
+	}
+
+	return nil
+}
+
+func (r MemoryTokenRepository) RevokeUserRefreshTokens(_ context.Context, userId string) error {
+	if _, err := uuid.Parse(userId); err != nil {
+		return ErrInvalidUserID
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for i, token := range r.store.tokens {
+		if token.UserID == userId {
+			r.store.tokens[i].IsRevoked = true
+		}
+	}
+
+	return nil
+}
+
+func (r MemoryTokenRepository) GetAccessTokenVersion(_ context.Context, userId string) (int, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	return r.store.versions[userId], nil
+}
+
+func (r MemoryTokenRepository) RevokeAccessTokens(_ context.Context, userId string) error {
+	if _, err := uuid.Parse(userId); err != nil {
+		return ErrInvalidUserID
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	r.store.versions[userId]++
+
+	return nil
+}
+
+func (r MemoryMoodRepository) CreateMoodScore(_ context.Context, userId string, year int32, month int32, day int32, moodId int32) (MoodScore, error) {
+	now := time.Now()
+
+	moodScore := MoodScore{
+		ID:        uuid.New().String(),
+		UserId:    userId,
+		Year:      year,
+		Month:     month,
+		Day:       day,
+		MoodId:    moodId,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	r.store.moods[moodScore.ID] = moodScore
+
+	return moodScore, nil
+}
+
+func (r MemoryMoodRepository) UpdateMoodScore(_ context.Context, userId string, id string, moodId int32) (MoodScore, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	moodScore, ok := r.store.moods[id]
+	if !ok || moodScore.UserId != userId {
+		return MoodScore{}, gorm.ErrRecordNotFound
+	}
+
+	moodScore.MoodId = moodId
+	moodScore.UpdatedAt = time.Now()
+	r.store.moods[id] = moodScore
+
+	return moodScore, nil
+}
+
+func (r MemoryMoodRepository) GetMoodScores(_ context.Context, userId string, year int, month int) (map[int32]map[int32]map[int32]MoodScore, error) {
+	result := make(map[int32]map[int32]map[int32]MoodScore)
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for _, moodScore := range r.store.moods {
+		// Same months as the Postgres query, the requested one and its neighbours in the same year
+		if moodScore.UserId != userId || int(moodScore.Year) != year || int(moodScore.Month) < month-1 || int(moodScore.Month) > month+1 {
+			continue
+		}
+
+		if _, ok := result[moodScore.Year]; !ok {
+			result[moodScore.Year] = make(map[int32]map[int32]MoodScore)
+		}
+		if _, ok := result[moodScore.Year][moodScore.Month]; !ok {
+			result[moodScore.Year][moodScore.Month] = make(map[int32]MoodScore)
+		}
+		result[moodScore.Year][moodScore.Month][moodScore.Day] = moodScore
+	}
+
+	return result, nil
+}
+
+func (r MemoryTodoRepository) GetTodos(_ context.Context, userId string) ([]Todo, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	todos := []Todo{}
+
+	for _, todo := range r.store.todos {
+		if todo.UserId == userId {
+			todos = append(todos, todo)
+		}
+	}
+
+	return todos, nil
+}
+
+func (r MemoryTodoRepository) CreateTodo(_ context.Context, userId string, title string, body string, done bool) (Todo, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	now := time.Now()
+
+	todo := Todo{
+		ID:        r.store.nextTodoId,
+		UserId:    userId,
+		Title:     title,
+		Body:      body,
+		Done:      done,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	r.store.nextTodoId++
+	r.store.todos = append(r.store.todos, todo)
+
+	return todo, nil
+}
+
+// updateTodo applies the change to the todo of the user, todos of other users are reported as not found
+func (r MemoryTodoRepository) updateTodo(userId string, id int, update func(todo *Todo)) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for i := range r.store.todos {
+		if r.store.todos[i].ID == id && r.store.todos[i].UserId == userId {
+			update(&r.store.todos[i])
+			r.store.todos[i].UpdatedAt = time.Now()
+			return nil
+		}
+	}
+
+	return gorm.ErrRecordNotFound
+}
+
+func (r MemoryTodoRepository) UpdateTodo(_ context.Context, userId string, id int, title string, body string, done bool) error {
+	return r.updateTodo(userId, id, func(todo *Todo) {
+		todo.Title = title
+		todo.Body = body
+		todo.Done = done
+	})
+}
+
+func (r MemoryTodoRepository) ToggleTodoStatus(_ context.Context, userId string, id int) error {
+	return r.updateTodo(userId, id, func(todo *Todo) {
+		todo.Done = !todo.Done
+	})
+}
+
+func (r MemoryTodoRepository) DeleteTodo(_ context.Context, userId string, id int) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for i, todo := range r.store.todos {
+		if todo.ID == id && todo.UserId == userId {
+			r.store.todos = slices.Delete(r.store.todos, i, i+1)
+			return nil
+		}
+	}
+
+	return gorm.ErrRecordNotFound
+}
+
+// The memory store acts as a single shard without an outbox, everything it holds is reconciled
+
+const memoryShardName = "memory"
+
+func (r MemoryAdminRepository) GetOutboxSummary(_ context.Context, status string, limit int) (OutboxSummary, error) {
+	return OutboxSummary{Entries: []OutboxEntry{}}, nil
+}
+
+func (r MemoryAdminRepository) RetryOutboxEntry(_ context.Context, id int64) error {
+	return gorm.ErrRecordNotFound
+}
+
+func (r MemoryAdminRepository) GetShardStatuses(_ context.Context) ShardMapStatus {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	return ShardMapStatus{Shards: []ShardStatus{{Name: memoryShardName, Weight: 1, Healthy: true, Users: int64(len(r.store.users))}}}
+}
+
+func (r MemoryAdminRepository) ListShardUsers(ctx context.Context, email string, offset int, limit int) ScatterResult[User] {
+	return scatterGather(ctx, []string{memoryShardName}, func(_ context.Context, _ int, fetch int) ([]User, error) {
+		r.store.mu.Lock()
+		defer r.store.mu.Unlock()
+
+		users := []User{}
+		for _, user := range r.store.users {
+			if email == "" || user.Email == email {
+				users = append(users, user)
+			}
+		}
+
+		return users, nil
+	}, ScatterOptions[User]{
+		Less:   func(a, b User) bool { return a.Email < b.Email },
+		Offset: offset,
+		Limit:  limit,
+	})
+}
+
+func (r MemoryAdminRepository) CountShardMoodScores(_ context.Context, year int, month int) (int64, []ShardError) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	var count int64
+	for _, moodScore := range r.store.moods {
+		if int(moodScore.Year) == year && int(moodScore.Month) == month {
+			count++
+		}
+	}
+
+	return count, []ShardError{}
+}
+
+func (r MemoryAdminRepository) IsReconcileRunning(_ context.Context) (bool, error) {
+	return false, nil
+}
+
+func (r MemoryAdminRepository) GetLastReconcileReport(_ context.Context) (*ReconcileReport, error) {
+	return nil, nil
+}
+
+func (r MemoryAdminRepository) StartReconcile(_ context.Context, dryRun bool) error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+)
+
+var (
+	outboxEnqueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "shard_outbox_enqueued_total",
+		Help: "Shard writes recorded in the outbox by QueueShardWrite, including ones rolled back with their transaction.",
+	})
+	outboxDeadLettered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "shard_outbox_dead_lettered_total",
+		Help: "Shard writes given up after OUTBOX_MAX_ATTEMPTS attempts.",
+	})
+	shardWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shard_writes_total",
+		Help: "Users written to their shard by the outbox worker, by shard and result (success, failure or read_only).",
+	}, []string{"shard", "result"})
+)
+
+func recordShardWrite(shard string, err error) {
+	result := "success"
+
+	if errors.Is(err, ErrShardReadOnly) {
+		result = "read_only"
+	} else if err != nil {
+		result = "failure"
+	}
+
+	shardWrites.WithLabelValues(shard, result).Inc()
+}
+
+var (
+	outboxEntriesDesc = prometheus.NewDesc("shard_outbox_entries", "Entries of the shard outbox by status, pending ones are the queue still to deliver.", []string{"status"}, nil)
+
+	poolOpenDesc         = prometheus.NewDesc("db_pool_open_connections", "Open connections, in use and idle.", []string{"database"}, nil)
+	poolInUseDesc        = prometheus.NewDesc("db_pool_in_use_connections", "Connections in use.", []string{"database"}, nil)
+	poolIdleDesc         = prometheus.NewDesc("db_pool_idle_connections", "Idle connections.", []string{"database"}, nil)
+	poolMaxOpenDesc      = prometheus.NewDesc("db_pool_max_open_connections", "Maximum number of open connections, 0 is unlimited.", []string{"database"}, nil)
+	poolWaitCountDesc    = prometheus.NewDesc("db_pool_wait_count_total", "Connections waited for.", []string{"database"}, nil)
+	poolWaitDurationDesc = prometheus.NewDesc("db_pool_wait_duration_seconds_total", "Time spent waiting for a connection.", []string{"database"}, nil)
+)
+
+// dbCollector reads the pool stats of the primary and the shards of the current topology,
+// and the outbox counts, when the metrics are scraped
+type dbCollector struct{}
+
+func (dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{outboxEntriesDesc, poolOpenDesc, poolInUseDesc, poolIdleDesc, poolMaxOpenDesc, poolWaitCountDesc, poolWaitDurationDesc} {
+		ch <- desc
+	}
+}
+
+func (dbCollector) Collect(ch chan<- prometheus.Metric) {
+	// Not connected, e.g. in the tests running on the memory repositories
+	if DBConn == nil {
+		return
+	}
+
+	collectPoolStats(ch, "primary", DBConn)
+
+	if t := currentTopology(); t != nil {
+		for i, shard := range t.shards {
+			collectPoolStats(ch, shard.Name, t.conns[i])
+		}
+	}
+
+	var counts []struct {
+		Status string
+		Count  int64
+	}
+
+	err := DBConn.Model(&OutboxEntry{}).
+		Select("status, COUNT(*) AS count").
+		Where("status IN ?", []string{OutboxStatusPending, OutboxStatusFailed}).
+		Group("status").
+		Scan(&counts).Error
+
+	if err != nil {
+		slog.Warn("Failed to count shard outbox entries", "error", err)
+		return
+	}
+
+	byStatus := map[string]int64{OutboxStatusPending: 0, OutboxStatusFailed: 0}
+	for _, count := range counts {
+		byStatus[count.Status] = count.Count
+	}
+
+	for status, count := range byStatus {
+		ch <- prometheus.MustNewConstMetric(outboxEntriesDesc, prometheus.GaugeValue, float64(count), status)
+	}
+}
+
+func collectPoolStats(ch chan<- prometheus.Metric, database string, conn *gorm.DB) {
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return
+	}
+
+	stats := sqlDB.Stats()
+
+	ch <- prometheus.MustNewConstMetric(poolOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections), database)
+	ch <- prometheus.MustNewConstMetric(poolInUseDesc, prometheus.GaugeValue, float64(stats.InUse), database)
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.Idle), database)
+	ch <- prometheus.MustNewConstMetric(poolMaxOpenDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections), database)
+	ch <- prometheus.MustNewConstMetric(poolWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount), database)
+	ch <- prometheus.MustNewConstMetric(poolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds(), database)
+}
+
+func init() {
+	prometheus.MustRegister(dbCollector{})
+}
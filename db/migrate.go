@@ -0,0 +1,331 @@
+package db
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations/primary/*.sql migrations/shard/*.sql
+var migrationFiles embed.FS
+
+const (
+	PrimaryMigrations = "migrations/primary"
+	ShardMigrations   = "migrations/shard"
+)
+
+// Arbitrary key for pg_advisory_xact_lock, serializes migrations run by several instances
+const migrationLockKey = 72190412
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// Row of schema_migrations
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Name      string    `json:"name"`
+	Checksum  string    `json:"checksum"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedAt"`
+	Modified  bool       `json:"modified"` // Applied file changed since
+}
+
+// LoadMigrations reads the <version>_<name>.up.sql / .down.sql pairs of a migration set ordered by version
+func LoadMigrations(dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make(map[int]*Migration)
+
+	for _, entry := range entries {
+		fileName := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionPart, name, found := strings.Cut(base, "_")
+		if !found {
+			return nil, fmt.Errorf("invalid migration file name %s", fileName)
+		}
+
+		version, err := strconv.Atoi(versionPart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s", fileName)
+		}
+
+		content, err := fs.ReadFile(migrationFiles, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := migrations[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: name}
+			migrations[version] = migration
+		} else if migration.Name != name {
+			return nil, fmt.Errorf("migration %d has conflicting names %s and %s", version, migration.Name, name)
+		}
+
+		if direction == "up" {
+			migration.Up = string(content)
+			checksum := sha256.Sum256(content)
+			migration.Checksum = hex.EncodeToString(checksum[:])
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	result := []Migration{}
+	for _, migration := range migrations {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down files", migration.Version, migration.Name)
+		}
+		result = append(result, *migration)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+
+	return result, nil
+}
+
+func ensureSchemaMigrationsTable(conn *gorm.DB) error {
+	return conn.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL
+	)`).Error
+}
+
+func getAppliedMigrations(conn *gorm.DB) (map[int]SchemaMigration, error) {
+	var rows []SchemaMigration
+
+	if err := conn.Order("version ASC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]SchemaMigration)
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+// MigrateUp applies every pending migration of the set, each one in its own transaction
+func MigrateUp(conn *gorm.DB, dir string) (int, error) {
+	migrations, err := LoadMigrations(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := ensureSchemaMigrationsTable(conn); err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, migration := range migrations {
+		applied := false
+
+		err := conn.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockKey).Error; err != nil {
+				return err
+			}
+
+			var existing SchemaMigration
+			result := tx.Where("version = ?", migration.Version).Limit(1).Find(&existing)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			if result.RowsAffected > 0 {
+				if existing.Checksum != migration.Checksum {
+					return fmt.Errorf("migration %d_%s was modified after it was applied", migration.Version, migration.Name)
+				}
+				return nil
+			}
+
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+
+			applied = true
+
+			return tx.Create(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Checksum:  migration.Checksum,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+
+		if err != nil {
+			return count, err
+		}
+
+		if applied {
+			slog.Info("Applied migration", "version", migration.Version, "name", migration.Name)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// MigrateDown reverts the given number of most recently applied migrations
+func MigrateDown(conn *gorm.DB, dir string, steps int) (int, error) {
+	migrations, err := LoadMigrations(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := ensureSchemaMigrationsTable(conn); err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		migration := migrations[i]
+		reverted := false
+
+		err := conn.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockKey).Error; err != nil {
+				return err
+			}
+
+			result := tx.Where("version = ?", migration.Version).Delete(&SchemaMigration{})
+			if result.Error != nil {
+				return result.Error
+			}
+
+			if result.RowsAffected == 0 {
+				return nil
+			}
+
+			if err := tx.Exec(migration.Down).Error; err != nil {
+				return fmt.Errorf("reverting migration %d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+
+			reverted = true
+
+			return nil
+		})
+
+		if err != nil {
+			return count, err
+		}
+
+		if reverted {
+			slog.Info("Reverted migration", "version", migration.Version, "name", migration.Name)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func GetMigrationStatus(conn *gorm.DB, dir string) ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensureSchemaMigrationsTable(conn); err != nil {
+		return nil, err
+	}
+
+	applied, err := getAppliedMigrations(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+
+	for _, migration := range migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+
+		if row, ok := applied[migration.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.Applied = true
+			status.AppliedAt = &appliedAt
+			status.Modified = row.Checksum != migration.Checksum
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// CheckMigrations returns an error when a migration of the set is pending or was modified after being applied
+func CheckMigrations(conn *gorm.DB, dir string) error {
+	statuses, err := GetMigrationStatus(conn, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		if !status.Applied {
+			return fmt.Errorf("migration %d_%s is not applied, run `migrate up`", status.Version, status.Name)
+		}
+		if status.Modified {
+			return fmt.Errorf("migration %d_%s was modified after it was applied", status.Version, status.Name)
+		}
+	}
+
+	return nil
+}
+
+// Targets of the migration commands: the primary and every shard with their migration set
+type MigrationTarget struct {
+	Name string
+	Conn *gorm.DB
+	Dir  string
+}
+
+func GetMigrationTargets() []MigrationTarget {
+	targets := []MigrationTarget{{Name: "primary", Conn: DBConn, Dir: PrimaryMigrations}}
+
+	t := currentTopology()
+	for i, shard := range t.shards {
+		targets = append(targets, MigrationTarget{Name: shard.Name, Conn: t.conns[i], Dir: ShardMigrations})
+	}
+
+	return targets
+}
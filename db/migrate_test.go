@@ -0,0 +1,138 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// testDatabase connects to the Postgres database in TEST_DATABASE_URL, in a schema of its own dropped afterwards
+func testDatabase(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	conn, err := gorm.Open(postgres.Open(dsn), gormConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := conn.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A single connection, so the search path set below holds for every query
+	sqlDB.SetMaxOpenConns(1)
+
+	schema := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	if err := conn.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Exec("DROP SCHEMA " + schema + " CASCADE")
+		sqlDB.Close()
+	})
+
+	if err := conn.Exec("SET search_path TO " + schema + ", public").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+// Tables as the server created them with AutoMigrate before the migrations, users had no key on user_id
+type baselineUser struct {
+	UserId    string `gorm:"type:uuid;default:uuid_generate_v4()"`
+	Email     string `gorm:"unique;default:uuid_generate_v4()"`
+	FirstName string
+	LastName  string
+	Password  string
+	IsAdmin   bool `gorm:"default:false"`
+	CreatedAt *time.Time
+	UpdatedAt time.Time
+}
+
+func (u *baselineUser) TableName() string {
+	return "users"
+}
+
+type baselineRefreshToken struct {
+	ID          string `gorm:"type:uuid;default:uuid_generate_v4()"`
+	UserID      string
+	JTI         string
+	AccessToken string
+	Expiry      string
+	IsRevoked   bool
+}
+
+func (r *baselineRefreshToken) TableName() string {
+	return "refresh_tokens"
+}
+
+type baselineMoodScore struct {
+	ID        string `gorm:"type:uuid;default:uuid_generate_v4()"`
+	UserId    string
+	Year      int32
+	Month     int32
+	Day       int32
+	MoodId    int32
+	UpdatedAt time.Time
+	CreatedAt time.Time
+}
+
+func (s *baselineMoodScore) TableName() string {
+	return "user_mood_records"
+}
+
+func TestPrimaryMigrationsOnAutoMigratedSchema(t *testing.T) {
+	conn := testDatabase(t)
+
+	if err := conn.Exec(`CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.AutoMigrate(&baselineUser{}, &baselineMoodScore{}, &baselineRefreshToken{}); err != nil {
+		t.Fatal(err)
+	}
+
+	user := baselineUser{Email: "existing@example.com", UpdatedAt: time.Now()}
+	if err := conn.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MigrateUp(conn, PrimaryMigrations); err != nil {
+		t.Fatalf("expected the migrations to apply on a schema created by AutoMigrate, got %v", err)
+	}
+
+	if err := CheckMigrations(conn, PrimaryMigrations); err != nil {
+		t.Fatal(err)
+	}
+
+	// Access token versions reference existing users only
+	if err := conn.Exec("INSERT INTO access_token_versions (user_id, version) VALUES (?, 1)", user.UserId).Error; err != nil {
+		t.Errorf("expected a version for an existing user to be stored, got %v", err)
+	}
+	if err := conn.Exec("INSERT INTO access_token_versions (user_id, version) VALUES (?, 1)", uuid.New().String()).Error; err == nil {
+		t.Error("expected a version for an unknown user to be rejected")
+	}
+
+	// And back down, e.g. for a rollback of the release
+	migrations, err := LoadMigrations(PrimaryMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MigrateDown(conn, PrimaryMigrations, len(migrations)); err != nil {
+		t.Fatalf("expected the migrations to revert, got %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+ALTER TABLE users ADD COLUMN credential_id BYTEA;
+ALTER TABLE users ADD COLUMN public_key BYTEA;
+ALTER TABLE users ADD COLUMN authenticator_aa_guid BYTEA;
+ALTER TABLE users ADD COLUMN sign_count BIGINT;
+
+-- Only one credential per user fits inline, keep the oldest
+UPDATE users SET
+    credential_id = first_credential.credential_id,
+    public_key = first_credential.public_key,
+    authenticator_aa_guid = first_credential.aaguid,
+    sign_count = first_credential.sign_count
+FROM (
+    SELECT DISTINCT ON (user_id) user_id, credential_id, public_key, aaguid, sign_count
+    FROM webauthn_credentials
+    ORDER BY user_id, created_at ASC
+) AS first_credential
+WHERE users.user_id::text = first_credential.user_id;
+
+DROP TABLE webauthn_credentials;
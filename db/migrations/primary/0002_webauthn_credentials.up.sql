@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id TEXT,
+    name TEXT,
+    credential_id BYTEA,
+    public_key BYTEA,
+    attestation_type TEXT,
+    transports TEXT,
+    attachment TEXT,
+    aaguid BYTEA,
+    sign_count BIGINT,
+    clone_warning BOOLEAN,
+    user_present BOOLEAN,
+    user_verified BOOLEAN,
+    backup_eligible BOOLEAN,
+    backup_state BOOLEAN,
+    last_used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_webauthn_credentials_credential_id ON webauthn_credentials (credential_id);
+
+-- Move the single credential previously stored inline on users
+ALTER TABLE users ADD COLUMN IF NOT EXISTS credential_id BYTEA;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS public_key BYTEA;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS authenticator_aa_guid BYTEA;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS sign_count BIGINT;
+
+INSERT INTO webauthn_credentials (id, user_id, name, credential_id, public_key, aaguid, sign_count, transports, created_at, updated_at)
+SELECT uuid_generate_v4(), user_id, 'Passkey', credential_id, public_key, authenticator_aa_guid, sign_count, '[]', NOW(), NOW()
+FROM users
+WHERE credential_id IS NOT NULL AND length(credential_id) > 0
+ON CONFLICT (credential_id) DO NOTHING;
+
+ALTER TABLE users DROP COLUMN credential_id;
+ALTER TABLE users DROP COLUMN public_key;
+ALTER TABLE users DROP COLUMN authenticator_aa_guid;
+ALTER TABLE users DROP COLUMN sign_count;
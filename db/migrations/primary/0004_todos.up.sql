@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS todos (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL,
+    title TEXT,
+    done BOOLEAN DEFAULT FALSE,
+    body TEXT,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_todos_user_id ON todos (user_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS reshard_jobs;
+DROP TABLE IF EXISTS shard_map;
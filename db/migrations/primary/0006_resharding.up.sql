@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS shard_map (
+    version INTEGER PRIMARY KEY,
+    shards JSONB NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- At most one layout routes traffic at a time
+CREATE UNIQUE INDEX IF NOT EXISTS idx_shard_map_active ON shard_map (active) WHERE active;
+
+CREATE TABLE IF NOT EXISTS reshard_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    from_version INTEGER NOT NULL REFERENCES shard_map (version),
+    to_version INTEGER NOT NULL REFERENCES shard_map (version),
+    phase TEXT NOT NULL,
+    last_user_id TEXT NOT NULL DEFAULT '',
+    moved BIGINT NOT NULL DEFAULT 0,
+    deleted BIGINT NOT NULL DEFAULT 0,
+    skipped BIGINT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1 @@
+ALTER TABLE shard_outbox DROP COLUMN IF EXISTS trace_context;
@@ -0,0 +1,2 @@
+-- W3C traceparent of the request that queued the write, the worker links its span to it
+ALTER TABLE shard_outbox ADD COLUMN IF NOT EXISTS trace_context TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS todos_updated_at ON todos;
+DROP FUNCTION IF EXISTS todos_set_updated_at();
+
+ALTER TABLE todos
+    ALTER COLUMN created_at DROP DEFAULT,
+    ALTER COLUMN created_at DROP NOT NULL,
+    ALTER COLUMN updated_at DROP DEFAULT,
+    ALTER COLUMN updated_at DROP NOT NULL;
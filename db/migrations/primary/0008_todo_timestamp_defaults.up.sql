@@ -0,0 +1,19 @@
+-- Timestamps of todos are set by the database, created_at on insert and updated_at by the trigger on every update
+UPDATE todos SET created_at = NOW() WHERE created_at IS NULL;
+UPDATE todos SET updated_at = created_at WHERE updated_at IS NULL;
+
+ALTER TABLE todos
+    ALTER COLUMN created_at SET DEFAULT NOW(),
+    ALTER COLUMN created_at SET NOT NULL,
+    ALTER COLUMN updated_at SET DEFAULT NOW(),
+    ALTER COLUMN updated_at SET NOT NULL;
+
+CREATE OR REPLACE FUNCTION todos_set_updated_at() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated_at = NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS todos_updated_at ON todos;
+CREATE TRIGGER todos_updated_at BEFORE UPDATE ON todos FOR EACH ROW EXECUTE FUNCTION todos_set_updated_at();
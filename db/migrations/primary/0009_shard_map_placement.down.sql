@@ -0,0 +1 @@
+ALTER TABLE shard_map DROP COLUMN IF EXISTS placement;
@@ -0,0 +1,2 @@
+-- Stored shard maps were placed on the ring, only the layout from the environment keeps the modulo placement
+ALTER TABLE shard_map ADD COLUMN IF NOT EXISTS placement TEXT NOT NULL DEFAULT 'ring';
@@ -0,0 +1 @@
+ALTER TABLE reshard_jobs DROP COLUMN IF EXISTS fence_version;
@@ -0,0 +1,2 @@
+-- Old layout with the shards losing users read-only, activated between the last sync and the flip
+ALTER TABLE reshard_jobs ADD COLUMN IF NOT EXISTS fence_version INTEGER REFERENCES shard_map (version);
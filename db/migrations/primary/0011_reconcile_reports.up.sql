@@ -0,0 +1,9 @@
+-- Reports of every reconciliation, so each instance serves the last one whichever instance ran it
+CREATE TABLE IF NOT EXISTS reconcile_reports (
+    id BIGSERIAL PRIMARY KEY,
+    dry_run BOOLEAN NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ,
+    shards JSONB NOT NULL DEFAULT '[]',
+    error TEXT NOT NULL DEFAULT ''
+);
@@ -0,0 +1,9 @@
+-- Finished runs of backfill-shards, the server refuses to start while mood records or refresh tokens
+-- are left on the primary and no run finished
+CREATE TABLE IF NOT EXISTS shard_backfills (
+    id BIGSERIAL PRIMARY KEY,
+    mood_scores BIGINT NOT NULL,
+    refresh_tokens BIGINT NOT NULL,
+    skipped BIGINT NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
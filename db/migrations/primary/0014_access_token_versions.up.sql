@@ -0,0 +1,6 @@
+-- Version of the access tokens of a user, a logout increments it and tokens issued with an older one are rejected
+CREATE TABLE IF NOT EXISTS access_token_versions (
+    user_id UUID PRIMARY KEY REFERENCES users (user_id) ON DELETE CASCADE,
+    version INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,2 @@
+-- Shard writes upsert on user_id, tables created by AutoMigrate had no key on it
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_id ON users (user_id);
@@ -0,0 +1,457 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/oleksiip-aiola/go-server/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	OutboxStatusPending   = "pending"
+	OutboxStatusDelivered = "delivered"
+	OutboxStatusFailed    = "failed" // Dead-lettered after OUTBOX_MAX_ATTEMPTS
+)
+
+const outboxAggregateUser = "user"
+
+var OUTBOX_MAX_ATTEMPTS = 8
+var OUTBOX_POLL_INTERVAL = time.Second
+var OUTBOX_BATCH_SIZE = 50
+var OUTBOX_BASE_BACKOFF = 2 * time.Second
+var OUTBOX_MAX_BACKOFF = 10 * time.Minute
+
+// A claimed entry is not claimed again for OUTBOX_LEASE. The lease is renewed when its delivery starts,
+// so OUTBOX_DELIVERY_TIMEOUT has to stay below it, not the delivery of the whole batch
+var OUTBOX_LEASE = time.Minute
+var OUTBOX_DELIVERY_TIMEOUT = 15 * time.Second
+
+// Delivered entries are deleted after OUTBOX_RETENTION, dead-lettered ones are kept for a retry
+var OUTBOX_RETENTION = 7 * 24 * time.Hour
+var OUTBOX_PRUNE_INTERVAL = time.Hour
+var OUTBOX_PRUNE_BATCH_SIZE = 1000
+
+// Pending shard write stored in the primary, in the same transaction as the change it replicates
+type OutboxEntry struct {
+	ID            int64      `gorm:"primaryKey" json:"id"`
+	AggregateType string     `json:"aggregateType"`
+	AggregateID   string     `json:"aggregateId"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"lastError"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt"`
+	TraceContext  string     `json:"-"` // traceparent of the request that queued the write
+	DeliveredAt   *time.Time `json:"deliveredAt"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+func (e *OutboxEntry) TableName() string {
+	return "shard_outbox"
+}
+
+// Wakes the worker up right after a commit instead of waiting for the next poll
+var outboxNotify = make(chan struct{}, 1)
+
+// QueueShardWrite records in the outbox that the user has to be copied to its shard.
+// It must be called with the transaction that writes the user to the primary
+func QueueShardWrite(tx *gorm.DB, user User) error {
+	entry := OutboxEntry{
+		AggregateType: outboxAggregateUser,
+		AggregateID:   user.UserId,
+		Status:        OutboxStatusPending,
+		NextAttemptAt: time.Now(),
+		TraceContext:  tracing.TraceParent(tx.Statement.Context),
+	}
+
+	if err := tx.Create(&entry).Error; err != nil {
+		return err
+	}
+
+	outboxEnqueued.Inc()
+	slog.Debug("User enqueued for shard write", "user_id", user.UserId)
+
+	return nil
+}
+
+// NotifyShardWorker triggers a delivery run, call it once the transaction with QueueShardWrite committed
+func NotifyShardWorker() {
+	select {
+	case outboxNotify <- struct{}{}:
+	default:
+	}
+}
+
+// Background worker that delivers outbox entries to the shards until ctx is done
+func shardWorker(ctx context.Context) {
+	ticker := time.NewTicker(OUTBOX_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	pruneTicker := time.NewTicker(OUTBOX_PRUNE_INTERVAL)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-outboxNotify:
+		case <-pruneTicker.C:
+			if err := pruneOutbox(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Failed to prune shard outbox", "error", err)
+			}
+			continue
+		}
+
+		drainOutbox(ctx)
+	}
+}
+
+// pruneOutbox deletes entries delivered more than OUTBOX_RETENTION ago, in batches so no delete locks many rows
+func pruneOutbox(ctx context.Context) error {
+	before := time.Now().Add(-OUTBOX_RETENTION)
+	var pruned int64
+
+	for ctx.Err() == nil {
+		result := DBConn.WithContext(ctx).Exec(`DELETE FROM shard_outbox WHERE id IN (
+			SELECT id FROM shard_outbox WHERE status = ? AND delivered_at < ? LIMIT ?)`,
+			OutboxStatusDelivered, before, OUTBOX_PRUNE_BATCH_SIZE)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		pruned += result.RowsAffected
+
+		if result.RowsAffected < int64(OUTBOX_PRUNE_BATCH_SIZE) {
+			break
+		}
+	}
+
+	if pruned > 0 {
+		slog.Info("Pruned delivered shard writes", "count", pruned, "delivered_before", before)
+	}
+
+	return ctx.Err()
+}
+
+// drainOutbox delivers batches until no entry is due or ctx is done
+func drainOutbox(ctx context.Context) {
+	for ctx.Err() == nil {
+		processed, err := processOutboxBatch(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Failed to process shard outbox", "error", err)
+			}
+			return
+		}
+		if processed < OUTBOX_BATCH_SIZE {
+			return
+		}
+	}
+}
+
+// processOutboxBatch claims due entries with a lease and delivers them outside of the claiming transaction,
+// so a slow shard holds neither a primary connection nor row locks. Entries whose delivery did not finish,
+// when ctx is done or the process died, are claimed again once their lease ran out
+func processOutboxBatch(ctx context.Context) (int, error) {
+	entries, err := claimOutboxEntries(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, entry := range entries {
+		// The deliveries before may have used up the lease of the claim
+		entry, renewed, err := renewOutboxLease(ctx, entry)
+		if err != nil {
+			return i, err
+		}
+		if !renewed {
+			slog.Warn("Shard outbox lease expired before the delivery started", "outbox_id", entry.ID)
+			continue
+		}
+
+		deliveryCtx, cancel := context.WithTimeout(ctx, OUTBOX_DELIVERY_TIMEOUT)
+		deliveryErr := traceOutboxDelivery(deliveryCtx, entry)
+		cancel()
+
+		// Interrupted, not a failed attempt
+		if ctx.Err() != nil {
+			return i, ctx.Err()
+		}
+
+		if err := recordOutboxResult(ctx, entry, deliveryErr); err != nil {
+			return i, err
+		}
+	}
+
+	return len(entries), nil
+}
+
+// claimOutboxEntries leases due entries by moving their next attempt past the delivery, the rows are locked
+// only while claiming so several instances can run the worker without delivering an entry twice
+func claimOutboxEntries(ctx context.Context) ([]OutboxEntry, error) {
+	var entries []OutboxEntry
+
+	// Postgres keeps microseconds, recordOutboxResult matches the lease by this exact value
+	leasedUntil := time.Now().Add(OUTBOX_LEASE).Truncate(time.Microsecond)
+
+	err := DBConn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", OutboxStatusPending, time.Now()).
+			Order("id ASC").
+			Limit(OUTBOX_BATCH_SIZE).
+			Find(&entries).Error
+
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+
+		ids := make([]int64, len(entries))
+		for i, entry := range entries {
+			ids[i] = entry.ID
+		}
+
+		return tx.Model(&OutboxEntry{}).Where("id IN ?", ids).Update("next_attempt_at", leasedUntil).Error
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		entries[i].NextAttemptAt = leasedUntil
+	}
+
+	return entries, nil
+}
+
+// renewOutboxLease leases the entry again for its delivery, unless the lease of the claim ran out and another
+// worker claimed the entry in the meantime
+func renewOutboxLease(ctx context.Context, entry OutboxEntry) (OutboxEntry, bool, error) {
+	leasedUntil := time.Now().Add(OUTBOX_LEASE).Truncate(time.Microsecond)
+
+	result := DBConn.WithContext(ctx).Model(&OutboxEntry{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", entry.ID, OutboxStatusPending, entry.NextAttemptAt).
+		Update("next_attempt_at", leasedUntil)
+
+	if result.Error != nil {
+		return entry, false, result.Error
+	}
+
+	entry.NextAttemptAt = leasedUntil
+
+	return entry, result.RowsAffected > 0, nil
+}
+
+// recordOutboxResult stores the outcome of a delivery, unless the lease ran out and another worker claimed the entry
+func recordOutboxResult(ctx context.Context, entry OutboxEntry, deliveryErr error) error {
+	updates := outboxEntryResult(entry, deliveryErr)
+
+	result := DBConn.WithContext(ctx).Model(&OutboxEntry{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", entry.ID, OutboxStatusPending, entry.NextAttemptAt).
+		Updates(updates)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		slog.Warn("Shard outbox lease expired before the delivery was recorded", "outbox_id", entry.ID)
+		return nil
+	}
+
+	if updates["status"] == OutboxStatusFailed {
+		outboxDeadLettered.Inc()
+		slog.Error("Shard write dead-lettered", "aggregate_type", entry.AggregateType, "aggregate_id", entry.AggregateID, "attempts", updates["attempts"], "error", deliveryErr)
+	}
+
+	return nil
+}
+
+// traceOutboxDelivery delivers the entry in a span of its own, linked to the request that queued it
+func traceOutboxDelivery(ctx context.Context, entry OutboxEntry) error {
+	ctx, span := tracing.Tracer().Start(ctx, "shardWorker.deliver",
+		trace.WithNewRoot(),
+		trace.WithLinks(tracing.LinkTo(entry.TraceContext)...),
+		trace.WithAttributes(
+			attribute.Int64("outbox.id", entry.ID),
+			attribute.String("outbox.aggregate_type", entry.AggregateType),
+			attribute.String("outbox.aggregate_id", entry.AggregateID),
+			attribute.Int("outbox.attempt", entry.Attempts+1),
+		),
+	)
+	defer span.End()
+
+	err := deliverOutboxEntry(ctx, entry)
+	tracing.RecordError(span, err)
+
+	return err
+}
+
+func deliverOutboxEntry(ctx context.Context, entry OutboxEntry) error {
+	if entry.AggregateType != outboxAggregateUser {
+		return fmt.Errorf("unknown outbox aggregate type %s", entry.AggregateType)
+	}
+
+	// Deliver the current state of the user, so retries never write stale data
+	var user User
+	err := DBConn.WithContext(ctx).Where("user_id = ?", entry.AggregateID).First(&user).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writeToShard(ctx, user)
+}
+
+func outboxEntryResult(entry OutboxEntry, deliveryErr error) map[string]interface{} {
+	now := time.Now()
+
+	if deliveryErr == nil {
+		return map[string]interface{}{
+			"status":       OutboxStatusDelivered,
+			"attempts":     entry.Attempts + 1,
+			"last_error":   "",
+			"delivered_at": &now,
+		}
+	}
+
+	// Read-only on purpose, e.g. fenced by a reshard, not a failed attempt. It becomes writable with a new shard map
+	if errors.Is(deliveryErr, ErrShardReadOnly) {
+		return map[string]interface{}{
+			"status":          OutboxStatusPending,
+			"attempts":        entry.Attempts,
+			"last_error":      deliveryErr.Error(),
+			"next_attempt_at": now.Add(SHARD_MAP_REFRESH_INTERVAL),
+		}
+	}
+
+	attempts := entry.Attempts + 1
+	status := OutboxStatusPending
+
+	if attempts >= OUTBOX_MAX_ATTEMPTS {
+		status = OutboxStatusFailed
+	}
+
+	return map[string]interface{}{
+		"status":          status,
+		"attempts":        attempts,
+		"last_error":      deliveryErr.Error(),
+		"next_attempt_at": now.Add(outboxBackoff(attempts)),
+	}
+}
+
+// Exponential backoff doubling from OUTBOX_BASE_BACKOFF up to OUTBOX_MAX_BACKOFF
+func outboxBackoff(attempts int) time.Duration {
+	backoff := OUTBOX_BASE_BACKOFF
+
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= OUTBOX_MAX_BACKOFF {
+			return OUTBOX_MAX_BACKOFF
+		}
+	}
+
+	return backoff
+}
+
+// Write user to the appropriate shard
+func writeToShard(ctx context.Context, user User) (err error) {
+	defer func() { recordShardWrite(shardNameOf(user.UserId), err) }()
+
+	// On a read-only shard the entry stays pending without counting an attempt, see outboxEntryResult
+	shardDB, err := getWritableShardByUserID(ctx, user.UserId)
+	if err != nil {
+		return err
+	}
+
+	if err := upsertShardUser(shardDB, user); err != nil {
+		return fmt.Errorf("failed to write user %s to shard DB: %w", user.UserId, err)
+	}
+
+	slog.Debug("User written to shard", "user_id", user.UserId)
+
+	return nil
+}
+
+// Upsert, so a repeated delivery refreshes the shard copy. Columns are listed because UpdateAll
+// skips the ones with defaults and stamps updated_at with the current time instead of the primary's.
+// A copy newer than the user is kept, a snapshot read earlier must not overwrite a later delivery
+func upsertShardUser(shardDB *gorm.DB, user User) error {
+	return shardDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"email", "first_name", "last_name", "password", "is_admin", "created_at", "updated_at"}),
+		Where:     clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "users.updated_at <= EXCLUDED.updated_at"}}},
+	}).Create(&user).Error
+}
+
+type OutboxSummary struct {
+	Pending   int64         `json:"pending"`
+	Failed    int64         `json:"failed"`
+	Delivered int64         `json:"delivered"`
+	Entries   []OutboxEntry `json:"entries"`
+}
+
+// GetOutboxSummary returns counts per status and the latest entries with the given status
+func GetOutboxSummary(ctx context.Context, status string, limit int) (OutboxSummary, error) {
+	summary := OutboxSummary{Entries: []OutboxEntry{}}
+
+	counts := []struct {
+		Status string
+		Count  int64
+	}{}
+
+	if err := DBConn.WithContext(ctx).Model(&OutboxEntry{}).Select("status, COUNT(*) AS count").Group("status").Scan(&counts).Error; err != nil {
+		return OutboxSummary{}, err
+	}
+
+	for _, count := range counts {
+		switch count.Status {
+		case OutboxStatusPending:
+			summary.Pending = count.Count
+		case OutboxStatusFailed:
+			summary.Failed = count.Count
+		case OutboxStatusDelivered:
+			summary.Delivered = count.Count
+		}
+	}
+
+	if err := DBConn.WithContext(ctx).Where("status = ?", status).Order("id DESC").Limit(limit).Find(&summary.Entries).Error; err != nil {
+		return OutboxSummary{}, err
+	}
+
+	return summary, nil
+}
+
+// RetryOutboxEntry moves a dead-lettered entry back to pending
+func RetryOutboxEntry(ctx context.Context, id int64) error {
+	result := DBConn.WithContext(ctx).Model(&OutboxEntry{}).Where("id = ? AND status = ?", id, OutboxStatusFailed).Updates(map[string]interface{}{
+		"status":          OutboxStatusPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	NotifyShardWorker()
+
+	return nil
+}
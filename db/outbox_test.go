@@ -0,0 +1,94 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{0, 2 * time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{8, 256 * time.Second},
+		{9, 512 * time.Second},
+		{10, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+
+	for _, tc := range cases {
+		if backoff := outboxBackoff(tc.attempts); backoff != tc.expected {
+			t.Errorf("attempt %d: expected %s, got %s", tc.attempts, tc.expected, backoff)
+		}
+	}
+}
+
+func TestReadOnlyShardIsNoFailedAttempt(t *testing.T) {
+	deliveryErr := fmt.Errorf("user moving off shard-0: %w", ErrShardReadOnly)
+
+	before := time.Now()
+	result := outboxEntryResult(OutboxEntry{Attempts: OUTBOX_MAX_ATTEMPTS - 1}, deliveryErr)
+
+	if result["status"] != OutboxStatusPending || result["attempts"] != OUTBOX_MAX_ATTEMPTS-1 {
+		t.Errorf("expected the entry to stay pending without another attempt, got %v", result)
+	}
+
+	next := result["next_attempt_at"].(time.Time)
+	if next.Before(before.Add(SHARD_MAP_REFRESH_INTERVAL)) || next.After(time.Now().Add(SHARD_MAP_REFRESH_INTERVAL)) {
+		t.Errorf("expected the next attempt after the next shard map refresh, got %s", next.Sub(before))
+	}
+}
+
+func TestOutboxEntryResult(t *testing.T) {
+	deliveryErr := errors.New("shard unavailable")
+
+	cases := []struct {
+		name        string
+		attempts    int
+		deliveryErr error
+		status      string
+		backoff     time.Duration
+	}{
+		{"delivered", 3, nil, OutboxStatusDelivered, 0},
+		{"first failure", 0, deliveryErr, OutboxStatusPending, 2 * time.Second},
+		{"retried failure", 4, deliveryErr, OutboxStatusPending, 32 * time.Second},
+		{"last retry", OUTBOX_MAX_ATTEMPTS - 2, deliveryErr, OutboxStatusPending, outboxBackoff(OUTBOX_MAX_ATTEMPTS - 1)},
+		{"dead-lettered", OUTBOX_MAX_ATTEMPTS - 1, deliveryErr, OutboxStatusFailed, outboxBackoff(OUTBOX_MAX_ATTEMPTS)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := time.Now()
+			result := outboxEntryResult(OutboxEntry{Attempts: tc.attempts}, tc.deliveryErr)
+
+			if result["status"] != tc.status {
+				t.Errorf("expected status %s, got %v", tc.status, result["status"])
+			}
+			if result["attempts"] != tc.attempts+1 {
+				t.Errorf("expected %d attempts, got %v", tc.attempts+1, result["attempts"])
+			}
+
+			if tc.deliveryErr == nil {
+				if result["last_error"] != "" || result["delivered_at"] == nil {
+					t.Errorf("expected a delivered entry without error, got %v", result)
+				}
+				return
+			}
+
+			if result["last_error"] != tc.deliveryErr.Error() {
+				t.Errorf("expected the delivery error to be kept, got %v", result["last_error"])
+			}
+
+			next := result["next_attempt_at"].(time.Time)
+			if next.Before(before.Add(tc.backoff)) || next.After(time.Now().Add(tc.backoff)) {
+				t.Errorf("expected the next attempt in %s, got %s", tc.backoff, next.Sub(before))
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Arbitrary key for pg_try_advisory_lock, only one instance reconciles at a time
+const reconcileLockKey = 72190414
+
+// Ids kept per kind of drift in a report
+var RECONCILE_SAMPLE_SIZE = 10
+
+const (
+	DriftMissing   = "missing"   // On the primary but not on its shard
+	DriftStale     = "stale"     // On its shard with an older UpdatedAt, or the same one and different columns
+	DriftOrphaned  = "orphaned"  // On a shard but deleted from the primary
+	DriftMisplaced = "misplaced" // On a shard the ring does not route it to, left for the reshard tool
+)
+
+var ErrReconcileRunning = errors.New("another reconciliation is running")
+
+type ShardReconcileReport struct {
+	Shard    string              `json:"shard"`
+	Checked  int64               `json:"checked"`
+	Drift    map[string]int64    `json:"drift"`
+	Repaired int64               `json:"repaired"`
+	Failed   int64               `json:"failed"`
+	Samples  map[string][]string `json:"samples"` // Up to RECONCILE_SAMPLE_SIZE user ids per kind of drift
+}
+
+// Row of reconcile_reports, stored when a run finishes
+type ReconcileReport struct {
+	ID         int64                   `gorm:"primaryKey" json:"id"`
+	DryRun     bool                    `json:"dryRun"`
+	StartedAt  time.Time               `json:"startedAt"`
+	FinishedAt *time.Time              `json:"finishedAt"`
+	Shards     []*ShardReconcileReport `gorm:"serializer:json" json:"shards"`
+	Error      string                  `json:"error,omitempty"`
+}
+
+func (r *ReconcileReport) TableName() string {
+	return "reconcile_reports"
+}
+
+func (r *ShardReconcileReport) record(kind string, userID string) {
+	r.Drift[kind]++
+
+	if len(r.Samples[kind]) < RECONCILE_SAMPLE_SIZE {
+		r.Samples[kind] = append(r.Samples[kind], userID)
+	}
+}
+
+// IsReconcileRunning tells whether any instance is reconciling right now, i.e. holds the reconcile lock
+func IsReconcileRunning(ctx context.Context) (bool, error) {
+	return isAdvisoryLockHeld(ctx, reconcileLockKey)
+}
+
+// GetLastReconcileReport returns the report of the last reconciliation of any instance, nil before the first one
+func GetLastReconcileReport(ctx context.Context) (*ReconcileReport, error) {
+	var report ReconcileReport
+	result := DBConn.WithContext(ctx).Order("id DESC").Limit(1).Find(&report)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &report, nil
+}
+
+// Hash of the replicated columns of a users row
+func userRowHash(user User) string {
+	createdAt := ""
+	if user.CreatedAt != nil {
+		createdAt = user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s %s %s %s %s %t %s %s", user.UserId, user.Email, user.FirstName, user.LastName, user.Password, user.IsAdmin, createdAt, user.UpdatedAt.UTC().Format(time.RFC3339Nano))))
+
+	return hex.EncodeToString(hash[:])
+}
+
+type reconcileRun struct {
+	ctx    context.Context
+	report *ReconcileReport
+	t      *shardTopology
+}
+
+// repair applies the fix unless it is a dry run or the shard is read-only
+func (r *reconcileRun) repair(shard int, userID string, fix func() error) {
+	shardReport := r.report.Shards[shard]
+
+	if r.report.DryRun || r.t.shards[shard].ReadOnly {
+		return
+	}
+
+	if err := fix(); err != nil {
+		slog.Error("Repairing user failed", "user_id", userID, "shard", r.t.shards[shard].Name, "error", err)
+		shardReport.Failed++
+		return
+	}
+
+	shardReport.Repaired++
+}
+
+// shardCopyDrift classifies the shard copy of a primary user, empty when it is up to date. A copy newer
+// than the primary snapshot was delivered by the outbox after the snapshot was read and is up to date
+func shardCopyDrift(user User, shardCopy User, found bool) string {
+	switch {
+	case !found:
+		return DriftMissing
+	case shardCopy.UpdatedAt.Before(user.UpdatedAt):
+		return DriftStale
+	case shardCopy.UpdatedAt.Equal(user.UpdatedAt) && userRowHash(shardCopy) != userRowHash(user):
+		return DriftStale
+	default:
+		return ""
+	}
+}
+
+// checkPrimaryUsers compares a batch of primary users with the copies on their shards
+func (r *reconcileRun) checkPrimaryUsers(ids []string) error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+
+	var users []User
+	if err := DBConn.WithContext(r.ctx).Where("user_id IN ?", ids).Find(&users).Error; err != nil {
+		return err
+	}
+
+	usersByShard := make(map[int][]User)
+	for _, user := range users {
+		shard, err := r.t.shardFor(user.UserId)
+		if err != nil {
+			return err
+		}
+		usersByShard[shard] = append(usersByShard[shard], user)
+	}
+
+	for shard, primaryUsers := range usersByShard {
+		shardReport := r.report.Shards[shard]
+		conn := r.t.conns[shard].WithContext(r.ctx)
+
+		shardIds := make([]string, len(primaryUsers))
+		for i, user := range primaryUsers {
+			shardIds[i] = user.UserId
+		}
+
+		var shardUsers []User
+		if err := conn.Where("user_id IN ?", shardIds).Find(&shardUsers).Error; err != nil {
+			return fmt.Errorf("reading users of %s failed: %w", r.t.shards[shard].Name, err)
+		}
+
+		copies := make(map[string]User, len(shardUsers))
+		for _, user := range shardUsers {
+			copies[user.UserId] = user
+		}
+
+		for _, user := range primaryUsers {
+			shardReport.Checked++
+
+			shardCopy, found := copies[user.UserId]
+
+			drift := shardCopyDrift(user, shardCopy, found)
+			if drift == "" {
+				continue
+			}
+
+			shardReport.record(drift, user.UserId)
+
+			// The upsert keeps a copy the outbox updated since, see upsertShardUser
+			r.repair(shard, user.UserId, func() error {
+				return upsertShardUser(conn, user)
+			})
+		}
+	}
+
+	return nil
+}
+
+// checkShardUsers looks for rows of a shard that the primary no longer has or routes elsewhere
+func (r *reconcileRun) checkShardUsers(shard int) error {
+	conn := r.t.conns[shard].WithContext(r.ctx)
+	shardReport := r.report.Shards[shard]
+	after := ""
+
+	for {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+
+		var ids []string
+
+		query := conn.Model(&User{}).Order("user_id ASC").Limit(RESHARD_BATCH_SIZE)
+		if after != "" {
+			query = query.Where("user_id > ?", after)
+		}
+
+		if err := query.Pluck("user_id", &ids).Error; err != nil {
+			return fmt.Errorf("reading users of %s failed: %w", r.t.shards[shard].Name, err)
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		var primaryIds []string
+		if err := DBConn.WithContext(r.ctx).Model(&User{}).Where("user_id IN ?", ids).Pluck("user_id", &primaryIds).Error; err != nil {
+			return err
+		}
+
+		onPrimary := make(map[string]bool, len(primaryIds))
+		for _, id := range primaryIds {
+			onPrimary[id] = true
+		}
+
+		for _, id := range ids {
+			if !onPrimary[id] {
+				shardReport.record(DriftOrphaned, id)
+
+				r.repair(shard, id, func() error {
+					return conn.Transaction(func(tx *gorm.DB) error {
+						return deleteUserShardData(tx, id)
+					})
+				})
+				continue
+			}
+
+			owner, err := r.t.shardFor(id)
+			if err != nil {
+				return err
+			}
+
+			if owner != shard {
+				shardReport.record(DriftMisplaced, id)
+			}
+		}
+
+		after = ids[len(ids)-1]
+	}
+}
+
+func (r *reconcileRun) execute() error {
+	err := walkUsers(r.ctx, "", r.checkPrimaryUsers)
+	if err != nil {
+		return err
+	}
+
+	for shard := range r.t.shards {
+		if err := r.checkShardUsers(shard); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reconcile compares every user of the primary with its shard copy and every shard row with the primary,
+// repairing missing, stale and orphaned rows unless dryRun is set. It stops between batches when ctx is done
+func Reconcile(ctx context.Context, dryRun bool) (*ReconcileReport, error) {
+	unlock, locked, err := tryAdvisoryLock(reconcileLockKey)
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrReconcileRunning
+	}
+	defer unlock()
+
+	return reconcile(ctx, dryRun)
+}
+
+// StartReconcile takes the reconcile lock and reconciles in the background of the server, which waits
+// for the run on shutdown
+func StartReconcile(dryRun bool) error {
+	unlock, locked, err := tryAdvisoryLock(reconcileLockKey)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return ErrReconcileRunning
+	}
+
+	runInBackground(func() {
+		defer unlock()
+
+		if _, err := reconcile(backgroundCtx, dryRun); err != nil {
+			slog.Error("Reconciling shards failed", "error", err)
+		}
+	})
+
+	return nil
+}
+
+// reconcile runs with the reconcile lock held and stores the report
+func reconcile(ctx context.Context, dryRun bool) (*ReconcileReport, error) {
+	t := currentTopology()
+	report := &ReconcileReport{DryRun: dryRun, StartedAt: time.Now()}
+
+	for _, shard := range t.shards {
+		report.Shards = append(report.Shards, &ShardReconcileReport{
+			Shard:   shard.Name,
+			Drift:   map[string]int64{DriftMissing: 0, DriftStale: 0, DriftOrphaned: 0, DriftMisplaced: 0},
+			Samples: map[string][]string{},
+		})
+	}
+
+	run := &reconcileRun{ctx: ctx, report: report, t: t}
+	err := run.execute()
+
+	finishedAt := time.Now()
+	report.FinishedAt = &finishedAt
+
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	// Stored even when ctx is done, the run is over either way
+	if storeErr := DBConn.Create(report).Error; storeErr != nil {
+		slog.Error("Failed to store reconcile report", "error", storeErr)
+	}
+
+	return report, err
+}
+
+// startReconciler runs Reconcile at the configured interval until ctx is done, 0 disables it
+func startReconciler(ctx context.Context) {
+	interval := settings.ReconcileInterval
+
+	if interval <= 0 {
+		return
+	}
+
+	runInBackground(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			report, err := Reconcile(ctx, false)
+
+			if errors.Is(err, ErrReconcileRunning) {
+				continue
+			}
+
+			if err != nil {
+				slog.Error("Reconciling shards failed", "error", err)
+				continue
+			}
+
+			for _, shard := range report.Shards {
+				if shard.Repaired > 0 || shard.Failed > 0 {
+					slog.Info("Reconciled shard", "shard", shard.Shard, "checked", shard.Checked, "drift", shard.Drift, "repaired", shard.Repaired, "failed", shard.Failed)
+				}
+			}
+		}
+	})
+}
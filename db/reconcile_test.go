@@ -0,0 +1,37 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShardCopyDrift(t *testing.T) {
+	updatedAt := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	user := User{UserId: "user", Email: "user@example.com", UpdatedAt: updatedAt}
+
+	renamed := user
+	renamed.FirstName = "Renamed"
+
+	older, newer := user, renamed
+	older.UpdatedAt = updatedAt.Add(-time.Minute)
+	newer.UpdatedAt = updatedAt.Add(time.Minute)
+
+	cases := []struct {
+		name      string
+		shardCopy User
+		found     bool
+		expected  string
+	}{
+		{"missing", User{}, false, DriftMissing},
+		{"up to date", user, true, ""},
+		{"older", older, true, DriftStale},
+		{"same time, other columns", renamed, true, DriftStale},
+		{"newer than the primary snapshot", newer, true, ""},
+	}
+
+	for _, tc := range cases {
+		if drift := shardCopyDrift(user, tc.shardCopy, tc.found); drift != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, drift)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Storage used by the routes and jwtService, implemented on Postgres by the functions of this
+// package and in memory for tests. Missing rows are reported as gorm.ErrRecordNotFound by both
+
+type UserRepository interface {
+	// CreateUser stores a user with a password and the user role, returns the new user id
+	CreateUser(ctx context.Context, email string, password string, firstName string, lastName string) (string, error)
+	// CreateWebAuthnUser stores a user registered with a passkey together with the credential
+	CreateWebAuthnUser(ctx context.Context, user *User, credential WebAuthnCredential) (string, error)
+	// Authenticate checks the password, failures are connect.CodeUnauthenticated errors
+	Authenticate(ctx context.Context, email string, password string) (*User, error)
+	GetUserById(ctx context.Context, id string) (User, error)
+	GetUserByEmail(ctx context.Context, email string) (User, error)
+	// GetWebAuthnUser returns the user with its credentials loaded
+	GetWebAuthnUser(ctx context.Context, id string) (*User, error)
+
+	GetWebAuthnCredentials(ctx context.Context, userId string) ([]WebAuthnCredential, error)
+	CreateWebAuthnCredential(ctx context.Context, credential *WebAuthnCredential) error
+	UpdateWebAuthnCredentialUsage(ctx context.Context, credential *webauthn.Credential) error
+	RenameWebAuthnCredential(ctx context.Context, userId string, id string, name string) error
+	DeleteWebAuthnCredential(ctx context.Context, userId string, id string) error
+
+	GetRoles(ctx context.Context) ([]Role, error)
+	GetUserRolesAndPermissions(ctx context.Context, userId string) ([]string, []string, error)
+	SetUserRoles(ctx context.Context, userId string, roleNames []string) error
+}
+
+type TokenRepository interface {
+	StoreRefreshToken(ctx context.Context, token RefreshToken) error
+	GetRefreshTokenByJTI(ctx context.Context, userId string, jti string) (RefreshToken, error)
+	// RotateRefreshToken fails with ErrRefreshTokenRotated when the old token was already rotated or revoked
+	RotateRefreshToken(ctx context.Context, oldJTI string, newToken RefreshToken) error
+	RevokeRefreshTokenFamily(ctx context.Context, userId string, familyId string) error
+	RevokeUserRefreshTokens(ctx context.Context, userId string) error
+	// GetAccessTokenVersion returns the version access tokens need, RevokeAccessTokens increments it
+	GetAccessTokenVersion(ctx context.Context, userId string) (int, error)
+	RevokeAccessTokens(ctx context.Context, userId string) error
+}
+
+type MoodRepository interface {
+	CreateMoodScore(ctx context.Context, userId string, year int32, month int32, day int32, moodId int32) (MoodScore, error)
+	UpdateMoodScore(ctx context.Context, userId string, id string, moodId int32) (MoodScore, error)
+	GetMoodScores(ctx context.Context, userId string, year int, month int) (map[int32]map[int32]map[int32]MoodScore, error)
+}
+
+type TodoRepository interface {
+	GetTodos(ctx context.Context, userId string) ([]Todo, error)
+	CreateTodo(ctx context.Context, userId string, title string, body string, done bool) (Todo, error)
+	UpdateTodo(ctx context.Context, userId string, id int, title string, body string, done bool) error
+	ToggleTodoStatus(ctx context.Context, userId string, id int) error
+	DeleteTodo(ctx context.Context, userId string, id int) error
+}
+
+// AdminRepository reports on the shards, the outbox and the reconciliation for the admin endpoints
+type AdminRepository interface {
+	GetOutboxSummary(ctx context.Context, status string, limit int) (OutboxSummary, error)
+	// RetryOutboxEntry fails with gorm.ErrRecordNotFound unless the entry is dead-lettered
+	RetryOutboxEntry(ctx context.Context, id int64) error
+	GetShardStatuses(ctx context.Context) ShardMapStatus
+	ListShardUsers(ctx context.Context, email string, offset int, limit int) ScatterResult[User]
+	CountShardMoodScores(ctx context.Context, year int, month int) (int64, []ShardError)
+	IsReconcileRunning(ctx context.Context) (bool, error)
+	// GetLastReconcileReport returns nil before the first reconciliation
+	GetLastReconcileReport(ctx context.Context) (*ReconcileReport, error)
+	// StartReconcile fails with ErrReconcileRunning while a reconciliation is running
+	StartReconcile(ctx context.Context, dryRun bool) error
+}
+
+type Repositories struct {
+	Users  UserRepository
+	Tokens TokenRepository
+	Moods  MoodRepository
+	Todos  TodoRepository
+	Admin  AdminRepository
+}
+
+// Postgres implementation, users on the primary and shards, tokens and moods on the user's shard
+
+type PostgresUserRepository struct{}
+type PostgresTokenRepository struct{}
+type PostgresMoodRepository struct{}
+type PostgresTodoRepository struct{}
+type PostgresAdminRepository struct{}
+
+func NewPostgresRepositories() Repositories {
+	return Repositories{
+		Users:  PostgresUserRepository{},
+		Tokens: PostgresTokenRepository{},
+		Moods:  PostgresMoodRepository{},
+		Todos:  PostgresTodoRepository{},
+		Admin:  PostgresAdminRepository{},
+	}
+}
+
+func (PostgresUserRepository) CreateUser(ctx context.Context, email string, password string, firstName string, lastName string) (string, error) {
+	user := User{}
+	return user.CreateAdmin(ctx, email, password, firstName, lastName)
+}
+
+func (PostgresUserRepository) CreateWebAuthnUser(ctx context.Context, webAuthnUser *User, credential WebAuthnCredential) (string, error) {
+	user := User{}
+	return user.CreateWebAuthnAdmin(ctx, webAuthnUser, credential)
+}
+
+func (PostgresUserRepository) Authenticate(ctx context.Context, email string, password string) (*User, error) {
+	user := User{}
+	return user.LoginAsAdmin(ctx, email, password)
+}
+
+func (PostgresUserRepository) GetUserById(ctx context.Context, id string) (User, error) {
+	return GetUserById(ctx, id)
+}
+
+func (PostgresUserRepository) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	return GetUserByEmail(ctx, email)
+}
+
+func (PostgresUserRepository) GetWebAuthnUser(ctx context.Context, id string) (*User, error) {
+	user := User{}
+
+	found, err := user.LoginAsWebAuthAdmin(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := found.LoadWebAuthnCredentials(ctx); err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+func (PostgresUserRepository) GetWebAuthnCredentials(ctx context.Context, userId string) ([]WebAuthnCredential, error) {
+	return GetWebAuthnCredentials(ctx, userId)
+}
+
+func (PostgresUserRepository) CreateWebAuthnCredential(ctx context.Context, credential *WebAuthnCredential) error {
+	return CreateWebAuthnCredential(ctx, credential)
+}
+
+func (PostgresUserRepository) UpdateWebAuthnCredentialUsage(ctx context.Context, credential *webauthn.Credential) error {
+	return UpdateWebAuthnCredentialUsage(ctx, credential)
+}
+
+func (PostgresUserRepository) RenameWebAuthnCredential(ctx context.Context, userId string, id string, name string) error {
+	return RenameWebAuthnCredential(ctx, userId, id, name)
+}
+
+func (PostgresUserRepository) DeleteWebAuthnCredential(ctx context.Context, userId string, id string) error {
+	return DeleteWebAuthnCredential(ctx, userId, id)
+}
+
+func (PostgresUserRepository) GetRoles(ctx context.Context) ([]Role, error) {
+	return GetRoles(ctx)
+}
+
+func (PostgresUserRepository) GetUserRolesAndPermissions(ctx context.Context, userId string) ([]string, []string, error) {
+	return GetUserRolesAndPermissions(ctx, userId)
+}
+
+func (PostgresUserRepository) SetUserRoles(ctx context.Context, userId string, roleNames []string) error {
+	return SetUserRoles(ctx, userId, roleNames)
+}
+
+func (PostgresTokenRepository) StoreRefreshToken(ctx context.Context, token RefreshToken) error {
+	return StoreJTI(ctx, token.JTI, token.UserID, token.FamilyID, token.Expiry, token.AccessToken)
+}
+
+func (PostgresTokenRepository) GetRefreshTokenByJTI(ctx context.Context, userId string, jti string) (RefreshToken, error) {
+	return GetRefreshTokenByJTI(ctx, userId, jti)
+}
+
+func (PostgresTokenRepository) RotateRefreshToken(ctx context.Context, oldJTI string, newToken RefreshToken) error {
+	return RotateRefreshToken(ctx, oldJTI, newToken)
+}
+
+func (PostgresTokenRepository) RevokeRefreshTokenFamily(ctx context.Context, userId string, familyId string) error {
+	return RevokeRefreshTokenFamily(ctx, userId, familyId)
+}
+
+func (PostgresTokenRepository) RevokeUserRefreshTokens(ctx context.Context, userId string) error {
+	return RevokeJWTByUserId(ctx, userId)
+}
+
+func (PostgresTokenRepository) GetAccessTokenVersion(ctx context.Context, userId string) (int, error) {
+	return GetAccessTokenVersion(ctx, userId)
+}
+
+func (PostgresTokenRepository) RevokeAccessTokens(ctx context.Context, userId string) error {
+	return RevokeAccessTokens(ctx, userId)
+}
+
+func (PostgresMoodRepository) CreateMoodScore(ctx context.Context, userId string, year int32, month int32, day int32, moodId int32) (MoodScore, error) {
+	return CreateMoodScore(ctx, userId, year, month, day, moodId)
+}
+
+func (PostgresMoodRepository) UpdateMoodScore(ctx context.Context, userId string, id string, moodId int32) (MoodScore, error) {
+	return UpdateMoodScore(ctx, userId, id, moodId)
+}
+
+func (PostgresMoodRepository) GetMoodScores(ctx context.Context, userId string, year int, month int) (map[int32]map[int32]map[int32]MoodScore, error) {
+	return GetMoodScores(ctx, userId, year, month)
+}
+
+func (PostgresTodoRepository) GetTodos(ctx context.Context, userId string) ([]Todo, error) {
+	return GetTodos(ctx, userId)
+}
+
+func (PostgresTodoRepository) CreateTodo(ctx context.Context, userId string, title string, body string, done bool) (Todo, error) {
+	return CreateTodo(ctx, userId, title, body, done)
+}
+
+func (PostgresTodoRepository) UpdateTodo(ctx context.Context, userId string, id int, title string, body string, done bool) error {
+	return UpdateTodo(ctx, userId, id, title, body, done)
+}
+
+func (PostgresTodoRepository) ToggleTodoStatus(ctx context.Context, userId string, id int) error {
+	return ToggleTodoStatus(ctx, userId, id)
+}
+
+func (PostgresTodoRepository) DeleteTodo(ctx context.Context, userId string, id int) error {
+	return DeleteTodo(ctx, userId, id)
+}
+
+func (PostgresAdminRepository) GetOutboxSummary(ctx context.Context, status string, limit int) (OutboxSummary, error) {
+	return GetOutboxSummary(ctx, status, limit)
+}
+
+func (PostgresAdminRepository) RetryOutboxEntry(ctx context.Context, id int64) error {
+	return RetryOutboxEntry(ctx, id)
+}
+
+func (PostgresAdminRepository) GetShardStatuses(ctx context.Context) ShardMapStatus {
+	return GetShardStatuses(ctx)
+}
+
+func (PostgresAdminRepository) ListShardUsers(ctx context.Context, email string, offset int, limit int) ScatterResult[User] {
+	return ListShardUsers(ctx, email, offset, limit)
+}
+
+func (PostgresAdminRepository) CountShardMoodScores(ctx context.Context, year int, month int) (int64, []ShardError) {
+	return CountShardMoodScores(ctx, year, month)
+}
+
+func (PostgresAdminRepository) IsReconcileRunning(ctx context.Context) (bool, error) {
+	return IsReconcileRunning(ctx)
+}
+
+func (PostgresAdminRepository) GetLastReconcileReport(ctx context.Context) (*ReconcileReport, error) {
+	return GetLastReconcileReport(ctx)
+}
+
+// The run outlives the request, it is stopped by Close instead of ctx
+func (PostgresAdminRepository) StartReconcile(_ context.Context, dryRun bool) error {
+	return StartReconcile(dryRun)
+}
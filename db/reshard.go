@@ -0,0 +1,709 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A job copies every moved user, verifies them all again, fences the moved users with a copy
+// of the old layout that rejects their writes, syncs them a last time once no server writes
+// to them, flips the active shard map and then deletes the moved users from their
+// old shard. Progress is stored after each batch so an interrupted job resumes where it stopped.
+const (
+	ReshardPhaseCopying   = "copying"
+	ReshardPhaseVerifying = "verifying"
+	ReshardPhaseFencing   = "fencing"
+	ReshardPhaseCleanup   = "cleanup"
+	ReshardPhaseCompleted = "completed"
+)
+
+// Arbitrary key for pg_try_advisory_lock, only one reshard job runs at a time
+const reshardLockKey = 72190413
+
+var RESHARD_BATCH_SIZE = 100
+
+var ErrReshardRunning = errors.New("another reshard job is running")
+
+type ReshardJob struct {
+	ID           int64     `gorm:"primaryKey" json:"id"`
+	FromVersion  int       `json:"fromVersion"`
+	ToVersion    int       `json:"toVersion"`
+	FenceVersion *int      `json:"fenceVersion"` // Old layout with the moved users read-only, active until the flip
+	Phase        string    `json:"phase"`
+	LastUserID   string    `json:"lastUserId"` // Users up to this id are done in the current phase
+	Moved        int64     `json:"moved"`
+	Deleted      int64     `json:"deleted"`
+	Skipped      int64     `json:"skipped"` // Changed on the old shard after the fence or on a read-only one, left there
+	LastError    string    `json:"lastError"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+func (j *ReshardJob) TableName() string {
+	return "reshard_jobs"
+}
+
+type ReshardPlan struct {
+	FromVersion       int              `json:"fromVersion"`
+	Users             int64            `json:"users"`
+	Moved             int64            `json:"moved"`
+	Moves             map[string]int64 `json:"moves"`             // "<from> -> <to>": users
+	PendingMigrations map[string]int   `json:"pendingMigrations"` // Per shard of the new map
+}
+
+// Everything stored on a shard for one user
+type userShardData struct {
+	Users         []User
+	RefreshTokens []RefreshToken
+	MoodScores    []MoodScore
+}
+
+func loadUserShardData(conn *gorm.DB, userID string) (userShardData, error) {
+	data := userShardData{}
+
+	if err := conn.Where("user_id = ?", userID).Find(&data.Users).Error; err != nil {
+		return data, err
+	}
+	if err := conn.Where("user_id = ?", userID).Order("id ASC").Find(&data.RefreshTokens).Error; err != nil {
+		return data, err
+	}
+	if err := conn.Where("user_id = ?", userID).Order("id ASC").Find(&data.MoodScores).Error; err != nil {
+		return data, err
+	}
+
+	return data, nil
+}
+
+// checksum hashes every column of every row, times in UTC so both sides print them alike
+func (d userShardData) checksum() string {
+	hash := sha256.New()
+
+	for _, user := range d.Users {
+		fmt.Fprintf(hash, "user %s\n", userRowHash(user))
+	}
+	for _, token := range d.RefreshTokens {
+		fmt.Fprintf(hash, "token %+v\n", token)
+	}
+	for _, mood := range d.MoodScores {
+		mood.CreatedAt = mood.CreatedAt.UTC()
+		mood.UpdatedAt = mood.UpdatedAt.UTC()
+		fmt.Fprintf(hash, "mood %+v\n", mood)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (d userShardData) rowCount() int {
+	return len(d.Users) + len(d.RefreshTokens) + len(d.MoodScores)
+}
+
+func deleteUserShardData(tx *gorm.DB, userID string) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&MoodScore{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ?", userID).Delete(&RefreshToken{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("user_id = ?", userID).Delete(&User{}).Error
+}
+
+// copyUser replaces the rows of the user on the destination with the ones of the source
+func copyUser(source *gorm.DB, destination *gorm.DB, userID string) (userShardData, error) {
+	data, err := loadUserShardData(source, userID)
+	if err != nil {
+		return data, err
+	}
+
+	err = destination.Transaction(func(tx *gorm.DB) error {
+		if err := deleteUserShardData(tx, userID); err != nil {
+			return err
+		}
+
+		if len(data.Users) > 0 {
+			if err := tx.Create(&data.Users).Error; err != nil {
+				return err
+			}
+		}
+		if len(data.RefreshTokens) > 0 {
+			if err := tx.CreateInBatches(&data.RefreshTokens, RESHARD_BATCH_SIZE).Error; err != nil {
+				return err
+			}
+		}
+		if len(data.MoodScores) > 0 {
+			if err := tx.CreateInBatches(&data.MoodScores, RESHARD_BATCH_SIZE).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return data, err
+}
+
+// verifyUser compares the row counts and checksums of the user on both shards
+func verifyUser(source *gorm.DB, destination *gorm.DB, userID string) (bool, error) {
+	sourceData, err := loadUserShardData(source, userID)
+	if err != nil {
+		return false, err
+	}
+
+	destinationData, err := loadUserShardData(destination, userID)
+	if err != nil {
+		return false, err
+	}
+
+	if sourceData.rowCount() != destinationData.rowCount() {
+		return false, nil
+	}
+
+	return sourceData.checksum() == destinationData.checksum(), nil
+}
+
+// walkUsers calls fn with batches of the ids of the primary users greater than after
+func walkUsers(ctx context.Context, after string, fn func(ids []string) error) error {
+	for {
+		var ids []string
+
+		query := DBConn.WithContext(ctx).Model(&User{}).Order("user_id ASC").Limit(RESHARD_BATCH_SIZE)
+		if after != "" {
+			query = query.Where("user_id > ?", after)
+		}
+
+		if err := query.Pluck("user_id", &ids).Error; err != nil {
+			return err
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		if err := fn(ids); err != nil {
+			return err
+		}
+
+		after = ids[len(ids)-1]
+	}
+}
+
+// Shard indexes of the user in both layouts, moved when the shard names differ
+func userMove(from *shardTopology, to *shardTopology, userID string) (int, int, bool, error) {
+	fromShard, err := from.shardFor(userID)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	toShard, err := to.shardFor(userID)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	return fromShard, toShard, from.shards[fromShard].Name != to.shards[toShard].Name, nil
+}
+
+// PlanReshard reports which users would move to the given layout without writing anything
+func PlanReshard(newMap ShardMap) (ReshardPlan, error) {
+	if err := ValidateShardMap(newMap); err != nil {
+		return ReshardPlan{}, err
+	}
+	if err := checkStorable(newMap); err != nil {
+		return ReshardPlan{}, err
+	}
+
+	current, err := GetActiveShardMap()
+	if err != nil {
+		return ReshardPlan{}, err
+	}
+
+	from := currentTopology()
+	to, err := newShardTopology(newMap, from)
+	if err != nil {
+		return ReshardPlan{}, err
+	}
+	defer to.closeConnsNotIn(from)
+
+	plan := ReshardPlan{FromVersion: current.Version, Moves: map[string]int64{}, PendingMigrations: map[string]int{}}
+
+	for i, shard := range to.shards {
+		// GetMigrationStatus creates schema_migrations, a new shard is reported as fully pending instead
+		if !to.conns[i].Migrator().HasTable(&SchemaMigration{}) {
+			migrations, err := LoadMigrations(ShardMigrations)
+			if err != nil {
+				return ReshardPlan{}, err
+			}
+			plan.PendingMigrations[shard.Name] = len(migrations)
+			continue
+		}
+
+		statuses, err := GetMigrationStatus(to.conns[i], ShardMigrations)
+		if err != nil {
+			return ReshardPlan{}, fmt.Errorf("reading migrations of shard %s failed: %w", shard.Name, err)
+		}
+
+		for _, status := range statuses {
+			if !status.Applied {
+				plan.PendingMigrations[shard.Name]++
+			}
+		}
+	}
+
+	err = walkUsers(context.Background(), "", func(ids []string) error {
+		for _, id := range ids {
+			plan.Users++
+
+			fromShard, toShard, moved, err := userMove(from, to, id)
+			if err != nil {
+				return err
+			}
+
+			if moved {
+				plan.Moved++
+				plan.Moves[from.shards[fromShard].Name+" -> "+to.shards[toShard].Name]++
+			}
+		}
+		return nil
+	})
+
+	return plan, err
+}
+
+func getShardMap(version int) (ShardMap, error) {
+	var shardMap ShardMap
+	err := DBConn.Where("version = ?", version).First(&shardMap).Error
+	return shardMap, err
+}
+
+// createReshardJob stores the current layout (if it only came from the environment) and the new one
+func createReshardJob(newMap ShardMap) (ReshardJob, error) {
+	if err := checkStorable(newMap); err != nil {
+		return ReshardJob{}, err
+	}
+
+	current, err := GetActiveShardMap()
+	if err != nil {
+		return ReshardJob{}, err
+	}
+
+	job := ReshardJob{Phase: ReshardPhaseCopying}
+
+	err = DBConn.Transaction(func(tx *gorm.DB) error {
+		var maxVersion int
+		if err := tx.Model(&ShardMap{}).Select("COALESCE(MAX(version), 0)").Scan(&maxVersion).Error; err != nil {
+			return err
+		}
+
+		if !current.Active {
+			maxVersion++
+			current.Version = maxVersion
+			current.Active = true
+
+			if err := tx.Create(&current).Error; err != nil {
+				return err
+			}
+		}
+
+		newMap.Version = maxVersion + 1
+		newMap.Active = false
+
+		if err := tx.Create(&newMap).Error; err != nil {
+			return err
+		}
+
+		job.FromVersion = current.Version
+		job.ToVersion = newMap.Version
+
+		return tx.Create(&job).Error
+	})
+
+	return job, err
+}
+
+// Unfinished job, a stopped job is resumed instead of starting a new one
+func getUnfinishedReshardJob() (*ReshardJob, error) {
+	var job ReshardJob
+	result := DBConn.Where("phase <> ?", ReshardPhaseCompleted).Order("id DESC").Limit(1).Find(&job)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &job, nil
+}
+
+func GetReshardJobs() ([]ReshardJob, error) {
+	jobs := []ReshardJob{}
+	err := DBConn.Order("id DESC").Find(&jobs).Error
+	return jobs, err
+}
+
+type reshardRun struct {
+	job  *ReshardJob
+	from *shardTopology
+	to   *shardTopology
+}
+
+func (r *reshardRun) save() error {
+	return DBConn.Save(r.job).Error
+}
+
+// forEachMovedUser calls fn for the users changing shard after the job cursor, advancing it per batch
+func (r *reshardRun) forEachMovedUser(fn func(userID string, fromShard int, toShard int) error) error {
+	return walkUsers(context.Background(), r.job.LastUserID, func(ids []string) error {
+		for _, id := range ids {
+			fromShard, toShard, moved, err := userMove(r.from, r.to, id)
+			if err != nil {
+				return err
+			}
+
+			if !moved {
+				continue
+			}
+
+			if r.to.shards[toShard].ReadOnly {
+				return fmt.Errorf("user %s moves to %s: %w", id, r.to.shards[toShard].Name, ErrShardReadOnly)
+			}
+
+			if err := fn(id, fromShard, toShard); err != nil {
+				return err
+			}
+		}
+
+		r.job.LastUserID = ids[len(ids)-1]
+
+		return r.save()
+	})
+}
+
+func (r *reshardRun) copyPhase() error {
+	err := r.forEachMovedUser(func(userID string, fromShard int, toShard int) error {
+		if _, err := copyUser(r.from.conns[fromShard], r.to.conns[toShard], userID); err != nil {
+			return fmt.Errorf("copying user %s failed: %w", userID, err)
+		}
+
+		r.job.Moved++
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	r.job.Phase = ReshardPhaseVerifying
+	r.job.LastUserID = ""
+
+	return r.save()
+}
+
+// syncUser copies the user again when it changed on the old shard since it was copied
+func (r *reshardRun) syncUser(userID string, fromShard int, toShard int) error {
+	source, destination := r.from.conns[fromShard], r.to.conns[toShard]
+
+	matches, err := verifyUser(source, destination, userID)
+	if err != nil {
+		return err
+	}
+
+	if matches {
+		return nil
+	}
+
+	if _, err := copyUser(source, destination, userID); err != nil {
+		return fmt.Errorf("copying user %s failed: %w", userID, err)
+	}
+
+	matches, err = verifyUser(source, destination, userID)
+	if err != nil {
+		return err
+	}
+
+	if !matches {
+		return fmt.Errorf("user %s differs between %s and %s after copy", userID, r.from.shards[fromShard].Name, r.to.shards[toShard].Name)
+	}
+
+	return nil
+}
+
+// verifyPhase checks every moved user again, users changed during the copy are copied once more,
+// then the old layout is fenced
+func (r *reshardRun) verifyPhase() error {
+	if err := r.forEachMovedUser(r.syncUser); err != nil {
+		return err
+	}
+
+	return r.fence()
+}
+
+// fence activates a copy of the old layout that servers route with like the old one, except that the
+// job's FenceVersion points them at the new layout: writes of the users it moves fail, see shardTopology.fenced.
+// Servers still on the old layout could otherwise write moods and refresh tokens to the old shard after the flip,
+// where they are lost. The other users of the shards keep writing, shard writes of moved users wait in the outbox
+func (r *reshardRun) fence() error {
+	fenced := ShardMap{Placement: r.from.placement, Shards: slices.Clone(r.from.shards)}
+
+	return DBConn.Transaction(func(tx *gorm.DB) error {
+		var maxVersion int
+		if err := tx.Model(&ShardMap{}).Select("COALESCE(MAX(version), 0)").Scan(&maxVersion).Error; err != nil {
+			return err
+		}
+
+		fenced.Version = maxVersion + 1
+
+		if err := tx.Create(&fenced).Error; err != nil {
+			return err
+		}
+
+		if err := activateShardMap(tx, fenced.Version); err != nil {
+			return err
+		}
+
+		r.job.FenceVersion = &fenced.Version
+		r.job.Phase = ReshardPhaseFencing
+		r.job.LastUserID = ""
+
+		return tx.Save(r.job).Error
+	})
+}
+
+// flipPhase runs once every server routes with the fenced layout, the moved users cannot change any more.
+// They are synced a last time and the new layout is activated in the same transaction that advances the job
+func (r *reshardRun) flipPhase() error {
+	if err := r.forEachMovedUser(r.syncUser); err != nil {
+		return err
+	}
+
+	return DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := activateShardMap(tx, r.job.ToVersion); err != nil {
+			return err
+		}
+
+		r.job.Phase = ReshardPhaseCleanup
+		r.job.LastUserID = ""
+
+		return tx.Save(r.job).Error
+	})
+}
+
+func activateShardMap(tx *gorm.DB, version int) error {
+	if err := tx.Model(&ShardMap{}).Where("active = ?", true).Update("active", false).Error; err != nil {
+		return err
+	}
+
+	return tx.Model(&ShardMap{}).Where("version = ?", version).Update("active", true).Error
+}
+
+// cleanupPhase deletes moved users from their old shard once they still match the copy
+func (r *reshardRun) cleanupPhase() error {
+	err := r.forEachMovedUser(func(userID string, fromShard int, toShard int) error {
+		source, destination := r.from.conns[fromShard], r.to.conns[toShard]
+
+		matches, err := verifyUser(source, destination, userID)
+		if err != nil {
+			return err
+		}
+
+		// The user was fenced before the last sync, only a server that missed the fence writes there
+		if !matches {
+			slog.Warn("User changed on its old shard after the fence, left in place", "user_id", userID, "shard", r.from.shards[fromShard].Name)
+			r.job.Skipped++
+			return nil
+		}
+
+		if r.from.shards[fromShard].ReadOnly {
+			slog.Warn("User left on read-only shard", "user_id", userID, "shard", r.from.shards[fromShard].Name)
+			r.job.Skipped++
+			return nil
+		}
+
+		if err := source.Transaction(func(tx *gorm.DB) error {
+			return deleteUserShardData(tx, userID)
+		}); err != nil {
+			return fmt.Errorf("deleting user %s from %s failed: %w", userID, r.from.shards[fromShard].Name, err)
+		}
+
+		r.job.Deleted++
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	r.job.Phase = ReshardPhaseCompleted
+	r.job.LastUserID = ""
+
+	return r.save()
+}
+
+// RunReshard moves the users to the given layout, or resumes the unfinished job for it
+func RunReshard(newMap ShardMap) (ReshardJob, error) {
+	if err := ValidateShardMap(newMap); err != nil {
+		return ReshardJob{}, err
+	}
+
+	unlock, locked, err := tryAdvisoryLock(reshardLockKey)
+	if err != nil {
+		return ReshardJob{}, err
+	}
+	if !locked {
+		return ReshardJob{}, ErrReshardRunning
+	}
+	defer unlock()
+
+	job, err := getUnfinishedReshardJob()
+	if err != nil {
+		return ReshardJob{}, err
+	}
+
+	if job != nil {
+		toMap, err := getShardMap(job.ToVersion)
+		if err != nil {
+			return ReshardJob{}, err
+		}
+
+		if toMap.Placement != newMap.Placement || !slices.Equal(toMap.Shards, newMap.Shards) {
+			return *job, fmt.Errorf("reshard job %d to shard map version %d is unfinished, resume it with the same shard map", job.ID, job.ToVersion)
+		}
+
+		slog.Info("Resuming reshard job", "job", job.ID, "phase", job.Phase)
+	} else {
+		created, err := createReshardJob(newMap)
+		if err != nil {
+			return ReshardJob{}, err
+		}
+		job = &created
+
+		slog.Info("Started reshard job", "job", job.ID, "from_version", job.FromVersion, "to_version", job.ToVersion)
+	}
+
+	run, err := newReshardRun(job)
+	if err != nil {
+		return *job, err
+	}
+	defer run.close()
+
+	if err := run.execute(); err != nil {
+		job.LastError = err.Error()
+		if saveErr := run.save(); saveErr != nil {
+			slog.Error("Failed to save reshard job", "job", job.ID, "error", saveErr)
+		}
+		return *job, err
+	}
+
+	return *job, nil
+}
+
+func newReshardRun(job *ReshardJob) (*reshardRun, error) {
+	fromMap, err := getShardMap(job.FromVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	toMap, err := getShardMap(job.ToVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := newShardTopology(fromMap, currentTopology())
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := newShardTopology(toMap, from)
+	if err != nil {
+		from.closeConnsNotIn(currentTopology())
+		return nil, err
+	}
+
+	run := &reshardRun{job: job, from: from, to: to}
+
+	// Shards added by the new layout need the schema before users are copied to them
+	for i, shard := range to.shards {
+		count, err := MigrateUp(to.conns[i], ShardMigrations)
+		if err != nil {
+			run.close()
+			return nil, fmt.Errorf("migrating shard %s failed: %w", shard.Name, err)
+		}
+		if count > 0 {
+			slog.Info("Applied shard migrations", "shard", shard.Name, "count", count)
+		}
+	}
+
+	return run, nil
+}
+
+// waitForServers gives every server time to switch to the shard map version
+func (r *reshardRun) waitForServers(version int) {
+	wait := 2 * SHARD_MAP_REFRESH_INTERVAL
+	slog.Info("Waiting for servers to switch shard map", "wait", wait, "version", version)
+	time.Sleep(wait)
+}
+
+// close releases the pools opened for the job that the server's own topology does not use
+func (r *reshardRun) close() {
+	current := currentTopology()
+
+	r.to.closeConnsNotIn(r.from, current)
+	r.from.closeConnsNotIn(current)
+}
+
+func (r *reshardRun) execute() error {
+	r.job.LastError = ""
+
+	for r.job.Phase != ReshardPhaseCompleted {
+		slog.Info("Reshard phase", "job", r.job.ID, "phase", r.job.Phase)
+
+		var err error
+
+		switch r.job.Phase {
+		case ReshardPhaseCopying:
+			err = r.copyPhase()
+		case ReshardPhaseVerifying:
+			err = r.verifyPhase()
+		case ReshardPhaseFencing:
+			// Let every server stop writing for the moved users before the last sync
+			r.waitForServers(*r.job.FenceVersion)
+
+			err = r.flipPhase()
+		case ReshardPhaseCleanup:
+			// Let every server pick up the new shard map before the old copies go away
+			r.waitForServers(r.job.ToVersion)
+
+			err = r.cleanupPhase()
+		default:
+			err = fmt.Errorf("unknown reshard phase %s", r.job.Phase)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Reshard job completed", "job", r.job.ID, "moved", r.job.Moved, "deleted", r.job.Deleted, "skipped", r.job.Skipped)
+
+	return nil
+}
+
+// Sorted move descriptions of a plan, for printing
+func (p ReshardPlan) SortedMoves() []string {
+	moves := []string{}
+	for move := range p.Moves {
+		moves = append(moves, move)
+	}
+	sort.Strings(moves)
+	return moves
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidUserID = errors.New("invalid user id")
+var ErrRingEmpty = errors.New("hash ring has no nodes")
+
+// Virtual nodes placed on the ring per unit of weight, overridable with SHARD_VIRTUAL_NODES
+var DEFAULT_VIRTUAL_NODES = 128
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// HashRing is a consistent-hash ring, adding or removing a node only moves the keys of that node
+type HashRing struct {
+	mu           sync.RWMutex
+	virtualNodes int
+	weights      map[string]int
+	points       []ringPoint
+}
+
+func NewHashRing(virtualNodes int) *HashRing {
+	if virtualNodes < 1 {
+		virtualNodes = DEFAULT_VIRTUAL_NODES
+	}
+
+	return &HashRing{virtualNodes: virtualNodes, weights: make(map[string]int)}
+}
+
+func ringHash(data []byte) uint64 {
+	hash := sha256.Sum256(data)
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// AddNode places weight * virtualNodes points of the node on the ring, re-adding a node updates its weight
+func (r *HashRing) AddNode(name string, weight int) error {
+	if name == "" {
+		return errors.New("ring node name is empty")
+	}
+	if weight < 1 {
+		return fmt.Errorf("weight of ring node %s must be at least 1", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.weights[name] = weight
+	r.rebuild()
+
+	return nil
+}
+
+func (r *HashRing) RemoveNode(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.weights, name)
+	r.rebuild()
+}
+
+func (r *HashRing) rebuild() {
+	points := []ringPoint{}
+
+	for name, weight := range r.weights {
+		for i := 0; i < weight*r.virtualNodes; i++ {
+			points = append(points, ringPoint{hash: ringHash([]byte(name + "#" + strconv.Itoa(i))), node: name})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].node < points[j].node
+		}
+		return points[i].hash < points[j].hash
+	})
+
+	r.points = points
+}
+
+// GetNode returns the node owning the key: the first point clockwise from the hash of the key
+func (r *HashRing) GetNode(key []byte) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return "", ErrRingEmpty
+	}
+
+	hash := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].node, nil
+}
+
+func (r *HashRing) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := []string{}
+	for name := range r.weights {
+		nodes = append(nodes, name)
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// GetUserNode parses the user id and returns the node owning it
+func (r *HashRing) GetUserNode(userID string) (string, error) {
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %v", ErrInvalidUserID, userID, err)
+	}
+
+	return r.GetNode(id[:])
+}
+
+// moduloShard is how users were placed before the ring: the first 4 bytes of the sha256 of the id modulo
+// the number of shards. Shard maps with the modulo placement keep using it, see PlacementModulo
+func moduloShard(userID string, shards int) (int, error) {
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return 0, fmt.Errorf("%w %q: %v", ErrInvalidUserID, userID, err)
+	}
+
+	if shards == 0 {
+		return 0, ErrRingEmpty
+	}
+
+	hash := sha256.Sum256(id[:])
+
+	return int(binary.BigEndian.Uint32(hash[:4]) % uint32(shards)), nil
+}
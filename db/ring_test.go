@@ -0,0 +1,175 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+const ringTestKeys = 20000
+
+func ringTestUserIds() []string {
+	ids := make([]string, ringTestKeys)
+	for i := range ids {
+		ids[i] = uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("user-%d", i))).String()
+	}
+	return ids
+}
+
+func newTestRing(t *testing.T, weights map[string]int) *HashRing {
+	ring := NewHashRing(DEFAULT_VIRTUAL_NODES)
+	for name, weight := range weights {
+		if err := ring.AddNode(name, weight); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ring
+}
+
+func assignUsers(t *testing.T, ring *HashRing, ids []string) map[string]string {
+	assignment := make(map[string]string, len(ids))
+	for _, id := range ids {
+		node, err := ring.GetUserNode(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assignment[id] = node
+	}
+	return assignment
+}
+
+func TestAddingShardOnlyMovesKeysToIt(t *testing.T) {
+	ids := ringTestUserIds()
+	ring := newTestRing(t, map[string]int{"shard-0": 1, "shard-1": 1})
+	before := assignUsers(t, ring, ids)
+
+	if err := ring.AddNode("shard-2", 1); err != nil {
+		t.Fatal(err)
+	}
+	after := assignUsers(t, ring, ids)
+
+	moved := 0
+	for _, id := range ids {
+		if before[id] == after[id] {
+			continue
+		}
+		if after[id] != "shard-2" {
+			t.Fatalf("user %s moved from %s to %s instead of the new shard", id, before[id], after[id])
+		}
+		moved++
+	}
+
+	// Ideally a third of the keys move, modulo hashing would move two thirds
+	fraction := float64(moved) / float64(len(ids))
+	if math.Abs(fraction-1.0/3) > 0.05 {
+		t.Fatalf("expected about a third of the users to move, %.3f moved", fraction)
+	}
+}
+
+func TestRemovingShardOnlyMovesItsKeys(t *testing.T) {
+	ids := ringTestUserIds()
+	ring := newTestRing(t, map[string]int{"shard-0": 1, "shard-1": 1, "shard-2": 1})
+	before := assignUsers(t, ring, ids)
+
+	ring.RemoveNode("shard-1")
+	after := assignUsers(t, ring, ids)
+
+	for _, id := range ids {
+		if before[id] != "shard-1" && before[id] != after[id] {
+			t.Fatalf("user %s moved from %s to %s although its shard was kept", id, before[id], after[id])
+		}
+		if after[id] == "shard-1" {
+			t.Fatalf("user %s is still routed to the removed shard", id)
+		}
+	}
+}
+
+func TestWeightsSkewDistribution(t *testing.T) {
+	ids := ringTestUserIds()
+	ring := newTestRing(t, map[string]int{"shard-0": 1, "shard-1": 3})
+
+	counts := map[string]int{}
+	for _, node := range assignUsers(t, ring, ids) {
+		counts[node]++
+	}
+
+	fraction := float64(counts["shard-1"]) / float64(len(ids))
+	if math.Abs(fraction-0.75) > 0.05 {
+		t.Fatalf("expected about 75%% of the users on the weight 3 shard, got %.3f", fraction)
+	}
+}
+
+func TestRingIsDeterministic(t *testing.T) {
+	ids := ringTestUserIds()
+	first := assignUsers(t, newTestRing(t, map[string]int{"shard-0": 1, "shard-1": 2}), ids)
+	second := assignUsers(t, newTestRing(t, map[string]int{"shard-1": 2, "shard-0": 1}), ids)
+
+	for _, id := range ids {
+		if first[id] != second[id] {
+			t.Fatalf("user %s routed to %s and %s by identical rings", id, first[id], second[id])
+		}
+	}
+}
+
+func TestInvalidUserIdIsRejected(t *testing.T) {
+	ring := newTestRing(t, map[string]int{"shard-0": 1})
+
+	for _, id := range []string{"", "not-a-uuid", "1234"} {
+		if _, err := ring.GetUserNode(id); !errors.Is(err, ErrInvalidUserID) {
+			t.Fatalf("expected ErrInvalidUserID for %q, got %v", id, err)
+		}
+	}
+}
+
+func TestEmptyRing(t *testing.T) {
+	ring := NewHashRing(DEFAULT_VIRTUAL_NODES)
+
+	if _, err := ring.GetUserNode(uuid.New().String()); !errors.Is(err, ErrRingEmpty) {
+		t.Fatalf("expected ErrRingEmpty, got %v", err)
+	}
+}
+
+func TestInvalidWeight(t *testing.T) {
+	ring := NewHashRing(DEFAULT_VIRTUAL_NODES)
+
+	if err := ring.AddNode("shard-0", 0); err == nil {
+		t.Fatal("expected an error for a zero weight")
+	}
+}
+
+func TestModuloPlacementKeepsLegacyRouting(t *testing.T) {
+	shards := []ShardSpec{{Name: "shard-0", Weight: 1}, {Name: "shard-1", Weight: 1}}
+	modulo := &shardTopology{placement: PlacementModulo, shards: shards}
+	ring := &shardTopology{placement: PlacementRing, shards: shards, ring: newTestRing(t, map[string]int{"shard-0": 1, "shard-1": 1}),
+		indexByName: map[string]int{"shard-0": 0, "shard-1": 1}}
+
+	moved := 0
+	for _, id := range ringTestUserIds() {
+		// How users were placed before the ring
+		parsed := uuid.MustParse(id)
+		hash := sha256.Sum256(parsed[:])
+		legacy := int(binary.BigEndian.Uint32(hash[:4]) % 2)
+
+		shard, err := modulo.shardFor(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shard != legacy {
+			t.Fatalf("user %s routed to shard %d, it was stored on %d", id, shard, legacy)
+		}
+
+		if onRing, _ := ring.shardFor(id); onRing != shard {
+			moved++
+		}
+	}
+
+	// Why the placement cannot change without a reshard job
+	if moved == 0 {
+		t.Fatal("expected the ring to place some users elsewhere")
+	}
+}
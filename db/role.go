@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	PermissionTodosRead   = "todos:read"
+	PermissionTodosWrite  = "todos:write"
+	PermissionGlowUpRead  = "glowup:read"
+	PermissionGlowUpWrite = "glowup:write"
+	PermissionUsersRead   = "users:read"
+	PermissionUsersWrite  = "users:write"
+	PermissionSystemRead  = "system:read"
+	PermissionSystemWrite = "system:write"
+)
+
+const (
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+)
+
+type Permission struct {
+	ID          string `gorm:"type:uuid;default:uuid_generate_v4()" json:"id"`
+	Name        string `gorm:"uniqueIndex" json:"name"`
+	Description string `json:"description"`
+}
+
+type Role struct {
+	ID          string       `gorm:"type:uuid;default:uuid_generate_v4()" json:"id"`
+	Name        string       `gorm:"uniqueIndex" json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `gorm:"many2many:role_permissions" json:"permissions"`
+}
+
+type UserRole struct {
+	UserId string `gorm:"type:uuid;primaryKey" json:"userId"`
+	RoleId string `gorm:"type:uuid;primaryKey" json:"roleId"`
+}
+
+// Roles and the permissions they grant, created on startup
+var defaultRoles = map[string][]string{
+	RoleUser:    {PermissionTodosRead, PermissionTodosWrite, PermissionGlowUpRead, PermissionGlowUpWrite},
+	RoleAdmin:   {PermissionTodosRead, PermissionTodosWrite, PermissionGlowUpRead, PermissionGlowUpWrite, PermissionUsersRead, PermissionUsersWrite, PermissionSystemRead, PermissionSystemWrite},
+	RoleSupport: {PermissionTodosRead, PermissionGlowUpRead, PermissionUsersRead},
+}
+
+var roleDescriptions = map[string]string{
+	RoleUser:    "Regular user managing own data",
+	RoleAdmin:   "Full access including user management",
+	RoleSupport: "Read-only support staff",
+}
+
+// SeedRoles creates the default roles and permissions, gives users without a role the
+// user role and grants the admin role to the configured admin emails
+func SeedRoles() error {
+	err := DBConn.Transaction(func(tx *gorm.DB) error {
+		for roleName, permissionNames := range defaultRoles {
+			role := Role{Name: roleName, Description: roleDescriptions[roleName]}
+
+			if err := tx.Where(Role{Name: roleName}).FirstOrCreate(&role).Error; err != nil {
+				return err
+			}
+
+			permissions := []Permission{}
+			for _, permissionName := range permissionNames {
+				permission := Permission{Name: permissionName}
+
+				if err := tx.Where(Permission{Name: permissionName}).FirstOrCreate(&permission).Error; err != nil {
+					return err
+				}
+				permissions = append(permissions, permission)
+			}
+
+			if err := tx.Model(&role).Association("Permissions").Replace(permissions); err != nil {
+				return err
+			}
+		}
+
+		return tx.Exec(`
+		INSERT INTO user_roles (user_id, role_id)
+		SELECT users.user_id, roles.id FROM users, roles
+		WHERE roles.name = ? AND NOT EXISTS (SELECT 1 FROM user_roles WHERE user_roles.user_id = users.user_id)`, RoleUser).Error
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, email := range settings.AdminEmails {
+		user, err := GetUserByEmail(context.Background(), email)
+		if err != nil {
+			slog.Warn("Admin email not found", "email", email)
+			continue
+		}
+
+		if err := AssignRole(user.UserId, RoleAdmin); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Roles and permissions seeded")
+
+	return nil
+}
+
+func GetRoles(ctx context.Context) ([]Role, error) {
+	var roles []Role
+
+	if err := DBConn.WithContext(ctx).Preload("Permissions").Order("name ASC").Find(&roles).Error; err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func AssignRole(userId string, roleName string) error {
+	return assignRoleInTx(DBConn, userId, roleName)
+}
+
+func assignRoleInTx(tx *gorm.DB, userId string, roleName string) error {
+	var role Role
+
+	if err := tx.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return err
+	}
+
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&UserRole{UserId: userId, RoleId: role.ID}).Error
+}
+
+// SetUserRoles replaces the roles of the user with the given ones
+func SetUserRoles(ctx context.Context, userId string, roleNames []string) error {
+	// A role named twice is assigned once, the count below compares distinct names
+	roleNames = slices.Compact(slices.Sorted(slices.Values(roleNames)))
+
+	return DBConn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var roles []Role
+
+		if err := tx.Where("name IN ?", roleNames).Find(&roles).Error; err != nil {
+			return err
+		}
+
+		if len(roles) != len(roleNames) {
+			return gorm.ErrRecordNotFound
+		}
+
+		if err := tx.Where("user_id = ?", userId).Delete(&UserRole{}).Error; err != nil {
+			return err
+		}
+
+		for _, role := range roles {
+			if err := tx.Create(&UserRole{UserId: userId, RoleId: role.ID}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetUserRolesAndPermissions returns the role names of the user and the union of their permissions
+func GetUserRolesAndPermissions(ctx context.Context, userId string) ([]string, []string, error) {
+	roleNames := []string{}
+	permissionNames := []string{}
+
+	err := DBConn.WithContext(ctx).Model(&Role{}).
+		Joins("JOIN user_roles ON user_roles.role_id = roles.id").
+		Where("user_roles.user_id = ?", userId).
+		Order("roles.name ASC").
+		Pluck("roles.name", &roleNames).Error
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = DBConn.WithContext(ctx).Model(&Permission{}).
+		Distinct("permissions.name").
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permissions.id").
+		Joins("JOIN user_roles ON user_roles.role_id = role_permissions.role_id").
+		Where("user_roles.user_id = ?", userId).
+		Order("permissions.name ASC").
+		Pluck("permissions.name", &permissionNames).Error
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return roleNames, permissionNames, nil
+}
@@ -0,0 +1,264 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Time a single shard gets to answer a scatter-gather query
+var SCATTER_SHARD_TIMEOUT = 2 * time.Second
+
+type ShardError struct {
+	Shard string `json:"shard"`
+	Error string `json:"error"`
+}
+
+type ScatterOptions[T any] struct {
+	Timeout time.Duration     // Per shard, SCATTER_SHARD_TIMEOUT when zero
+	Less    func(a, b T) bool // Order of the merged results, shard order when nil
+	Offset  int
+	Limit   int // All results when zero
+
+	// Results with the same key are merged into one, e.g. the copies of a user left on two shards by a
+	// reshard. The copy from the shard named by Owner wins, otherwise the first in the merged order
+	Key   func(item T) string
+	Owner func(item T) string
+}
+
+// ScatterResult holds one page of the merged results. Partial is set when shards failed,
+// the results of the other shards are still returned
+type ScatterResult[T any] struct {
+	Items   []T          `json:"items"`
+	HasMore bool         `json:"hasMore"` // Results after this page on the shards that answered
+	Partial bool         `json:"partial"`
+	Failed  []ShardError `json:"failed"`
+}
+
+// ScatterGather runs the query concurrently on every shard and merges the results. The query gets
+// the number of rows each shard has to return at most for the requested page, 0 meaning all of them.
+// It runs again with more rows when merging copies left the page undecided
+func ScatterGather[T any](ctx context.Context, query func(conn *gorm.DB, fetch int) ([]T, error), options ScatterOptions[T]) ScatterResult[T] {
+	t := currentTopology()
+
+	names := make([]string, len(t.shards))
+	for i, shard := range t.shards {
+		names[i] = shard.Name
+	}
+
+	return scatterGather(ctx, names, func(ctx context.Context, shard int, fetch int) ([]T, error) {
+		return query(t.conns[shard].WithContext(ctx), fetch)
+	}, options)
+}
+
+type shardItem[T any] struct {
+	shard int
+	item  T
+}
+
+// scatterGather is ScatterGather on the named shards, query is called with the shard index
+func scatterGather[T any](ctx context.Context, shards []string, query func(ctx context.Context, shard int, fetch int) ([]T, error), options ScatterOptions[T]) ScatterResult[T] {
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = SCATTER_SHARD_TIMEOUT
+	}
+
+	// One row more than the page, so HasMore knows whether a shard has rows after it
+	fetch := 0
+	if options.Limit > 0 {
+		fetch = options.Offset + options.Limit + 1
+	}
+	needed := fetch
+
+	for {
+		results, errs := queryShards(ctx, shards, query, timeout, fetch)
+
+		result := ScatterResult[T]{Items: []T{}, Failed: []ShardError{}}
+		merged := []shardItem[T]{}
+		truncated := []int{} // Shards that returned fetch rows and may have more after them
+
+		for i, shard := range shards {
+			if errs[i] != nil {
+				result.Failed = append(result.Failed, ShardError{Shard: shard, Error: errs[i].Error()})
+				continue
+			}
+			for _, item := range results[i] {
+				merged = append(merged, shardItem[T]{shard: i, item: item})
+			}
+			if fetch > 0 && len(results[i]) >= fetch {
+				truncated = append(truncated, i)
+			}
+		}
+
+		result.Partial = len(result.Failed) > 0
+
+		if options.Less != nil {
+			sort.SliceStable(merged, func(i, j int) bool {
+				return options.Less(merged[i].item, merged[j].item)
+			})
+		}
+
+		if options.Key != nil {
+			merged = dedupeShardItems(merged, shards, options)
+		}
+
+		// Copies merged into one leave fewer rows than fetched, so the rows of a shard beyond its fetch could
+		// belong on this page. Fetch more until the page and the row after it are known
+		if fetch > 0 && len(truncated) > 0 && settledItems(merged, shards, results, truncated, options) < needed {
+			fetch *= 2
+			continue
+		}
+
+		start := min(options.Offset, len(merged))
+		end := len(merged)
+		if options.Limit > 0 {
+			end = min(start+options.Limit, len(merged))
+		}
+
+		for _, entry := range merged[start:end] {
+			result.Items = append(result.Items, entry.item)
+		}
+		result.HasMore = end < len(merged)
+
+		return result
+	}
+}
+
+// queryShards runs the query concurrently on every shard, each with its own timeout
+func queryShards[T any](ctx context.Context, shards []string, query func(ctx context.Context, shard int, fetch int) ([]T, error), timeout time.Duration, fetch int) ([][]T, []error) {
+	results := make([][]T, len(shards))
+	errs := make([]error, len(shards))
+
+	var wg sync.WaitGroup
+
+	for i := range shards {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			shardCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			results[i], errs[i] = query(shardCtx, i, fetch)
+
+			// A query ignoring ctx still counts as timed out
+			if errs[i] == nil && shardCtx.Err() != nil {
+				results[i], errs[i] = nil, shardCtx.Err()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	return results, errs
+}
+
+// settledItems counts the leading merged items no unfetched row of a truncated shard can come before or replace.
+// Without an order the shards are concatenated, so everything up to the first truncated shard is settled
+func settledItems[T any](merged []shardItem[T], shards []string, results [][]T, truncated []int, options ScatterOptions[T]) int {
+	for i, entry := range merged {
+		for _, shard := range truncated {
+			last := results[shard][len(results[shard])-1]
+
+			if options.Less == nil && entry.shard > shard || options.Less != nil && options.Less(last, entry.item) {
+				return i
+			}
+
+			// The copy of the owning shard wins and may not be fetched yet
+			if options.Owner != nil && entry.shard != shard && options.Owner(entry.item) == shards[shard] {
+				return i
+			}
+		}
+	}
+
+	return len(merged)
+}
+
+// dedupeShardItems keeps one item per key, at the position of the copy that wins
+func dedupeShardItems[T any](merged []shardItem[T], shards []string, options ScatterOptions[T]) []shardItem[T] {
+	winner := make(map[string]int, len(merged))
+
+	for i, candidate := range merged {
+		key := options.Key(candidate.item)
+
+		current, seen := winner[key]
+		if !seen {
+			winner[key] = i
+			continue
+		}
+
+		if options.Owner != nil {
+			owner := options.Owner(candidate.item)
+			if shards[candidate.shard] == owner && shards[merged[current].shard] != owner {
+				winner[key] = i
+			}
+		}
+	}
+
+	deduped := make([]shardItem[T], 0, len(winner))
+	for i, candidate := range merged {
+		if winner[options.Key(candidate.item)] == i {
+			deduped = append(deduped, candidate)
+		}
+	}
+
+	return deduped
+}
+
+// ScatterCount sums a count run on every shard, the counts of failed shards are left out and reported
+func ScatterCount(ctx context.Context, query func(conn *gorm.DB) *gorm.DB) (int64, []ShardError) {
+	result := ScatterGather(ctx, func(conn *gorm.DB, fetch int) ([]int64, error) {
+		var count int64
+		if err := query(conn).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		return []int64{count}, nil
+	}, ScatterOptions[int64]{})
+
+	var total int64
+	for _, count := range result.Items {
+		total += count
+	}
+
+	return total, result.Failed
+}
+
+// ListShardUsers pages through the users of every shard ordered by email, optionally filtered by email.
+// A user found on several shards, e.g. during a reshard, is listed once with the copy of its current shard
+func ListShardUsers(ctx context.Context, email string, offset int, limit int) ScatterResult[User] {
+	return ScatterGather(ctx, func(conn *gorm.DB, fetch int) ([]User, error) {
+		var users []User
+
+		// Byte order, so shards sort like the merge in Go regardless of their collation
+		query := conn.Model(&User{}).Order(`email COLLATE "C" ASC`)
+		if email != "" {
+			query = query.Where("email = ?", email)
+		}
+		if fetch > 0 {
+			query = query.Limit(fetch)
+		}
+
+		if err := query.Find(&users).Error; err != nil {
+			return nil, err
+		}
+
+		return users, nil
+	}, ScatterOptions[User]{
+		Less:   func(a, b User) bool { return a.Email < b.Email },
+		Offset: offset,
+		Limit:  limit,
+		Key:    func(user User) string { return user.UserId },
+		Owner:  func(user User) string { return shardNameOf(user.UserId) },
+	})
+}
+
+// CountShardMoodScores counts the mood records of the given month across all shards
+func CountShardMoodScores(ctx context.Context, year int, month int) (int64, []ShardError) {
+	return ScatterCount(ctx, func(conn *gorm.DB) *gorm.DB {
+		return conn.Model(&MoodScore{}).Where("year = ? AND month = ?", year, month)
+	})
+}
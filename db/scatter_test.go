@@ -0,0 +1,218 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeRow struct {
+	id    string
+	email string
+}
+
+var fakeShards = []string{"shard-0", "shard-1", "shard-2"}
+
+// fakeShardQuery serves the rows of each shard ordered by email like ListShardUsers, limited to fetch
+func fakeShardQuery(rows [][]fakeRow) func(ctx context.Context, shard int, fetch int) ([]fakeRow, error) {
+	return func(ctx context.Context, shard int, fetch int) ([]fakeRow, error) {
+		sorted := slices.SortedFunc(slices.Values(rows[shard]), func(a, b fakeRow) int { return strings.Compare(a.email, b.email) })
+		if fetch > 0 && fetch < len(sorted) {
+			sorted = sorted[:fetch]
+		}
+		return sorted, nil
+	}
+}
+
+func fakeOptions(offset int, limit int) ScatterOptions[fakeRow] {
+	return ScatterOptions[fakeRow]{
+		Less:   func(a, b fakeRow) bool { return a.email < b.email },
+		Offset: offset,
+		Limit:  limit,
+		Key:    func(row fakeRow) string { return row.id },
+	}
+}
+
+func emails(rows []fakeRow) []string {
+	result := make([]string, len(rows))
+	for i, row := range rows {
+		result[i] = row.email
+	}
+	return result
+}
+
+func TestScatterGatherPagesDoNotOverlap(t *testing.T) {
+	rows := [][]fakeRow{
+		{{"1", "a"}, {"4", "d"}, {"7", "g"}},
+		{{"2", "b"}, {"5", "e"}},
+		{{"3", "c"}, {"6", "f"}, {"8", "h"}, {"9", "i"}},
+	}
+
+	var listed []string
+	for offset := 0; ; offset += 2 {
+		page := scatterGather(context.Background(), fakeShards, fakeShardQuery(rows), fakeOptions(offset, 2))
+		if page.Partial {
+			t.Fatalf("unexpected failed shards %v", page.Failed)
+		}
+
+		listed = append(listed, emails(page.Items)...)
+
+		if !page.HasMore {
+			break
+		}
+		if len(page.Items) != 2 {
+			t.Fatalf("expected a full page before the last one, got %v", page.Items)
+		}
+	}
+
+	expected := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i"}
+	if !slices.Equal(listed, expected) {
+		t.Errorf("expected every row once in order %v, got %v", expected, listed)
+	}
+}
+
+func TestScatterGatherMergesCopiesOnSeveralShards(t *testing.T) {
+	// User 2 was copied to shard-1 by a reshard and is still on shard-0
+	rows := [][]fakeRow{
+		{{"1", "a"}, {"2", "b"}},
+		{{"2", "b"}, {"3", "c"}},
+		{{"4", "d"}},
+	}
+
+	first := scatterGather(context.Background(), fakeShards, fakeShardQuery(rows), fakeOptions(0, 2))
+	second := scatterGather(context.Background(), fakeShards, fakeShardQuery(rows), fakeOptions(2, 2))
+
+	if got := emails(append(first.Items, second.Items...)); !slices.Equal(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("expected each user once, got %v", got)
+	}
+	if !first.HasMore || second.HasMore {
+		t.Errorf("expected more after the first page only, got %t and %t", first.HasMore, second.HasMore)
+	}
+}
+
+func TestScatterGatherKeepsCopyOfOwner(t *testing.T) {
+	// A stale copy of user 1 with its old email is left on shard-0, shard-1 owns the user
+	rows := [][]fakeRow{
+		{{"1", "old"}},
+		{{"1", "new"}},
+		{},
+	}
+
+	options := fakeOptions(0, 10)
+	options.Owner = func(row fakeRow) string { return "shard-1" }
+
+	result := scatterGather(context.Background(), fakeShards, fakeShardQuery(rows), options)
+
+	if got := emails(result.Items); !slices.Equal(got, []string{"new"}) {
+		t.Errorf("expected the copy of the owning shard, got %v", got)
+	}
+}
+
+func TestScatterGatherShardTimeout(t *testing.T) {
+	rows := [][]fakeRow{{{"1", "a"}}, {{"2", "b"}}, {{"3", "c"}}}
+	serve := fakeShardQuery(rows)
+
+	query := func(ctx context.Context, shard int, fetch int) ([]fakeRow, error) {
+		if shard == 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return serve(ctx, shard, fetch)
+	}
+
+	options := fakeOptions(0, 10)
+	options.Timeout = 20 * time.Millisecond
+
+	start := time.Now()
+	result := scatterGather(context.Background(), fakeShards, query, options)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the slow shard to be cut off, took %s", elapsed)
+	}
+	if !result.Partial || len(result.Failed) != 1 || result.Failed[0].Shard != "shard-1" {
+		t.Errorf("expected shard-1 to be reported as failed, got %v", result.Failed)
+	}
+	if !strings.Contains(result.Failed[0].Error, context.DeadlineExceeded.Error()) {
+		t.Errorf("expected a timeout, got %s", result.Failed[0].Error)
+	}
+	if got := emails(result.Items); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("expected the rows of the other shards, got %v", got)
+	}
+}
+
+func TestScatterGatherAllShardsFail(t *testing.T) {
+	query := func(ctx context.Context, shard int, fetch int) ([]fakeRow, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	result := scatterGather(context.Background(), fakeShards, query, fakeOptions(0, 10))
+
+	if !result.Partial || len(result.Failed) != len(fakeShards) {
+		t.Errorf("expected every shard to be reported as failed, got %v", result.Failed)
+	}
+	if result.Items == nil || len(result.Items) != 0 || result.HasMore {
+		t.Errorf("expected an empty page, got %v (hasMore %t)", result.Items, result.HasMore)
+	}
+}
+
+func TestScatterGatherPagesWithCopiesMatchFullListing(t *testing.T) {
+	random := rand.New(rand.NewPCG(1, 2))
+
+	for round := range 50 {
+		rows := make([][]fakeRow, len(fakeShards))
+		owners := map[string]string{}
+
+		for user := range 30 {
+			id := fmt.Sprintf("%02d", user)
+			email := fmt.Sprintf("%c%02d", 'a'+random.IntN(26), user)
+			owner := random.IntN(len(fakeShards))
+
+			owners[id] = fakeShards[owner]
+			rows[owner] = append(rows[owner], fakeRow{id, email})
+
+			// Copies left on another shard by a reshard, some with an email changed since
+			if random.IntN(3) == 0 {
+				other := (owner + 1 + random.IntN(len(fakeShards)-1)) % len(fakeShards)
+				if random.IntN(2) == 0 {
+					email = fmt.Sprintf("%c%02d", 'a'+random.IntN(26), user)
+				}
+				rows[other] = append(rows[other], fakeRow{id, email})
+			}
+		}
+
+		options := func(offset int, limit int) ScatterOptions[fakeRow] {
+			options := fakeOptions(offset, limit)
+			options.Owner = func(row fakeRow) string { return owners[row.id] }
+			return options
+		}
+
+		expected := emails(scatterGather(context.Background(), fakeShards, fakeShardQuery(rows), options(0, 0)).Items)
+		if len(expected) != 30 {
+			t.Fatalf("round %d: expected each of the 30 users once, got %v", round, expected)
+		}
+
+		limit := 1 + random.IntN(5)
+		var listed []string
+
+		for offset := 0; ; offset += limit {
+			page := scatterGather(context.Background(), fakeShards, fakeShardQuery(rows), options(offset, limit))
+			listed = append(listed, emails(page.Items)...)
+
+			if page.HasMore != (offset+limit < len(expected)) {
+				t.Fatalf("round %d: wrong hasMore %t at offset %d", round, page.HasMore, offset)
+			}
+			if !page.HasMore {
+				break
+			}
+		}
+
+		if !slices.Equal(listed, expected) {
+			t.Fatalf("round %d with limit %d: expected the pages to list %v, got %v", round, limit, expected, listed)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// Rows written to the primary before mood records and refresh tokens moved to the shards, a finished run
+// is stored in shard_backfills
+type BackfillReport struct {
+	ID            int64     `gorm:"primaryKey" json:"id"`
+	DryRun        bool      `gorm:"-" json:"dryRun"`
+	MoodScores    int64     `json:"moodScores"`
+	RefreshTokens int64     `json:"refreshTokens"`
+	Skipped       int64     `json:"skipped"` // Rows without a valid user id or of a read-only shard, left on the primary
+	FinishedAt    time.Time `gorm:"<-:false;default:now()" json:"finishedAt"`
+}
+
+func (r *BackfillReport) TableName() string {
+	return "shard_backfills"
+}
+
+var ErrBackfillPending = errors.New("mood records and refresh tokens are still stored on the primary, run backfill-shards")
+
+// backfillTable moves the rows of one table from the primary to the shard of their user. Rows are
+// deleted from the primary only after they were written to the shard, so a rerun continues where it stopped
+func backfillTable[T any](dryRun bool, userIdOf func(T) string, idOf func(T) string, moved *int64, skipped *int64) error {
+	after := ""
+
+	for {
+		var rows []T
+
+		query := DBConn.Order("id ASC").Limit(RESHARD_BATCH_SIZE)
+		if after != "" {
+			query = query.Where("id > ?", after)
+		}
+
+		if err := query.Find(&rows).Error; err != nil {
+			return err
+		}
+
+		if len(rows) == 0 {
+			return nil
+		}
+
+		after = idOf(rows[len(rows)-1])
+
+		for _, row := range rows {
+			shardDB, err := getWritableShardByUserID(context.Background(), userIdOf(row))
+			if err != nil {
+				slog.Warn("Skipping row", "id", idOf(row), "error", err)
+				*skipped++
+				continue
+			}
+
+			*moved++
+
+			if dryRun {
+				continue
+			}
+
+			if err := shardDB.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+				return fmt.Errorf("copying row %s failed: %w", idOf(row), err)
+			}
+
+			var model T
+			if err := DBConn.Where("id = ?", idOf(row)).Delete(&model).Error; err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// BackfillShardData moves mood records and refresh tokens still stored on the primary to the shards
+func BackfillShardData(dryRun bool) (BackfillReport, error) {
+	report := BackfillReport{DryRun: dryRun}
+
+	err := backfillTable(dryRun,
+		func(m MoodScore) string { return m.UserId },
+		func(m MoodScore) string { return m.ID },
+		&report.MoodScores, &report.Skipped)
+
+	if err != nil {
+		return report, err
+	}
+
+	err = backfillTable(dryRun,
+		func(t RefreshToken) string { return t.UserID },
+		func(t RefreshToken) string { return t.ID },
+		&report.RefreshTokens, &report.Skipped)
+
+	if err != nil || dryRun {
+		return report, err
+	}
+
+	return report, DBConn.Create(&report).Error
+}
+
+// CheckShardBackfill fails while the primary has mood records or refresh tokens that no backfill moved,
+// they are read from the shards only, so their users would lose them
+func CheckShardBackfill() error {
+	var finished int64
+	if err := DBConn.Model(&BackfillReport{}).Count(&finished).Error; err != nil {
+		return err
+	}
+
+	if finished > 0 {
+		return nil
+	}
+
+	for _, model := range []interface{}{&MoodScore{}, &RefreshToken{}} {
+		var left int64
+		if err := DBConn.Model(model).Count(&left).Error; err != nil {
+			return err
+		}
+
+		if left > 0 {
+			return ErrBackfillPending
+		}
+	}
+
+	return nil
+}
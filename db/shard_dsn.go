@@ -0,0 +1,112 @@
+package db
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Shard maps are stored in the primary, so their DSNs carry no password. The password, or the whole DSN,
+// comes from the env var the shard names in passwordEnv or dsnEnv
+
+// connString returns the DSN of the shard with its credentials
+func (s ShardSpec) connString() (string, error) {
+	dsn := s.DSN
+
+	if s.DSNEnv != "" {
+		dsn = lookupCredential(s.DSNEnv)
+		if dsn == "" {
+			return "", fmt.Errorf("shard %s: %s is not set", s.Name, s.DSNEnv)
+		}
+	}
+
+	if s.PasswordEnv != "" {
+		password := lookupCredential(s.PasswordEnv)
+		if password == "" {
+			return "", fmt.Errorf("shard %s: %s is not set", s.Name, s.PasswordEnv)
+		}
+
+		return withPassword(dsn, password)
+	}
+
+	return dsn, nil
+}
+
+// lookupCredential reads the env var, or the setting it overrides when that came from the config file
+func lookupCredential(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	if name == "DB_PASSWORD" {
+		return settings.Password
+	}
+
+	var n int
+	if _, err := fmt.Sscanf(name, "POSTGRES_PROD_SHARD_%d_URL", &n); err == nil && n >= 1 && n <= len(settings.ProdShardURLs) {
+		return settings.ProdShardURLs[n-1]
+	}
+
+	return ""
+}
+
+func isURLDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// withPassword adds the password to a URL or key=value DSN
+func withPassword(dsn string, password string) (string, error) {
+	if !isURLDSN(dsn) {
+		escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(password)
+		return dsn + " password='" + escaped + "'", nil
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+
+	u.User = url.UserPassword(u.User.Username(), password)
+
+	return u.String(), nil
+}
+
+// dsnHasPassword reports a password written into the DSN itself
+func dsnHasPassword(dsn string) bool {
+	if !isURLDSN(dsn) {
+		return strings.Contains(dsn, "password=")
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return false
+	}
+
+	_, ok := u.User.Password()
+
+	return ok || u.Query().Has("password")
+}
+
+// checkStorable refuses a shard map with passwords in its DSNs before it is stored in the primary
+func checkStorable(shardMap ShardMap) error {
+	for _, shard := range shardMap.Shards {
+		if dsnHasPassword(shard.DSN) {
+			return fmt.Errorf("shard %s has a password in its dsn, move it to an env var named by passwordEnv or dsnEnv", shard.Name)
+		}
+	}
+
+	return nil
+}
+
+// warnStoredPasswords reports a stored shard map written before passwords were kept out of it
+func warnStoredPasswords(shardMap ShardMap) {
+	if !shardMap.Active {
+		return
+	}
+
+	if err := checkStorable(shardMap); err != nil {
+		slog.Warn("Active shard map stores a password, reshard to a map without it", "version", shardMap.Version, "error", err)
+	}
+}
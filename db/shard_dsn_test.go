@@ -0,0 +1,64 @@
+package db
+
+import "testing"
+
+func TestShardCredentialsComeFromEnv(t *testing.T) {
+	t.Setenv("SHARD_TEST_PASSWORD", "p@ss'word")
+	t.Setenv("SHARD_TEST_URL", "postgres://app:secret@db/shard9")
+
+	cases := []struct {
+		name     string
+		spec     ShardSpec
+		expected string
+	}{
+		{"url with password env", ShardSpec{DSN: "postgres://app@db/shard1?sslmode=disable", PasswordEnv: "SHARD_TEST_PASSWORD"}, "postgres://app:p%40ss%27word@db/shard1?sslmode=disable"},
+		{"key value with password env", ShardSpec{DSN: "host=db user=app dbname=shard1", PasswordEnv: "SHARD_TEST_PASSWORD"}, `host=db user=app dbname=shard1 password='p@ss\'word'`},
+		{"dsn env", ShardSpec{DSNEnv: "SHARD_TEST_URL"}, "postgres://app:secret@db/shard9"},
+		{"no credentials", ShardSpec{DSN: "postgres://app@db/shard1"}, "postgres://app@db/shard1"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dsn, err := tc.spec.connString()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dsn != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, dsn)
+			}
+			if err := checkStorable(ShardMap{Shards: []ShardSpec{tc.spec}}); err != nil {
+				t.Errorf("expected the spec to be storable, got %v", err)
+			}
+		})
+	}
+
+	if _, err := (ShardSpec{Name: "shard-0", DSNEnv: "SHARD_TEST_UNSET"}).connString(); err == nil {
+		t.Error("expected an error for an unset dsnEnv")
+	}
+}
+
+func TestShardMapWithPasswordIsNotStorable(t *testing.T) {
+	for _, dsn := range []string{
+		"postgres://app:secret@db/shard1",
+		"postgres://app@db/shard1?password=secret",
+		"host=db user=app password=secret",
+	} {
+		if err := checkStorable(ShardMap{Shards: []ShardSpec{{Name: "shard-0", DSN: dsn}}}); err == nil {
+			t.Errorf("expected %s to be rejected", dsn)
+		}
+	}
+}
+
+func TestValidateShardMapNeedsOneDSNSource(t *testing.T) {
+	t.Setenv("SHARD_TEST_URL", "postgres://app@db/shard9")
+
+	shardMap := ShardMap{Placement: PlacementRing, Shards: []ShardSpec{{Name: "shard-0", DSN: "postgres://app@db/shard1", DSNEnv: "SHARD_TEST_URL", Weight: 1}}}
+	if err := ValidateShardMap(shardMap); err == nil {
+		t.Error("expected a shard with dsn and dsnEnv to be rejected")
+	}
+
+	shardMap.Shards[0].DSN = ""
+	if err := ValidateShardMap(shardMap); err != nil {
+		t.Errorf("expected a shard with dsnEnv to be valid, got %v", err)
+	}
+}
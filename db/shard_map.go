@@ -0,0 +1,586 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/oleksiip-aiola/go-server/tracing"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+var ErrShardReadOnly = errors.New("shard is read-only")
+
+// How often servers check the primary for a newly activated shard map
+var SHARD_MAP_REFRESH_INTERVAL = 10 * time.Second
+
+// Pools dropped by a new shard map are closed after the queries started on the previous one had time to finish
+var SHARD_POOL_CLOSE_GRACE = 30 * time.Second
+
+// How a shard map places users on its shards. Modulo is the placement of the shards configured before the ring,
+// deployments move to the ring with a reshard job, see the README
+const (
+	PlacementRing   = "ring"
+	PlacementModulo = "modulo"
+)
+
+// Read-only shards keep serving reads but reject shard writes, e.g. during maintenance.
+// The map is stored in the primary, so credentials are referenced by env var: DSNEnv names the var
+// holding the whole DSN, PasswordEnv the one holding the password added to DSN
+type ShardSpec struct {
+	Name        string `json:"name"`
+	DSN         string `json:"dsn,omitempty"`
+	DSNEnv      string `json:"dsnEnv,omitempty"`
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+	Weight      int    `json:"weight"`
+	ReadOnly    bool   `json:"readOnly"`
+}
+
+// Row of shard_map, the active row is the layout every server routes with
+type ShardMap struct {
+	Version   int         `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Placement string      `json:"placement"` // PlacementRing or PlacementModulo
+	Shards    []ShardSpec `gorm:"serializer:json" json:"shards"`
+	Active    bool        `json:"active"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+func (m *ShardMap) TableName() string {
+	return "shard_map"
+}
+
+// Connections and ring built from a shard map, replaced as a whole when the map changes
+type shardTopology struct {
+	version     int
+	placement   string
+	shards      []ShardSpec
+	dsns        []string // resolved with credentials, never stored
+	conns       []*gorm.DB
+	ring        *HashRing // nil with the modulo placement
+	indexByName map[string]int
+
+	// Layout a reshard moves users to while its fence is active, without connections.
+	// Writes of the users it places on another shard are rejected until the flip
+	moving *shardTopology
+}
+
+var topologyMu sync.RWMutex
+var topology *shardTopology
+
+func currentTopology() *shardTopology {
+	topologyMu.RLock()
+	defer topologyMu.RUnlock()
+
+	return topology
+}
+
+func setTopology(t *shardTopology) {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+
+	topology = t
+}
+
+// Shard index of the user in this topology
+func (t *shardTopology) shardFor(userID string) (int, error) {
+	if t.placement == PlacementModulo {
+		return moduloShard(userID, len(t.shards))
+	}
+
+	name, err := t.ring.GetUserNode(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.indexByName[name], nil
+}
+
+func shardVirtualNodes() (int, error) {
+	if settings.ShardVirtualNodes == 0 {
+		return DEFAULT_VIRTUAL_NODES, nil
+	}
+
+	if settings.ShardVirtualNodes < 1 {
+		return 0, fmt.Errorf("invalid number of virtual nodes %d", settings.ShardVirtualNodes)
+	}
+
+	return settings.ShardVirtualNodes, nil
+}
+
+// NewShardRing places the shards of the map on a consistent-hash ring
+func NewShardRing(shardMap ShardMap) (*HashRing, error) {
+	virtualNodes, err := shardVirtualNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	ring := NewHashRing(virtualNodes)
+
+	for _, shard := range shardMap.Shards {
+		if err := ring.AddNode(shard.Name, shard.Weight); err != nil {
+			return nil, err
+		}
+	}
+
+	return ring, nil
+}
+
+func openShardDB(name string, dsn string) (*gorm.DB, error) {
+	conn, err := gorm.Open(postgres.Open(dsn), gormConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Use(tracing.GormPlugin(name)); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// newShardPlacement places users on the shards of the map without connecting to them
+func newShardPlacement(shardMap ShardMap) (*shardTopology, error) {
+	if err := ValidateShardMap(shardMap); err != nil {
+		return nil, err
+	}
+
+	t := &shardTopology{
+		version:     shardMap.Version,
+		placement:   shardMap.Placement,
+		shards:      shardMap.Shards,
+		indexByName: make(map[string]int),
+	}
+
+	if shardMap.Placement == PlacementRing {
+		ring, err := NewShardRing(shardMap)
+		if err != nil {
+			return nil, err
+		}
+		t.ring = ring
+	}
+
+	for i, shard := range shardMap.Shards {
+		t.indexByName[shard.Name] = i
+	}
+
+	return t, nil
+}
+
+// newShardTopology connects to the shards of the map, reusing the connections of the previous topology
+func newShardTopology(shardMap ShardMap, previous *shardTopology) (*shardTopology, error) {
+	t, err := newShardPlacement(shardMap)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, shard := range shardMap.Shards {
+		dsn, err := shard.connString()
+		if err != nil {
+			t.closeConnsNotIn(previous)
+			return nil, err
+		}
+
+		var conn *gorm.DB
+		if previous != nil {
+			if j, ok := previous.indexByName[shard.Name]; ok && previous.dsns[j] == dsn {
+				conn = previous.conns[j]
+			}
+		}
+
+		if conn == nil {
+			conn, err = openShardDB(shard.Name, dsn)
+			if err != nil {
+				t.closeConnsNotIn(previous)
+				return nil, fmt.Errorf("failed to connect to shard %s: %w", shard.Name, err)
+			}
+		}
+
+		t.dsns = append(t.dsns, dsn)
+		t.conns = append(t.conns, conn)
+	}
+
+	return t, nil
+}
+
+// fenced reports whether the user on the given shard is moved by the reshard fencing this topology
+func (t *shardTopology) fenced(userID string, shardID int) (bool, error) {
+	if t.moving == nil {
+		return false, nil
+	}
+
+	target, err := t.moving.shardFor(userID)
+	if err != nil {
+		return false, err
+	}
+
+	return t.moving.shards[target].Name != t.shards[shardID].Name, nil
+}
+
+// fenceTarget returns the placement of the layout the reshard fenced by the shard map moves users to,
+// nil when the map is no fence
+func fenceTarget(shardMap ShardMap) (*shardTopology, error) {
+	if shardMap.Version == 0 {
+		return nil, nil
+	}
+
+	var job ReshardJob
+	result := DBConn.Where("fence_version = ?", shardMap.Version).Limit(1).Find(&job)
+
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+
+	target, err := getShardMap(job.ToVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	return newShardPlacement(target)
+}
+
+// closeConnsNotIn closes the pools of t that none of the other topologies use
+func (t *shardTopology) closeConnsNotIn(others ...*shardTopology) {
+	for i, conn := range t.conns {
+		shared := slices.ContainsFunc(others, func(other *shardTopology) bool {
+			return other != nil && slices.Contains(other.conns, conn)
+		})
+
+		if shared {
+			continue
+		}
+
+		if sqlDB, err := conn.DB(); err == nil {
+			if err := sqlDB.Close(); err != nil {
+				slog.Warn("Failed to close shard connection", "shard", t.shards[i].Name, "error", err)
+			}
+		}
+	}
+}
+
+// ReadShardMapFile reads {"shards": [{"name": "shard-0", "dsn": "postgres://...", "passwordEnv": "SHARD_0_PASSWORD", "weight": 1, "readOnly": false}]}
+func ReadShardMapFile(path string) (ShardMap, error) {
+	var shardMap ShardMap
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return shardMap, err
+	}
+
+	if err := json.Unmarshal(content, &shardMap); err != nil {
+		return shardMap, fmt.Errorf("invalid shard map %s: %w", path, err)
+	}
+
+	shardMap.Version = 0
+	shardMap.Active = false
+
+	if shardMap.Placement == "" {
+		shardMap.Placement = PlacementRing
+	}
+
+	return shardMap, nil
+}
+
+// configuredShardMap is the layout used until a shard map is stored in the primary: the shard map
+// file, otherwise the production shard URLs when the production database is used or the local shard
+// databases (default "shard1,shard2"). Weights of the latter come from the shard weights (e.g. "1,2"),
+// their placement from the shard placement setting, modulo unless the deployment started on the ring
+func configuredShardMap() (ShardMap, error) {
+	if settings.ShardMapFile != "" {
+		return ReadShardMapFile(settings.ShardMapFile)
+	}
+
+	var specs []ShardSpec
+
+	if settings.ProdURL != "" {
+		for i := range settings.ProdShardURLs {
+			specs = append(specs, ShardSpec{DSNEnv: fmt.Sprintf("POSTGRES_PROD_SHARD_%d_URL", i+1)})
+		}
+	} else {
+		for _, name := range settings.Shards {
+			dsn := fmt.Sprintf("postgres://%s@%s/%s?sslmode=disable", url.User(settings.User), settings.Host, name)
+			spec := ShardSpec{DSN: dsn}
+			if settings.Password != "" {
+				spec.PasswordEnv = "DB_PASSWORD"
+			}
+			specs = append(specs, spec)
+		}
+	}
+
+	if len(settings.ShardWeights) > 0 && len(settings.ShardWeights) != len(specs) {
+		return ShardMap{}, fmt.Errorf("SHARD_WEIGHTS has %d entries for %d shards", len(settings.ShardWeights), len(specs))
+	}
+
+	shardMap := ShardMap{Placement: settings.ShardPlacement}
+	if shardMap.Placement == "" {
+		shardMap.Placement = PlacementModulo
+	}
+
+	for i, spec := range specs {
+		spec.Name = fmt.Sprintf("shard-%d", i)
+		spec.Weight = 1
+
+		if len(settings.ShardWeights) > 0 {
+			spec.Weight = settings.ShardWeights[i]
+		}
+
+		shardMap.Shards = append(shardMap.Shards, spec)
+	}
+
+	return shardMap, nil
+}
+
+// ValidateShardMap checks the placement, that shard names are unique and every shard has a DSN, with its
+// credentials set, and a positive weight
+func ValidateShardMap(shardMap ShardMap) error {
+	if len(shardMap.Shards) == 0 {
+		return errors.New("shard map has no shards")
+	}
+
+	if shardMap.Placement != PlacementRing && shardMap.Placement != PlacementModulo {
+		return fmt.Errorf("unknown shard placement %q", shardMap.Placement)
+	}
+
+	names := make(map[string]bool)
+
+	for i, shard := range shardMap.Shards {
+		if shard.Name == "" {
+			return fmt.Errorf("shard %d has no name", i)
+		}
+		if names[shard.Name] {
+			return fmt.Errorf("shard %s is listed twice", shard.Name)
+		}
+		names[shard.Name] = true
+
+		if (shard.DSN == "") == (shard.DSNEnv == "") {
+			return fmt.Errorf("shard %s needs either a dsn or a dsnEnv", shard.Name)
+		}
+		dsn, err := shard.connString()
+		if err != nil {
+			return err
+		}
+		if _, err := pgconn.ParseConfig(dsn); err != nil {
+			return fmt.Errorf("shard %s has an invalid dsn", shard.Name)
+		}
+		if shard.Weight < 1 {
+			return fmt.Errorf("weight of shard %s must be at least 1", shard.Name)
+		}
+		if shard.Weight != 1 && shardMap.Placement == PlacementModulo {
+			return fmt.Errorf("shard %s has weight %d, weights need the ring placement", shard.Name, shard.Weight)
+		}
+	}
+
+	return nil
+}
+
+// GetActiveShardMap returns the shard map stored in the primary, or the default one when none was activated yet
+func GetActiveShardMap() (ShardMap, error) {
+	if !DBConn.Migrator().HasTable(&ShardMap{}) {
+		return configuredShardMap()
+	}
+
+	var shardMap ShardMap
+	result := DBConn.Where("active = ?", true).Limit(1).Find(&shardMap)
+
+	if result.Error != nil {
+		return ShardMap{}, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return configuredShardMap()
+	}
+
+	return shardMap, nil
+}
+
+func connectShards() error {
+	shardMap, err := GetActiveShardMap()
+	if err != nil {
+		return err
+	}
+
+	moving, err := fenceTarget(shardMap)
+	if err != nil {
+		return err
+	}
+
+	t, err := newShardTopology(shardMap, nil)
+	if err != nil {
+		return err
+	}
+
+	t.moving = moving
+	setTopology(t)
+	warnStoredPasswords(shardMap)
+
+	for _, shard := range t.shards {
+		mode := "read-write"
+		if shard.ReadOnly {
+			mode = "read-only"
+		}
+		slog.Info("Shard connected", "shard", shard.Name, "weight", shard.Weight, "mode", mode)
+	}
+
+	return nil
+}
+
+// RefreshShardTopology switches routing to the active shard map when its version changed
+func RefreshShardTopology() error {
+	shardMap, err := GetActiveShardMap()
+	if err != nil {
+		return err
+	}
+
+	previous := currentTopology()
+	if previous != nil && previous.version == shardMap.Version {
+		return nil
+	}
+
+	moving, err := fenceTarget(shardMap)
+	if err != nil {
+		return err
+	}
+
+	t, err := newShardTopology(shardMap, previous)
+	if err != nil {
+		return err
+	}
+
+	t.moving = moving
+	setTopology(t)
+	slog.Info("Switched shard map", "version", shardMap.Version, "fenced", moving != nil)
+	warnStoredPasswords(shardMap)
+
+	if previous != nil {
+		retireTopology(previous)
+	}
+
+	return nil
+}
+
+// Replaced topologies whose pools are closed after SHARD_POOL_CLOSE_GRACE, or by closePools at shutdown
+var retiringMu sync.Mutex
+var retiring = map[*shardTopology]*time.Timer{}
+
+func retireTopology(previous *shardTopology) {
+	retiringMu.Lock()
+	defer retiringMu.Unlock()
+
+	retiring[previous] = time.AfterFunc(SHARD_POOL_CLOSE_GRACE, func() {
+		retiringMu.Lock()
+		_, pending := retiring[previous]
+		delete(retiring, previous)
+
+		// Pools a more recently replaced topology still has stay open for its grace period
+		keep := []*shardTopology{currentTopology()}
+		for other := range retiring {
+			keep = append(keep, other)
+		}
+		retiringMu.Unlock()
+
+		// Already closed by closePools otherwise
+		if pending {
+			previous.closeConnsNotIn(keep...)
+		}
+	})
+}
+
+// closeRetiredTopologies closes the pools of every replaced topology right away, except those of current
+func closeRetiredTopologies(current *shardTopology) {
+	retiringMu.Lock()
+	retired := []*shardTopology{}
+	for previous, timer := range retiring {
+		timer.Stop()
+		retired = append(retired, previous)
+	}
+	clear(retiring)
+	retiringMu.Unlock()
+
+	for i, previous := range retired {
+		// Each pool once, whichever topologies share it
+		previous.closeConnsNotIn(append([]*shardTopology{current}, retired[:i]...)...)
+	}
+}
+
+func startShardMapRefresh(ctx context.Context, interval time.Duration) {
+	runInBackground(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := RefreshShardTopology(); err != nil {
+				slog.Error("Failed to refresh shard map", "error", err)
+			}
+		}
+	})
+}
+
+type ShardStatus struct {
+	Name      string `json:"name"`
+	Weight    int    `json:"weight"`
+	ReadOnly  bool   `json:"readOnly"`
+	Healthy   bool   `json:"healthy"`
+	LatencyMs int64  `json:"latencyMs"`
+	Users     int64  `json:"users"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ShardMapStatus struct {
+	Version int           `json:"version"`
+	Shards  []ShardStatus `json:"shards"`
+}
+
+// GetShardStatuses pings every shard of the current layout and counts its users, shards are checked concurrently
+func GetShardStatuses(ctx context.Context) ShardMapStatus {
+	t := currentTopology()
+	status := ShardMapStatus{Version: t.version, Shards: make([]ShardStatus, len(t.shards))}
+
+	var wg sync.WaitGroup
+
+	for i, shard := range t.shards {
+		wg.Add(1)
+
+		go func(i int, shard ShardSpec) {
+			defer wg.Done()
+
+			shardStatus := ShardStatus{Name: shard.Name, Weight: shard.Weight, ReadOnly: shard.ReadOnly}
+			start := time.Now()
+
+			sqlDB, err := t.conns[i].DB()
+			if err == nil {
+				err = sqlDB.PingContext(ctx)
+			}
+			shardStatus.LatencyMs = time.Since(start).Milliseconds()
+
+			if err == nil {
+				err = t.conns[i].WithContext(ctx).Model(&User{}).Count(&shardStatus.Users).Error
+			}
+
+			if err != nil {
+				shardStatus.Error = err.Error()
+			} else {
+				shardStatus.Healthy = true
+			}
+
+			status.Shards[i] = shardStatus
+		}(i, shard)
+	}
+
+	wg.Wait()
+
+	return status
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestFenceOnlyRejectsMovedUsers(t *testing.T) {
+	spec := func(name string) ShardSpec {
+		return ShardSpec{Name: name, DSN: "postgres://app@db/" + name, Weight: 1}
+	}
+
+	from, err := newShardPlacement(ShardMap{Version: 2, Placement: PlacementRing, Shards: []ShardSpec{spec("shard-0"), spec("shard-1")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to, err := newShardPlacement(ShardMap{Version: 3, Placement: PlacementRing, Shards: []ShardSpec{spec("shard-0"), spec("shard-1"), spec("shard-2")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fencedUsers, writableUsers := 0, 0
+
+	for range 500 {
+		userID := uuid.New().String()
+
+		shardID, err := from.shardFor(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fenced, _ := from.fenced(userID, shardID); fenced {
+			t.Fatalf("expected no user to be fenced without a reshard, got %s", userID)
+		}
+
+		from.moving = to
+		fenced, err := from.fenced(userID, shardID)
+		from.moving = nil
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		target, _ := to.shardFor(userID)
+		moves := to.shards[target].Name != from.shards[shardID].Name
+
+		if fenced != moves {
+			t.Errorf("user %s on %s moving to %s: expected fenced %v, got %v", userID, from.shards[shardID].Name, to.shards[target].Name, moves, fenced)
+		}
+
+		if fenced {
+			fencedUsers++
+		} else {
+			writableUsers++
+		}
+	}
+
+	// Adding a third shard moves about a third of the users, the others keep writing
+	if fencedUsers == 0 || writableUsers < fencedUsers {
+		t.Errorf("expected a minority of the users to be fenced, got %d fenced and %d writable", fencedUsers, writableUsers)
+	}
+}
+
+func TestShutdownClosesRetiredPools(t *testing.T) {
+	open := func() *gorm.DB {
+		conn, err := gorm.Open(postgres.Open("postgres://app@localhost/test"), &gorm.Config{DisableAutomaticPing: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	closed := func(conn *gorm.DB) bool {
+		sqlDB, _ := conn.DB()
+		err := sqlDB.Ping()
+		return err != nil && strings.Contains(err.Error(), "database is closed")
+	}
+
+	dropped, kept := open(), open()
+	previous := &shardTopology{shards: []ShardSpec{{Name: "shard-0"}, {Name: "shard-1"}}, conns: []*gorm.DB{dropped, kept}}
+	current := &shardTopology{shards: []ShardSpec{{Name: "shard-1"}}, conns: []*gorm.DB{kept}}
+
+	grace := SHARD_POOL_CLOSE_GRACE
+	SHARD_POOL_CLOSE_GRACE = time.Hour
+	t.Cleanup(func() { SHARD_POOL_CLOSE_GRACE = grace })
+
+	retireTopology(previous)
+	closeRetiredTopologies(current)
+
+	if !closed(dropped) {
+		t.Error("expected the pool dropped by the new shard map to be closed at shutdown")
+	}
+	if closed(kept) {
+		t.Error("expected the pool of the current shard map to be left to closePools")
+	}
+	if len(retiring) != 0 {
+		t.Errorf("expected no pool left to close, got %d topologies", len(retiring))
+	}
+}
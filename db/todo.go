@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Todo timestamps are set by the database, see migration 0008, and returned on create
+type Todo struct {
+	ID        int       `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserId    string    `gorm:"type:uuid;index;not null" json:"userId"`
+	Title     string    `json:"title"`
+	Done      bool      `gorm:"default:false" json:"done"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `gorm:"<-:false;default:now()" json:"createdAt"`
+	UpdatedAt time.Time `gorm:"<-:false;default:now()" json:"updatedAt"`
+}
+
+func (t *Todo) TableName() string {
+	return "todos"
+}
+
+func GetTodos(ctx context.Context, userId string) ([]Todo, error) {
+	todos := []Todo{}
+
+	if err := DBConn.WithContext(ctx).Where("user_id = ?", userId).Order("id ASC").Find(&todos).Error; err != nil {
+		return nil, err
+	}
+
+	return todos, nil
+}
+
+func CreateTodo(ctx context.Context, userId string, title string, body string, done bool) (Todo, error) {
+	todo := Todo{
+		UserId: userId,
+		Title:  title,
+		Body:   body,
+		Done:   done,
+	}
+
+	if err := DBConn.WithContext(ctx).Create(&todo).Error; err != nil {
+		return Todo{}, err
+	}
+
+	return todo, nil
+}
+
+// Todos of other users are reported as not found by the functions below
+func UpdateTodo(ctx context.Context, userId string, id int, title string, body string, done bool) error {
+	result := DBConn.WithContext(ctx).Model(&Todo{}).Where("id = ? AND user_id = ?", id, userId).Updates(map[string]interface{}{
+		"title": title,
+		"body":  body,
+		"done":  done,
+	})
+
+	return checkTodoResult(result)
+}
+
+func ToggleTodoStatus(ctx context.Context, userId string, id int) error {
+	result := DBConn.WithContext(ctx).Model(&Todo{}).Where("id = ? AND user_id = ?", id, userId).Update("done", gorm.Expr("NOT done"))
+
+	return checkTodoResult(result)
+}
+
+func DeleteTodo(ctx context.Context, userId string, id int) error {
+	result := DBConn.WithContext(ctx).Where("id = ? AND user_id = ?", id, userId).Delete(&Todo{})
+
+	return checkTodoResult(result)
+}
+
+func checkTodoResult(result *gorm.DB) error {
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
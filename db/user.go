@@ -1,13 +1,16 @@
 package db
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"connectrpc.com/connect"
 	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/oleksiip-aiola/go-server/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
@@ -22,14 +25,16 @@ type User struct {
 	CreatedAt *time.Time `json:"createdAt"`
 	UpdatedAt time.Time  `json:"updatedAt"`
 
-	// WebAuthn-specific fields
-	CredentialID        []byte `gorm:"type:bytea" json:"credentialID"`        // WebAuthn Credential ID
-	PublicKey           []byte `gorm:"type:bytea" json:"publicKey"`           // Public Key used for authentication
-	AuthenticatorAAGUID []byte `gorm:"type:bytea" json:"authenticatorAAGUID"` // Authenticator AAGUID
-	SignCount           uint32 `json:"signCount"`                             // Sign counter to prevent replay attacks
+	// WebAuthn credentials, stored in webauthn_credentials and loaded with LoadWebAuthnCredentials
+	Credentials []WebAuthnCredential `gorm:"-" json:"-"`
 }
 
-func (u *User) CreateAdmin(email string, password string, firstName string, lastName string) (string, error) {
+// LogValue keeps the password hash and credentials out of the logs when a user is logged
+func (u User) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("user_id", u.UserId), slog.String("email", u.Email))
+}
+
+func (u *User) CreateAdmin(ctx context.Context, email string, password string, firstName string, lastName string) (string, error) {
 	user := User{
 		Email:     email,
 		Password:  password,
@@ -38,45 +43,104 @@ func (u *User) CreateAdmin(email string, password string, firstName string, last
 		IsAdmin:   true,
 	}
 
+	// Cost 14 is slow on purpose, the span shows how slow next to the queries
+	_, span := tracing.Tracer().Start(ctx, "bcrypt.GenerateFromPassword", trace.WithAttributes(attribute.Int("bcrypt.cost", 14)))
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 14)
+	span.End()
 
 	if err != nil {
 		return "", errors.New("failed to hash password")
 	}
 
 	user.Password = string(hashedPassword)
-	fmt.Println(user)
-	if err := DBConn.Create(&user).Error; err != nil {
+
+	err = DBConn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+
+		if err := assignRoleInTx(tx, user.UserId, RoleUser); err != nil {
+			return err
+		}
+
+		return QueueShardWrite(tx, user)
+	})
+
+	if err != nil {
 		return "", err
 	}
 
-	QueueShardWrite(user)
+	NotifyShardWorker()
 
 	return user.UserId, nil
 }
 
-func (u *User) CreateWebAuthnAdmin(webAuthnUser *User) (string, error) {
+func (u *User) CreateWebAuthnAdmin(ctx context.Context, webAuthnUser *User, credential WebAuthnCredential) (string, error) {
 	webAuthnUser.IsAdmin = true
-	// fmt.Println(webAuthnUser, &webAuthnUser)
 
-	if err := DBConn.Create(&webAuthnUser).Error; err != nil {
+	err := DBConn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(webAuthnUser).Error; err != nil {
+			return err
+		}
+
+		credential.UserId = webAuthnUser.UserId
+
+		if err := tx.Create(&credential).Error; err != nil {
+			return err
+		}
+
+		if err := assignRoleInTx(tx, webAuthnUser.UserId, RoleUser); err != nil {
+			return err
+		}
+
+		return QueueShardWrite(tx, *webAuthnUser)
+	})
+
+	if err != nil {
 		return "", err
 	}
 
-	QueueShardWrite(*webAuthnUser)
+	webAuthnUser.Credentials = []WebAuthnCredential{credential}
+
+	NotifyShardWorker()
 
 	return webAuthnUser.UserId, nil
 }
 
-func (u *User) LoginAsAdmin(email string, password string) (*User, error) {
+// Hash compared against when the email is unknown, at the cost of real passwords. Generated by InitDB,
+// so the first failed login does not pay for it and take longer than the ones after
+var unknownUserHash []byte
 
-	if err := DBConn.Where("email = ? AND is_admin = ?", email, true).First(&u).Error; err != nil {
-		fmt.Println(err)
+func generateUnknownUserHash() error {
+	hash, err := bcrypt.GenerateFromPassword([]byte("unknown user"), 14)
+	if err != nil {
+		return err
+	}
+
+	unknownUserHash = hash
+
+	return nil
+}
+
+func (u *User) LoginAsAdmin(ctx context.Context, email string, password string) (*User, error) {
+	if err := DBConn.WithContext(ctx).Where("email = ? AND is_admin = ?", email, true).First(&u).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+
+		// Same bcrypt work as for a known email, the response time does not tell whether the account exists
+		bcrypt.CompareHashAndPassword(unknownUserHash, []byte(password))
+
+		slog.Warn("Admin login failed", "error", err)
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("user not found"))
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
-		fmt.Println(err)
+	_, span := tracing.Tracer().Start(ctx, "bcrypt.CompareHashAndPassword")
+	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	span.End()
+
+	if err != nil {
+		slog.Warn("Admin login failed", "user_id", u.UserId, "error", err)
 
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("password is incorrect"))
 	}
@@ -84,81 +148,164 @@ func (u *User) LoginAsAdmin(email string, password string) (*User, error) {
 	return u, nil
 }
 
-func (u *User) LoginAsWebAuthAdmin(userId string) (*User, error) {
-	if err := DBConn.Where("user_id = ? AND is_admin = ?", userId, true).First(&u).Error; err != nil {
-		fmt.Println(err)
+func (u *User) LoginAsWebAuthAdmin(ctx context.Context, userId string) (*User, error) {
+	if err := DBConn.WithContext(ctx).Where("user_id = ? AND is_admin = ?", userId, true).First(&u).Error; err != nil {
+		slog.Warn("WebAuthn admin login failed", "user_id", userId, "error", err)
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("user not found"))
 	}
 
 	return u, nil
 }
 
-func RevokeJWTByUserId(userId string) error {
+func GetUserByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+
+	if err := DBConn.WithContext(ctx).Where("email = ?", email).First(&user).Error; err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func RevokeJWTByUserId(ctx context.Context, userId string) error {
+	shardDB, err := getWritableShardByUserID(ctx, userId)
+	if err != nil {
+		return err
+	}
 
-	err := DBConn.Model(&RefreshToken{}).Where("user_id = ?", userId).Update("is_revoked", true).Error
+	err = shardDB.Model(&RefreshToken{}).Where("user_id = ?", userId).Update("is_revoked", true).Error
 
 	if err != nil {
-		fmt.Println(err)
-		log.Fatal(err)
+		slog.Error("Failed to revoke refresh tokens", "user_id", userId, "error", err)
 		return err
 	}
 
-	fmt.Println("Revoked JWT for user ID:", userId)
+	slog.Info("Revoked refresh tokens", "user_id", userId)
 
 	return nil
 }
 
-func GetUserById(id string) (User, error) {
-	user, err := ReadFromShard(id)
+// Stored on the primary, so a logout works while the shard of the user is read-only
+type AccessTokenVersion struct {
+	UserId    string    `gorm:"primaryKey"`
+	Version   int       `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"<-:false;default:now()"`
+}
+
+func (v *AccessTokenVersion) TableName() string {
+	return "access_token_versions"
+}
+
+// GetAccessTokenVersion returns the version access tokens of the user need, 0 until the first revocation
+func GetAccessTokenVersion(ctx context.Context, userId string) (int, error) {
+	var version AccessTokenVersion
+	result := DBConn.WithContext(ctx).Where("user_id = ?", userId).Limit(1).Find(&version)
+
+	return version.Version, result.Error
+}
+
+// RevokeAccessTokens increments the version of the user, access tokens issued before are rejected
+func RevokeAccessTokens(ctx context.Context, userId string) error {
+	return DBConn.WithContext(ctx).Exec(`INSERT INTO access_token_versions (user_id, version) VALUES (?, 1)
+		ON CONFLICT (user_id) DO UPDATE SET version = access_token_versions.version + 1, updated_at = NOW()`, userId).Error
+}
+
+func GetUserById(ctx context.Context, id string) (User, error) {
+	user, err := ReadFromShard(ctx, id)
 
 	return user, err
 }
 
+// Refresh tokens are stored on the shard of their user
 type RefreshToken struct {
 	ID          string `gorm:"type:uuid;default:uuid_generate_v4()" json:"id"`
 	UserID      string `json:"userID"`
-	JTI         string `json:"jti"`
+	JTI         string `gorm:"index" json:"jti"`
+	FamilyID    string `gorm:"index" json:"familyID"` // Shared by all tokens rotated from the same login
+	ReplacedBy  string `json:"replacedBy"`            // JTI of the token this one was rotated into
 	AccessToken string `json:"accessToken"`
 	Expiry      string `json:"expiry"`
 	IsRevoked   bool   `json:"isRevoked"`
 }
 
-func StoreJTI(jti string, userID string, refreshTokenExp string, accessToken string) error {
+var ErrRefreshTokenRotated = errors.New("refresh token was already rotated")
+
+func StoreJTI(ctx context.Context, jti string, userID string, familyID string, refreshTokenExp string, accessToken string) error {
 	refreshToken := RefreshToken{
 		UserID:      userID,
 		JTI:         jti,
+		FamilyID:    familyID,
 		Expiry:      refreshTokenExp,
 		IsRevoked:   false,
 		AccessToken: accessToken,
 	}
 
-	if err := DBConn.Table("refresh_tokens").Create(&refreshToken).Error; err != nil {
-		log.Fatal(err)
+	shardDB, err := getWritableShardByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := shardDB.Table("refresh_tokens").Create(&refreshToken).Error; err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func CheckIfRefreshTokenIsRevokedByUserId(userId string) (string, error) {
+// GetRefreshTokenByJTI looks the token up on the shard of the user it was issued to
+func GetRefreshTokenByJTI(ctx context.Context, userID string, jti string) (RefreshToken, error) {
 	var refreshToken RefreshToken
 
-	err := DBConn.Table("refresh_tokens").Where("user_id = ? AND expiry > NOW()", userId).Order("token_id DESC").Limit(1).Select("is_revoked, jti").Scan(&refreshToken).Error
+	shardDB, _, err := determineShardByUserID(ctx, userID)
+	if err != nil {
+		return RefreshToken{}, err
+	}
 
+	if err := shardDB.Where("jti = ? AND user_id = ?", jti, userID).First(&refreshToken).Error; err != nil {
+		return RefreshToken{}, err
+	}
+
+	return refreshToken, nil
+}
+
+// RotateRefreshToken revokes the token with the given JTI and stores its successor in the same family.
+// Only one caller can rotate a token, a concurrent or repeated rotation gets ErrRefreshTokenRotated
+func RotateRefreshToken(ctx context.Context, oldJTI string, newToken RefreshToken) error {
+	shardDB, err := getWritableShardByUserID(ctx, newToken.UserID)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return "", fmt.Errorf("refresh token is expired or invalid")
-		}
-		return "", err
+		return err
 	}
 
-	isRevoked := refreshToken.IsRevoked
+	return shardDB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&RefreshToken{}).
+			Where("jti = ? AND is_revoked = ?", oldJTI, false).
+			Updates(map[string]interface{}{"is_revoked": true, "replaced_by": newToken.JTI})
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrRefreshTokenRotated
+		}
+
+		return tx.Create(&newToken).Error
+	})
+}
 
-	if isRevoked {
-		return "", fmt.Errorf("refresh token is revoked")
+func RevokeRefreshTokenFamily(ctx context.Context, userID string, familyID string) error {
+	shardDB, err := getWritableShardByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := shardDB.Model(&RefreshToken{}).Where("family_id = ?", familyID).Update("is_revoked", true).Error; err != nil {
+		return err
 	}
 
-	return refreshToken.JTI, nil
+	slog.Info("Revoked refresh token family", "family_id", familyID)
+
+	return nil
 }
 
 // Implement WebAuthn User interface for the User struct
@@ -175,10 +322,11 @@ func (u *User) WebAuthnDisplayName() string {
 }
 
 func (u *User) WebAuthnCredentials() []webauthn.Credential {
-	return []webauthn.Credential{
-		{
-			ID:        u.CredentialID,
-			PublicKey: u.PublicKey,
-		},
+	credentials := make([]webauthn.Credential, len(u.Credentials))
+
+	for i, credential := range u.Credentials {
+		credentials[i] = credential.ToWebAuthn()
 	}
+
+	return credentials
 }
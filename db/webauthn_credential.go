@@ -0,0 +1,164 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+// One row per authenticator registered by a user
+type WebAuthnCredential struct {
+	ID              string     `gorm:"type:uuid;default:uuid_generate_v4()" json:"id"`
+	UserId          string     `gorm:"index" json:"userId"`
+	Name            string     `json:"name"`
+	CredentialID    []byte     `gorm:"type:bytea;uniqueIndex" json:"credentialID"`
+	PublicKey       []byte     `gorm:"type:bytea" json:"-"`
+	AttestationType string     `json:"attestationType"`
+	Transports      []string   `gorm:"serializer:json" json:"transports"`
+	Attachment      string     `json:"attachment"`
+	AAGUID          []byte     `gorm:"type:bytea;column:aaguid" json:"aaguid"`
+	SignCount       uint32     `json:"signCount"`
+	CloneWarning    bool       `json:"cloneWarning"`
+	UserPresent     bool       `json:"userPresent"`
+	UserVerified    bool       `json:"userVerified"`
+	BackupEligible  bool       `json:"backupEligible"`
+	BackupState     bool       `json:"backupState"`
+	LastUsedAt      *time.Time `json:"lastUsedAt"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+}
+
+func (c *WebAuthnCredential) TableName() string {
+	return "webauthn_credentials"
+}
+
+func NewWebAuthnCredential(userId string, name string, credential *webauthn.Credential) WebAuthnCredential {
+	transports := make([]string, len(credential.Transport))
+	for i, transport := range credential.Transport {
+		transports[i] = string(transport)
+	}
+
+	return WebAuthnCredential{
+		UserId:          userId,
+		Name:            name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		Attachment:      string(credential.Authenticator.Attachment),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		CloneWarning:    credential.Authenticator.CloneWarning,
+		UserPresent:     credential.Flags.UserPresent,
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+}
+
+func (c *WebAuthnCredential) ToWebAuthn() webauthn.Credential {
+	transports := make([]protocol.AuthenticatorTransport, len(c.Transports))
+	for i, transport := range c.Transports {
+		transports[i] = protocol.AuthenticatorTransport(transport)
+	}
+
+	return webauthn.Credential{
+		ID:              c.CredentialID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transport:       transports,
+		Flags: webauthn.CredentialFlags{
+			UserPresent:    c.UserPresent,
+			UserVerified:   c.UserVerified,
+			BackupEligible: c.BackupEligible,
+			BackupState:    c.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:       c.AAGUID,
+			SignCount:    c.SignCount,
+			CloneWarning: c.CloneWarning,
+			Attachment:   protocol.AuthenticatorAttachment(c.Attachment),
+		},
+	}
+}
+
+func (u *User) LoadWebAuthnCredentials(ctx context.Context) error {
+	credentials, err := GetWebAuthnCredentials(ctx, u.UserId)
+
+	if err != nil {
+		return err
+	}
+
+	u.Credentials = credentials
+
+	return nil
+}
+
+func GetWebAuthnCredentials(ctx context.Context, userId string) ([]WebAuthnCredential, error) {
+	var credentials []WebAuthnCredential
+
+	if err := DBConn.WithContext(ctx).Where("user_id = ?", userId).Order("created_at ASC").Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func CreateWebAuthnCredential(ctx context.Context, credential *WebAuthnCredential) error {
+	if err := DBConn.WithContext(ctx).Create(credential).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Store sign count and flags reported by the authenticator on a successful login
+func UpdateWebAuthnCredentialUsage(ctx context.Context, credential *webauthn.Credential) error {
+	now := time.Now()
+
+	err := DBConn.WithContext(ctx).Model(&WebAuthnCredential{}).Where("credential_id = ?", credential.ID).Updates(map[string]interface{}{
+		"sign_count":    credential.Authenticator.SignCount,
+		"clone_warning": credential.Authenticator.CloneWarning,
+		"user_present":  credential.Flags.UserPresent,
+		"user_verified": credential.Flags.UserVerified,
+		"backup_state":  credential.Flags.BackupState,
+		"last_used_at":  &now,
+	}).Error
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func RenameWebAuthnCredential(ctx context.Context, userId string, id string, name string) error {
+	result := DBConn.WithContext(ctx).Model(&WebAuthnCredential{}).Where("id = ? AND user_id = ?", id, userId).Update("name", name)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func DeleteWebAuthnCredential(ctx context.Context, userId string, id string) error {
+	result := DBConn.WithContext(ctx).Where("id = ? AND user_id = ?", id, userId).Delete(&WebAuthnCredential{})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
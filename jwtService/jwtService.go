@@ -1,20 +1,36 @@
 package jwtService
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"os"
+	"log/slog"
+	"slices"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/oleksiip-aiola/go-server/config"
 	"github.com/oleksiip-aiola/go-server/db"
+	"github.com/oleksiip-aiola/go-server/tracing"
 	"gorm.io/gorm"
 )
 
+// Service issues, rotates and revokes the tokens of the users in its repositories, the cookies
+// are named and scoped by the configuration. The signing keys are shared, see InitKeyRing
+type Service struct {
+	settings config.Config
+	users    db.UserRepository
+	tokens   db.TokenRepository
+}
+
+func NewService(cfg config.Config, users db.UserRepository, tokens db.TokenRepository) *Service {
+	return &Service{settings: cfg, users: users, tokens: tokens}
+}
+
 // Generate random JTI (JWT ID)
 func generateJTI() (string, error) {
 	b := make([]byte, 32)
@@ -30,14 +46,14 @@ var ACCESS_TOKEN_EXPIRATION = 24 * time.Hour
 var REFRESH_TOKEN_EXPIRATION = 7 * ACCESS_TOKEN_EXPIRATION
 var ACCESS_TOKEN_EXPIRATION_DEVELOPMENT = REFRESH_TOKEN_EXPIRATION
 
-func isDevelopment() bool {
-	return os.Getenv("ENV") == "development"
+func (s *Service) isDevelopment() bool {
+	return s.settings.Env == "development"
 }
 
-// Store JTI in HTTP-only cookie
-func SetRefreshCookie(c *fiber.Ctx, jti string) {
-	publicUrl := os.Getenv("PUBLIC_URL")
-	publicDomain := os.Getenv("PUBLIC_DOMAIN")
+// Store refresh token in HTTP-only cookie
+func (s *Service) SetRefreshCookie(c *fiber.Ctx, refreshToken string) {
+	publicUrl := s.settings.PublicURL
+	publicDomain := s.settings.PublicDomain
 
 	sameSite := "Lax"
 	secure := false
@@ -49,8 +65,8 @@ func SetRefreshCookie(c *fiber.Ctx, jti string) {
 	}
 
 	c.Cookie(&fiber.Cookie{
-		Name:     os.Getenv("JTI_COOKIE_NAME"),             // Name of the cookie to store JTI
-		Value:    jti,                                      // JTI as value
+		Name:     s.settings.Cookies.RefreshToken,          // Name of the cookie to store JTI
+		Value:    refreshToken,                             // Refresh token as value
 		Expires:  time.Now().Add(REFRESH_TOKEN_EXPIRATION), // Cookie expiry matches refresh token expiry
 		HTTPOnly: true,                                     // HTTP-only, prevents JavaScript access
 		// @TODO: Set Secure to true/Strict in production
@@ -61,9 +77,9 @@ func SetRefreshCookie(c *fiber.Ctx, jti string) {
 }
 
 // Store JTI in HTTP-only cookie
-func SetAccessTokenCookie(c *fiber.Ctx, token string) {
-	publicUrl := os.Getenv("PUBLIC_URL")
-	publicDomain := os.Getenv("PUBLIC_DOMAIN")
+func (s *Service) SetAccessTokenCookie(c *fiber.Ctx, token string) {
+	publicUrl := s.settings.PublicURL
+	publicDomain := s.settings.PublicDomain
 
 	sameSite := "Lax"
 	secure := false
@@ -76,15 +92,15 @@ func SetAccessTokenCookie(c *fiber.Ctx, token string) {
 
 	expires := ACCESS_TOKEN_EXPIRATION
 
-	if isDevelopment() {
+	if s.isDevelopment() {
 		expires = ACCESS_TOKEN_EXPIRATION_DEVELOPMENT
 	}
 
 	c.Cookie(&fiber.Cookie{
-		Name:     os.Getenv("ACCESS_TOKEN_COOKIE_NAME"), // Name of the cookie to store JTI
-		Value:    token,                                 // JTI as value
-		Expires:  time.Now().Add(expires),               // Cookie expiry matches refresh token expiry
-		HTTPOnly: true,                                  // HTTP-only, prevents JavaScript access
+		Name:     s.settings.Cookies.AccessToken, // Name of the cookie to store JTI
+		Value:    token,                          // JTI as value
+		Expires:  time.Now().Add(expires),        // Cookie expiry matches refresh token expiry
+		HTTPOnly: true,                           // HTTP-only, prevents JavaScript access
 		// @TODO: Set Secure to true/Strict in production
 		Secure:   secure,   // Send only over HTTPS
 		SameSite: sameSite, // Prevent CSRF attacks
@@ -92,9 +108,9 @@ func SetAccessTokenCookie(c *fiber.Ctx, token string) {
 	})
 }
 
-func GetConnectRpcAccessTokenCookie(token string) string {
-	publicUrl := os.Getenv("PUBLIC_URL")
-	publicDomain := os.Getenv("PUBLIC_DOMAIN")
+func (s *Service) GetConnectRpcAccessTokenCookie(token string) string {
+	publicUrl := s.settings.PublicURL
+	publicDomain := s.settings.PublicDomain
 
 	sameSite := "Lax"
 	secure := false
@@ -105,7 +121,7 @@ func GetConnectRpcAccessTokenCookie(token string) string {
 		domain = publicDomain
 	}
 
-	cookieName := os.Getenv("ACCESS_TOKEN_COOKIE_NAME")
+	cookieName := s.settings.Cookies.AccessToken
 	cookieValue := token
 	expires := time.Now().Add(REFRESH_TOKEN_EXPIRATION).Format(time.RFC1123) // Cookie expiry formatted to a standard HTTP date
 
@@ -120,9 +136,9 @@ func GetConnectRpcAccessTokenCookie(token string) string {
 	return cookieStr
 }
 
-func DeleteAccessTokenCookie(c *fiber.Ctx) {
-	publicDomain := os.Getenv("PUBLIC_DOMAIN")
-	publicUrl := os.Getenv("PUBLIC_URL")
+func (s *Service) DeleteRefreshCookie(c *fiber.Ctx) {
+	publicDomain := s.settings.PublicDomain
+	publicUrl := s.settings.PublicURL
 
 	domain := "localhost"
 
@@ -131,7 +147,7 @@ func DeleteAccessTokenCookie(c *fiber.Ctx) {
 	}
 
 	c.Cookie(&fiber.Cookie{
-		Name:     os.Getenv("ACCESS_TOKEN_COOKIE_NAME"),
+		Name:     s.settings.Cookies.RefreshToken,
 		Value:    "",
 		Expires:  time.Now().Add(-time.Hour),
 		HTTPOnly: true,
@@ -141,60 +157,115 @@ func DeleteAccessTokenCookie(c *fiber.Ctx) {
 	})
 }
 
+func (s *Service) DeleteAccessTokenCookie(c *fiber.Ctx) {
+	publicDomain := s.settings.PublicDomain
+	publicUrl := s.settings.PublicURL
+
+	domain := "localhost"
+
+	if publicUrl != "" {
+		domain = publicDomain
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     s.settings.Cookies.AccessToken,
+		Value:    "",
+		Expires:  time.Now().Add(-time.Hour),
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: "Lax",
+		Domain:   domain,
+	})
+}
+
+const ACCESS_TOKEN_TYPE = "access"
+const REFRESH_TOKEN_TYPE = "refresh"
+
 type AuthClaims struct {
-	ID        string `json:"id"`
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
-	Email     string `json:"email"`
-	Admin     bool   `json:"role"`
+	ID          string   `json:"id"`
+	Type        string   `json:"type"`
+	FirstName   string   `json:"firstName"`
+	LastName    string   `json:"lastName"`
+	Email       string   `json:"email"`
+	Admin       bool     `json:"role"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	Version     int      `json:"ver"` // Access token version of the user, see AuthMiddleware
 	jwt.RegisteredClaims
 }
 type RefreshJWTClaims struct {
-	ID string `json:"id"`
+	ID   string `json:"id"`
+	Type string `json:"type"`
 	jwt.RegisteredClaims
 }
 
-func GenerateJWTAccessToken(userId string) (string, error) {
+func (s *Service) GenerateJWTAccessToken(ctx context.Context, userId string) (accessToken string, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "jwt.GenerateAccessToken")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	// Set expiration time for the token
 	expirationTime := time.Now().Add(ACCESS_TOKEN_EXPIRATION)
-	userData, _ := db.GetUserById(userId)
+	userData, err := s.users.GetUserById(ctx, userId)
+	if err != nil {
+		return "", err
+	}
 
-	// Create the claims, which includes the user ID and standard JWT claims
+	roles, permissions, err := s.users.GetUserRolesAndPermissions(ctx, userId)
+	if err != nil {
+		return "", err
+	}
+
+	version, err := s.tokens.GetAccessTokenVersion(ctx, userId)
+	if err != nil {
+		return "", err
+	}
+
+	// Create the claims, which includes the user ID, roles with permissions and standard JWT claims
 	claims := &AuthClaims{
-		ID:        userData.UserId,
-		FirstName: userData.FirstName,
-		LastName:  userData.LastName,
-		Email:     userData.Email,
+		ID:          userData.UserId,
+		Type:        ACCESS_TOKEN_TYPE,
+		FirstName:   userData.FirstName,
+		LastName:    userData.LastName,
+		Email:       userData.Email,
+		Admin:       slices.Contains(roles, db.RoleAdmin),
+		Roles:       roles,
+		Permissions: permissions,
+		Version:     version,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			Issuer:    "go-server",
 		},
 	}
 
-	// Create the token with the specified signing method
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign the token with the secret key
-	accessToken, err := token.SignedString(config.JwtKey)
+	// Sign the token with the active key of the key ring
+	accessToken, err = signToken(claims)
 	if err != nil {
 		return "", err
 	}
-	fmt.Println("Generated JWT:", accessToken)
+	tokensIssued.WithLabelValues(ACCESS_TOKEN_TYPE).Inc()
+	slog.Debug("Generated access token", "user_id", userId)
 	return accessToken, err
 }
 
-func GenerateJWTRefreshToken(userId string) (string, time.Time, error) {
+func GenerateJWTRefreshToken(ctx context.Context, userId string) (string, string, time.Time, error) {
+	_, span := tracing.Tracer().Start(ctx, "jwt.GenerateRefreshToken")
+	defer span.End()
+
 	// Set expiration time for the token
 	expirationTime := time.Now().Add(REFRESH_TOKEN_EXPIRATION)
 
 	jti, err := generateJTI()
 
 	if err != nil {
-		return "", time.Time{}, err
+		return "", "", time.Time{}, err
 	}
 
 	refreshClaims := &RefreshJWTClaims{
-		ID: userId,
+		ID:   userId,
+		Type: REFRESH_TOKEN_TYPE,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			Issuer:    "go-server",
@@ -202,128 +273,188 @@ func GenerateJWTRefreshToken(userId string) (string, time.Time, error) {
 		},
 	}
 
-	// Create the token with the specified signing method
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-
-	// Sign the token with the secret key
-	refreshToken, err := token.SignedString(config.JwtKey)
+	// Sign the token with the active key of the key ring
+	refreshToken, err := signToken(refreshClaims)
 	if err != nil {
-		return "", time.Time{}, err
+		return "", "", time.Time{}, err
 	}
-	fmt.Println("Generated REFRESH TOKEN:", refreshToken)
-	return refreshToken, expirationTime, err
+	tokensIssued.WithLabelValues(REFRESH_TOKEN_TYPE).Inc()
+	slog.Debug("Generated refresh token", "user_id", userId, "jti", jti)
+	return refreshToken, jti, expirationTime, err
 }
 
-// Generate JWT with user ID
-func GenerateJWTPair(userId string) (string, error) {
-	accessToken, err := GenerateJWTAccessToken(userId)
+// Generate JWT with user ID, returns access and refresh s.tokens.
+// Every call starts a new refresh token family
+func (s *Service) GenerateJWTPair(ctx context.Context, userId string) (accessToken string, refreshToken string, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "jwt.GeneratePair")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	accessToken, refreshToken, refreshTokenRecord, err := s.generateJWTPairInFamily(ctx, userId, uuid.New().String())
+
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	// Set expiration time for Refresh Token (long-lived)
-	refreshToken, expirationTime, err := GenerateJWTRefreshToken(userId)
 
+	// Store the JTI in the database
+	err = s.tokens.StoreRefreshToken(ctx, refreshTokenRecord)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	userData, _ := db.GetUserById(userId)
+	return accessToken, refreshToken, nil
+}
 
-	// Store the JTI in the database
-	err = db.StoreJTI(refreshToken, userData.UserId, expirationTime.Format(time.RFC3339), accessToken)
+// Generate token pair and the refresh token row to be stored for it
+func (s *Service) generateJWTPairInFamily(ctx context.Context, userId string, familyId string) (string, string, db.RefreshToken, error) {
+	accessToken, err := s.GenerateJWTAccessToken(ctx, userId)
 	if err != nil {
-		return "", err
+		return "", "", db.RefreshToken{}, err
 	}
+	// Set expiration time for Refresh Token (long-lived)
+	refreshToken, jti, expirationTime, err := GenerateJWTRefreshToken(ctx, userId)
 
-	return accessToken, nil
+	if err != nil {
+		return "", "", db.RefreshToken{}, err
+	}
+
+	return accessToken, refreshToken, db.RefreshToken{
+		UserID:      userId,
+		JTI:         jti,
+		FamilyID:    familyId,
+		Expiry:      expirationTime.Format(time.RFC3339),
+		AccessToken: accessToken,
+	}, nil
 }
 
-func handleRefreshAccessTokenByUserId(userId string) (string, error) {
-	result := db.DBConn.Model(&db.RefreshToken{}).Where("user_id = ? AND expiry > NOW() AND is_revoked=false", userId).Limit(1)
+var ErrRefreshTokenInvalid = errors.New("refresh token is expired or invalid")
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected")
 
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return "", fmt.Errorf("refresh token is expired or invalid")
-		}
-		return "", result.Error
-	}
+// RotateRefreshToken exchanges a refresh token for a new token pair in the same family.
+// Presenting a token that was already rotated revokes the whole family
+func (s *Service) RotateRefreshToken(ctx context.Context, refreshToken string) (string, string, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "jwt.RotateRefreshToken")
+	defer span.End()
 
-	accessToken, err := GenerateJWTAccessToken(userId)
+	accessToken, newRefreshToken, err := s.rotateRefreshToken(ctx, refreshToken)
+	recordRefresh(err)
+	tracing.RecordError(span, err)
 
-	return accessToken, err
+	return accessToken, newRefreshToken, err
 }
 
-func HandleInvalidateUserSession(userId string) error {
-	if userId == "" {
-		return fiber.NewError(fiber.StatusUnauthorized, "No user id found")
+func (s *Service) rotateRefreshToken(ctx context.Context, refreshToken string) (string, string, error) {
+	claims := &RefreshJWTClaims{}
+
+	_, err := jwt.ParseWithClaims(refreshToken, claims, keyRing.verificationKey)
+
+	if err != nil || claims.Type != REFRESH_TOKEN_TYPE || claims.RegisteredClaims.ID == "" {
+		return "", "", ErrRefreshTokenInvalid
 	}
 
-	err := db.DBConn.Model(&db.RefreshToken{}).Where("user_id = ?", userId).Update("is_revoked", true).Error
+	storedToken, err := s.tokens.GetRefreshTokenByJTI(ctx, claims.ID, claims.RegisteredClaims.ID)
+
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return fmt.Errorf("refresh token is expired or invalid")
+			return "", "", ErrRefreshTokenInvalid
 		}
-		return err
+		return "", "", err
 	}
 
-	return nil
-}
+	if storedToken.UserID != claims.ID {
+		return "", "", ErrRefreshTokenInvalid
+	}
+
+	if storedToken.IsRevoked {
+		if storedToken.ReplacedBy != "" {
+			return "", "", s.revokeReusedFamily(ctx, storedToken)
+		}
+		return "", "", ErrRefreshTokenInvalid
+	}
 
-func RefreshAccessToken(c *fiber.Ctx, userId string) (string, error) {
+	if expiry, err := time.Parse(time.RFC3339, storedToken.Expiry); err != nil || time.Now().After(expiry) {
+		return "", "", ErrRefreshTokenInvalid
+	}
 
-	// Validate the JTI against stored refresh tokens in your database (mock validation here)
-	// In production, check if the JTI is valid and not revoked.
-	accessToken, err := handleRefreshAccessTokenByUserId(userId)
+	accessToken, newRefreshToken, refreshTokenRecord, err := s.generateJWTPairInFamily(ctx, storedToken.UserID, storedToken.FamilyID)
 
 	if err != nil {
-		return "", c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Token refresh failed"})
+		return "", "", err
 	}
 
-	SetAccessTokenCookie(c, accessToken)
+	err = s.tokens.RotateRefreshToken(ctx, storedToken.JTI, refreshTokenRecord)
 
-	return accessToken, nil
+	if err != nil {
+		// Somebody else rotated the token in the meantime, treat it as a replay
+		if errors.Is(err, db.ErrRefreshTokenRotated) {
+			return "", "", s.revokeReusedFamily(ctx, storedToken)
+		}
+		return "", "", err
+	}
+
+	return accessToken, newRefreshToken, nil
 }
 
-func VerifyToken(token string) (*jwt.Token, error) {
-	// Parse the JWT token
-	parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+func (s *Service) revokeReusedFamily(ctx context.Context, storedToken db.RefreshToken) error {
+	slog.Warn("Refresh token reuse detected", "user_id", storedToken.UserID, "family_id", storedToken.FamilyID)
 
-		// Verify the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("invalid signing method: %v", token.Header["alg"])
-		}
-		// Return the secret key used for signing
-		return []byte(config.JwtKey), nil
-	})
+	if err := s.tokens.RevokeRefreshTokenFamily(ctx, storedToken.UserID, storedToken.FamilyID); err != nil {
+		return err
+	}
+	tokenRevocations.WithLabelValues("reuse").Inc()
 
+	return ErrRefreshTokenReused
+}
+
+// HandleInvalidateUserSession revokes the access and refresh tokens issued to the user so far
+func (s *Service) HandleInvalidateUserSession(ctx context.Context, userId string) error {
+	if userId == "" {
+		return fiber.NewError(fiber.StatusUnauthorized, "No user id found")
+	}
+
+	if err := s.tokens.RevokeAccessTokens(ctx, userId); err != nil {
+		return err
+	}
+
+	err := s.tokens.RevokeUserRefreshTokens(ctx, userId)
 	if err != nil {
-		// Check if the error is due to token expiration
-		if errors.Is(err, jwt.ErrTokenExpired) {
-			return nil, fmt.Errorf("access token expired")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("refresh token is expired or invalid")
 		}
-		return nil, fmt.Errorf("invalid access token")
+		return err
 	}
+	tokenRevocations.WithLabelValues("logout").Inc()
 
-	// Check if the token is valid
-	if !parsedToken.Valid {
-		return nil, errors.New("invalid JWT token")
-	}
+	return nil
+}
+
+// RefreshAccessToken rotates the refresh token presented in the refresh cookie and sets both cookies
+func (s *Service) RefreshAccessToken(c *fiber.Ctx) (string, error) {
+	accessToken, refreshToken, err := s.RotateRefreshToken(c.UserContext(), c.Cookies(s.settings.Cookies.RefreshToken))
 
-	if err := db.DBConn.Table("refresh_tokens").Where("access_token = ?", parsedToken).Error; err != nil {
-		return nil, errors.New("access token is invalid")
+	if err != nil {
+		return "", err
 	}
 
-	// Return the parsed token
-	return parsedToken, nil
+	s.SetAccessTokenCookie(c, accessToken)
+	s.SetRefreshCookie(c, refreshToken)
+
+	return accessToken, nil
 }
 
-func RevokeJWTByUserId(userId string) error {
+func (s *Service) RevokeJWTByUserId(ctx context.Context, userId string) error {
+	if err := s.tokens.RevokeAccessTokens(ctx, userId); err != nil {
+		return err
+	}
 
-	err := db.RevokeJWTByUserId(userId)
+	err := s.tokens.RevokeUserRefreshTokens(ctx, userId)
 
 	if err != nil {
 		return err
 	}
+	tokenRevocations.WithLabelValues("user").Inc()
 
 	return nil
 }
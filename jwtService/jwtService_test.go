@@ -0,0 +1,25 @@
+package jwtService
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/oleksiip-aiola/go-server/config"
+	"github.com/oleksiip-aiola/go-server/db"
+)
+
+func TestNoAccessTokenForUnknownUser(t *testing.T) {
+	cfg := config.Default()
+	cfg.JWT.SigningKeys = []string{writeSigningKey(t, t.TempDir(), "key.pem")}
+	if err := InitKeyRing(cfg.JWT); err != nil {
+		t.Fatal(err)
+	}
+
+	repositories := db.NewMemoryRepositories()
+	service := NewService(cfg, repositories.Users, repositories.Tokens)
+
+	if token, err := service.GenerateJWTAccessToken(context.Background(), uuid.New().String()); err == nil {
+		t.Errorf("expected an error for an unknown user, got token %s", token)
+	}
+}
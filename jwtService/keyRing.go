@@ -0,0 +1,320 @@
+package jwtService
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oleksiip-aiola/go-server/config"
+)
+
+// Key used to sign tokens, identified in the token header by its kid
+type SigningKey struct {
+	Kid        string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.Signer
+	// Set once the key stops signing; it is still accepted for verification
+	// until every token it could have signed has expired
+	RetiredAt *time.Time
+}
+
+// expired is true once every token the key could have signed has expired
+func (key *SigningKey) expired(now time.Time) bool {
+	return key.RetiredAt != nil && now.After(key.RetiredAt.Add(REFRESH_TOKEN_EXPIRATION))
+}
+
+type KeyRing struct {
+	mutex     sync.RWMutex
+	keys      map[string]*SigningKey
+	activeKid string
+	files     []string
+	rotatedAt time.Time // When the first file became active, the other files retire from then
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var keyRing = &KeyRing{keys: make(map[string]*SigningKey)}
+
+var KEY_ROTATION_CHECK_INTERVAL = time.Hour
+
+// Thumbprints of keys anyone can read, e.g. the key.pem once committed to this repository, they are never loaded
+var PUBLISHED_KEY_THUMBPRINTS = []string{"9lI9FUG8xUpvOLNyh-egfCfeVnayu70cdiVCifR_kcQ"}
+
+// InitKeyRing loads the signing keys from the configured PEM files.
+// The first file holds the active signing key, the others are only used for verification
+func InitKeyRing(cfg config.JWTConfig) error {
+	keyRing.files = slices.Clone(cfg.SigningKeys)
+	keyRing.rotatedAt = cfg.KeyRotatedAt
+
+	if cfg.KeyRotationInterval > 0 {
+		KEY_ROTATION_CHECK_INTERVAL = cfg.KeyRotationInterval
+	}
+
+	return keyRing.Reload()
+}
+
+// StartKeyRotation periodically reloads the key files, so a new active key placed in the
+// first file is picked up without a restart, and drops retired keys once they are no longer needed
+func StartKeyRotation(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := keyRing.Reload(); err != nil {
+				slog.Error("Failed to reload JWT signing keys", "error", err)
+			}
+		}
+	}()
+}
+
+func (r *KeyRing) Reload() error {
+	loaded := []*SigningKey{}
+
+	for _, file := range r.files {
+		key, err := loadSigningKey(file)
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, key)
+	}
+
+	if len(loaded) == 0 {
+		return errors.New("no JWT signing keys configured")
+	}
+
+	// The other keys stopped signing at the configured time, which stays the same across restarts and copies
+	if len(loaded) > 1 && r.rotatedAt.IsZero() {
+		return errors.New("JWT_KEY_ROTATED_AT is required with more than one signing key")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	current := make(map[string]bool)
+
+	for i, key := range loaded {
+		current[key.Kid] = true
+
+		existing, seen := r.keys[key.Kid]
+		if seen {
+			key.RetiredAt = existing.RetiredAt
+		}
+
+		switch {
+		case i == 0:
+			key.RetiredAt = nil
+		case key.RetiredAt != nil:
+		case seen:
+			// Signed until this reload, a restart only knows the configured time
+			key.RetiredAt = &now
+			slog.Warn("JWT signing key rotated, set JWT_KEY_ROTATED_AT before the next restart", "kid", key.Kid, "rotated_at", now.Format(time.RFC3339))
+		default:
+			rotatedAt := r.rotatedAt
+			key.RetiredAt = &rotatedAt
+		}
+
+		r.keys[key.Kid] = key
+	}
+
+	for kid, key := range r.keys {
+		if current[kid] {
+			continue
+		}
+
+		// Key was removed from the files, keep it around for tokens it already signed
+		if key.RetiredAt == nil {
+			key.RetiredAt = &now
+		}
+
+		if key.expired(now) {
+			delete(r.keys, kid)
+		}
+	}
+
+	if r.activeKid != loaded[0].Kid {
+		slog.Info("Active JWT signing key", "kid", loaded[0].Kid)
+	}
+
+	r.activeKid = loaded[0].Kid
+
+	return nil
+}
+
+func (r *KeyRing) activeKey() (*SigningKey, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	key, ok := r.keys[r.activeKid]
+	if !ok {
+		return nil, errors.New("no active JWT signing key")
+	}
+
+	return key, nil
+}
+
+func (r *KeyRing) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("token has no kid header")
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+
+	if key.expired(time.Now()) {
+		return nil, fmt.Errorf("signing key expired: %s", kid)
+	}
+
+	// Only accept the algorithm the key was issued for
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("invalid signing method: %v", token.Header["alg"])
+	}
+
+	return key.PrivateKey.Public(), nil
+}
+
+// signToken signs the claims with the active key and sets its kid in the header
+func signToken(claims jwt.Claims) (string, error) {
+	key, err := keyRing.activeKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Kid
+
+	return token.SignedString(key.PrivateKey)
+}
+
+// GetJWKS returns the public part of every key that may still verify tokens
+func GetJWKS() JWKS {
+	keyRing.mutex.RLock()
+	defer keyRing.mutex.RUnlock()
+
+	jwks := JWKS{Keys: []JWK{}}
+	now := time.Now()
+
+	for _, key := range keyRing.keys {
+		if !key.expired(now) {
+			jwks.Keys = append(jwks.Keys, publicJWK(key))
+		}
+	}
+
+	return jwks
+}
+
+func loadSigningKey(file string) (*SigningKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key %s: %w", file, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", file)
+	}
+
+	var parsed interface{}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, file)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", file, err)
+	}
+
+	key := &SigningKey{}
+
+	switch privateKey := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+		key.PrivateKey = privateKey
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.PrivateKey = privateKey
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T in %s", parsed, file)
+	}
+
+	key.Kid = thumbprint(publicJWK(key))
+
+	if slices.Contains(PUBLISHED_KEY_THUMBPRINTS, key.Kid) {
+		return nil, fmt.Errorf("signing key %s was published with the source code, generate a new one", file)
+	}
+
+	return key, nil
+}
+
+func publicJWK(key *SigningKey) JWK {
+	jwk := JWK{Use: "sig", Alg: key.Method.Alg(), Kid: key.Kid}
+
+	switch publicKey := key.PrivateKey.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+	}
+
+	return jwk
+}
+
+// RFC 7638 thumbprint, so the kid stays the same for a key across restarts and instances
+func thumbprint(jwk JWK) string {
+	var members map[string]string
+
+	if jwk.Kty == "RSA" {
+		members = map[string]string{"e": jwk.E, "kty": jwk.Kty, "n": jwk.N}
+	} else {
+		members = map[string]string{"crv": jwk.Crv, "kty": jwk.Kty, "x": jwk.X}
+	}
+
+	// encoding/json sorts map keys, which gives the canonical member order
+	data, _ := json.Marshal(members)
+	hash := sha256.Sum256(data)
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,150 @@
+package jwtService
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func writeSigningKey(t *testing.T, dir string, name string) string {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestRetiredKeysExpireAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+
+	current := writeSigningKey(t, dir, "current.pem")
+	previous := writeSigningKey(t, dir, "previous.pem")
+
+	// A fresh file time, e.g. from a redeploy, does not keep the previous key alive
+	now := time.Now()
+	if err := os.Chtimes(current, now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotated before the previous key could have signed a token still valid, a fresh ring is what a restart starts from
+	ring := &KeyRing{keys: make(map[string]*SigningKey), files: []string{current, previous}, rotatedAt: now.Add(-REFRESH_TOKEN_EXPIRATION - time.Hour)}
+	if err := ring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range ring.keys {
+		if key.Kid == ring.activeKid {
+			continue
+		}
+		if !key.expired(time.Now()) {
+			t.Errorf("expected the previous key to be retired since the rotation, got %v", key.RetiredAt)
+		}
+	}
+
+	previousRing := keyRing
+	keyRing = ring
+	t.Cleanup(func() { keyRing = previousRing })
+
+	jwks := GetJWKS()
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != ring.activeKid {
+		t.Errorf("expected only the active key to be published, got %v", jwks.Keys)
+	}
+
+	// Rotated recently, the previous key still verifies even with an old file time, e.g. from an image build
+	epoch := time.Unix(0, 0)
+	if err := os.Chtimes(current, epoch, epoch); err != nil {
+		t.Fatal(err)
+	}
+
+	ring = &KeyRing{keys: make(map[string]*SigningKey), files: []string{current, previous}, rotatedAt: now.Add(-time.Hour)}
+	if err := ring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	keyRing = ring
+
+	if len(GetJWKS().Keys) != 2 {
+		t.Error("expected a recently retired key to be published")
+	}
+
+	// Without the rotation time the previous key cannot be placed
+	ring = &KeyRing{keys: make(map[string]*SigningKey), files: []string{current, previous}}
+	if err := ring.Reload(); err == nil {
+		t.Error("expected a previous key without a rotation time to be refused")
+	}
+}
+
+func TestRotationWithoutRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	current := writeSigningKey(t, dir, "current.pem")
+	previous := writeSigningKey(t, dir, "previous.pem")
+
+	ring := &KeyRing{keys: make(map[string]*SigningKey), files: []string{current, previous}, rotatedAt: time.Now().Add(-REFRESH_TOKEN_EXPIRATION - time.Hour)}
+	if err := ring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	rotatedKid := ring.activeKid
+
+	// The active key moves to the second file and a new one is written to the first
+	data, err := os.ReadFile(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(previous, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeSigningKey(t, dir, "current.pem")
+
+	if err := ring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ring.activeKid == rotatedKid {
+		t.Fatal("expected the new key to be active")
+	}
+	if key := ring.keys[rotatedKid]; key == nil || key.expired(time.Now()) {
+		t.Error("expected the key active until the reload to still verify")
+	}
+}
+
+func TestPublishedKeysAreRejected(t *testing.T) {
+	dir := t.TempDir()
+	file := writeSigningKey(t, dir, "published.pem")
+
+	key, err := loadSigningKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := PUBLISHED_KEY_THUMBPRINTS
+	PUBLISHED_KEY_THUMBPRINTS = append(slices.Clone(previous), key.Kid)
+	t.Cleanup(func() { PUBLISHED_KEY_THUMBPRINTS = previous })
+
+	if _, err := loadSigningKey(file); err == nil {
+		t.Error("expected a published key to be rejected")
+	}
+
+	ring := &KeyRing{keys: make(map[string]*SigningKey), files: []string{file}}
+	if err := ring.Reload(); err == nil {
+		t.Error("expected a ring with a published key to fail to load")
+	}
+}
@@ -0,0 +1,38 @@
+package jwtService
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tokensIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_tokens_issued_total",
+		Help: "Signed tokens by type (access or refresh).",
+	}, []string{"type"})
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_token_refreshes_total",
+		Help: "Refresh token rotations by result (success, invalid, reused or error).",
+	}, []string{"result"})
+	tokenRevocations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_token_revocations_total",
+		Help: "Refresh token revocations by reason (logout, reuse or user).",
+	}, []string{"reason"})
+)
+
+func recordRefresh(err error) {
+	result := "success"
+
+	switch {
+	case errors.Is(err, ErrRefreshTokenInvalid):
+		result = "invalid"
+	case errors.Is(err, ErrRefreshTokenReused):
+		result = "reused"
+	case err != nil:
+		result = "error"
+	}
+
+	tokenRefreshes.WithLabelValues(result).Inc()
+}
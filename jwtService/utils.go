@@ -2,41 +2,128 @@ package jwtService
 
 import (
 	"errors"
-	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oleksiip-aiola/go-server/keys"
+	"github.com/oleksiip-aiola/go-server/logger"
 )
 
-func VerifyTokenProtectedRoute(c *fiber.Ctx) error {
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Missing Authorization header",
-		})
+// Read the access token from the Bearer header, falling back to the access token cookie
+func (s *Service) getRequestAccessToken(c *fiber.Ctx) string {
+	authHeader := c.Get(fiber.HeaderAuthorization)
 
-		return errors.New("authorization header missing")
+	if len(authHeader) > len("Bearer ") && strings.EqualFold(authHeader[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(authHeader[len("Bearer "):])
 	}
-	// Extract JWT token from Authorization header
-	accessTokenCookie := authHeader[len("Bearer "):]
 
-	_, verificationError := VerifyToken(accessTokenCookie)
-	if verificationError != nil {
-		if verificationError.Error() == "access token expired" {
-			fmt.Println(verificationError, verificationError.Error() == "access token expired")
+	return c.Cookies(s.settings.Cookies.AccessToken)
+}
 
-			c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid JWT token",
+// ParseAccessToken verifies the token signature and expiry and returns its claims
+func ParseAccessToken(token string) (*AuthClaims, error) {
+	claims := &AuthClaims{}
+
+	parsedToken, err := jwt.ParseWithClaims(token, claims, keyRing.verificationKey)
+
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, errors.New("access token expired")
+		}
+		return nil, errors.New("invalid access token")
+	}
+
+	if !parsedToken.Valid || claims.Type != ACCESS_TOKEN_TYPE || claims.ID == "" {
+		return nil, errors.New("invalid access token")
+	}
+
+	return claims, nil
+}
+
+// AuthMiddleware rejects requests without a valid access token, or with one issued before the
+// user's last logout, and stores the verified claims in the request locals for the handlers down the chain
+func (s *Service) AuthMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token := s.getRequestAccessToken(c)
+
+		if token == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Missing access token",
 			})
-			return errors.New("invalid JWT token")
+		}
 
-		} else {
-			c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		claims, err := ParseAccessToken(token)
+
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "Invalid JWT token",
 			})
-			return errors.New("invalid JWT token")
+		}
 
+		version, err := s.tokens.GetAccessTokenVersion(c.UserContext(), claims.ID)
+
+		if err != nil {
+			logger.FromCtx(c).Error("Failed to read access token version", "user_id", claims.ID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to verify access token",
+			})
 		}
+
+		if claims.Version < version {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid JWT token",
+			})
+		}
+
+		c.Locals(keys.AuthClaimsKey, claims)
+
+		return c.Next()
+	}
+}
+
+// GetAuthClaims returns the claims stored by AuthMiddleware, nil when the route is not protected
+func GetAuthClaims(c *fiber.Ctx) *AuthClaims {
+	claims, ok := c.Locals(keys.AuthClaimsKey).(*AuthClaims)
+	if !ok {
+		return nil
+	}
+
+	return claims
+}
+
+// GetUserId returns the id of the authenticated user of the request
+func GetUserId(c *fiber.Ctx) string {
+	claims := GetAuthClaims(c)
+	if claims == nil {
+		return ""
 	}
 
-	return nil
+	return claims.ID
+}
+
+// RequirePermission allows the request only when the access token grants every given permission.
+// It has to run after AuthMiddleware
+func RequirePermission(permissions ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims := GetAuthClaims(c)
+
+		if claims == nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Missing access token",
+			})
+		}
+
+		for _, permission := range permissions {
+			if !slices.Contains(claims.Permissions, permission) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+					"error":      "Insufficient permissions",
+					"permission": permission,
+				})
+			}
+		}
+
+		return c.Next()
+	}
 }
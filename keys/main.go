@@ -13,3 +13,5 @@ type HttpRequestResponse struct {
 // Shared key
 const HttpRequestKey ContextKey = "httpRequest"
 const HttpResponseWriterKey ContextKey = "httpResponseWriter"
+const AuthClaimsKey ContextKey = "authClaims"
+const RequestIDKey ContextKey = "requestId"
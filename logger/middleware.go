@@ -0,0 +1,93 @@
+package logger
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/oleksiip-aiola/go-server/keys"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// Longest request id accepted from a client, longer ones are replaced
+const maxRequestIDLength = 128
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RequestID keeps the X-Request-ID of the request, or generates one, and returns it in the response
+func RequestID() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Get(RequestIDHeader)
+
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+
+		c.Locals(keys.RequestIDKey, id)
+		c.Set(RequestIDHeader, id)
+
+		return c.Next()
+	}
+}
+
+// GetRequestID returns the id set by RequestID, empty when the middleware did not run
+func GetRequestID(c *fiber.Ctx) string {
+	id, _ := c.Locals(keys.RequestIDKey).(string)
+	return id
+}
+
+// FromCtx returns the default logger with the request id of the request
+func FromCtx(c *fiber.Ctx) *slog.Logger {
+	if id := GetRequestID(c); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+
+	return slog.Default()
+}
+
+// AccessLog logs every request once it is handled, it has to run after RequestID
+func AccessLog() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		err := c.Next()
+
+		// Let the error handler set the status before it is logged
+		if err != nil {
+			if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+				c.Status(fiber.StatusInternalServerError)
+			}
+		}
+
+		status := c.Response().StatusCode()
+		level := slog.LevelInfo
+
+		if status >= fiber.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		FromCtx(c).Log(c.UserContext(), level, "Request handled",
+			"method", c.Method(),
+			"path", c.Path(),
+			"status", status,
+			"duration", time.Since(start),
+			"ip", c.IP(),
+		)
+
+		return nil
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,77 +15,185 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/joho/godotenv"
+	"github.com/oleksiip-aiola/go-server/config"
 	"github.com/oleksiip-aiola/go-server/db"
+	"github.com/oleksiip-aiola/go-server/jwtService"
+	"github.com/oleksiip-aiola/go-server/logger"
+	"github.com/oleksiip-aiola/go-server/metrics"
 	"github.com/oleksiip-aiola/go-server/routes"
+	"github.com/oleksiip-aiola/go-server/tlsService"
+	"github.com/oleksiip-aiola/go-server/tracing"
+	"github.com/oleksiip-aiola/go-server/webAuthnService"
 )
 
-func establishdbConnection() {
-	fmt.Println("Establishing Gorm DB connection")
+func establishdbConnection(cfg config.DatabaseConfig) {
+	slog.Info("Establishing Gorm DB connection")
 	// Initialize DB connection
-	db.InitDB()
-
-	db.CreateTable()
-	db.CreateJTITable()
-
-	//Glow up
-	db.CreateUserMoodRecordsTable()
+	db.InitDB(cfg)
 }
 
 func main() {
-	err := godotenv.Load()
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Everything from here on, the commands included, logs through slog
+	if err := logger.Setup(cfg.Log, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 {
+		runCommand(cfg, os.Args[1:])
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	// Before connecting, the GORM spans use the installed provider
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
 	if err != nil {
-		fmt.Println("Error loading .env file")
+		slog.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
 	}
+
 	// Connect to the database
-	establishdbConnection()
+	establishdbConnection(cfg.Database)
+
+	if err := webAuthnService.InitWebAuthn(cfg.WebAuthn); err != nil {
+		slog.Error("Failed to initialize WebAuthn", "error", err)
+		os.Exit(1)
+	}
+
+	if err := jwtService.InitKeyRing(cfg.JWT); err != nil {
+		slog.Error("Failed to load JWT signing keys", "error", err)
+		os.Exit(1)
+	}
+	jwtService.StartKeyRotation(jwtService.KEY_ROTATION_CHECK_INTERVAL)
+
 	app := fiber.New(fiber.Config{
 		IdleTimeout: 5 * time.Second,
+		// Shutdown waits for connections being read, a slow client cannot hold one open longer
+		ReadTimeout: 30 * time.Second,
 	})
 
-	publicUrl := os.Getenv("PUBLIC_URL")
+	publicUrl := cfg.PublicURL
 	allowedOrigins := "http://localhost:3000,https://localhost:3000"
 
 	if publicUrl != "" {
 		allowedOrigins = fmt.Sprintf("%s, %s", allowedOrigins, publicUrl)
 	}
 
+	// First so every response, preflight included, carries the request id, is traced and measured
+	app.Use(logger.RequestID(), logger.AccessLog(), tracing.Middleware(), metrics.Middleware())
+
 	app.Options("*", cors.New(cors.Config{
 		AllowOrigins:     allowedOrigins,
 		AllowMethods:     "GET, POST, OPTIONS",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Set-Cookie, connect-protocol-version",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Set-Cookie, connect-protocol-version, X-Request-ID",
 		AllowCredentials: true,
 	}))
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     allowedOrigins,
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Set-Cookie, connect-protocol-version",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Set-Cookie, connect-protocol-version, X-Request-ID",
 		AllowMethods:     "GET, POST, OPTIONS",
+		ExposeHeaders:    logger.RequestIDHeader,
 		AllowCredentials: true,
 	}))
 
 	app.Use(compress.New())
 
-	routes.SetRoutes(app)
+	routes.SetRoutes(app, cfg, db.NewPostgresRepositories())
 
-	handleLogFatal(app)
+	ln, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil {
+		slog.Error("Failed to listen", "port", cfg.Port, "error", err)
+		os.Exit(1)
+	}
 
-	go func() {
-		if error := app.Listen(":" + os.Getenv("PORT")); error != nil {
-			log.Panic(error)
+	var redirect *fiber.App
+
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := tlsService.NewConfig(cfg.TLS)
+		if err != nil {
+			slog.Error("Failed to set up TLS", "error", err)
+			os.Exit(1)
+		}
+
+		ln = tls.NewListener(ln, tlsConfig)
+
+		if cfg.TLS.RedirectPort != "" {
+			redirect = tlsService.RedirectApp(cfg.Port)
 		}
+	}
+
+	os.Exit(serve(app, ln, redirect, cfg, shutdownTracing))
+}
+
+// serve accepts on ln, and plain HTTP on TLS_REDIRECT_PORT when redirect is set, until SIGINT or SIGTERM.
+// Then it stops accepting connections, lets in-flight requests finish, delivers the shard writes that are due
+// and closes the pools within cfg.ShutdownTimeout. It returns the exit code
+func serve(app *fiber.App, ln net.Listener, redirect *fiber.App, cfg config.Config, shutdownTracing func(context.Context) error) int {
+	listenErr := make(chan error, 2)
+
+	go func() {
+		listenErr <- app.Listener(ln)
 	}()
 
-	c := make(chan os.Signal, 1)
+	if redirect != nil {
+		go func() {
+			listenErr <- redirect.Listen(":" + cfg.TLS.RedirectPort)
+		}()
+	}
 
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c // Block the main thread until a signal is received/interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	app.Shutdown()
-	fmt.Println("Shutting down the server")
+	code := 0
 
-}
+	select {
+	case sig := <-signals:
+		slog.Info("Shutting down the server", "signal", sig.String())
+	case err := <-listenErr:
+		// A listener only returns before Shutdown when it could not start
+		slog.Error("Server stopped", "error", err)
+		code = 1
+	}
+
+	// A second signal skips what is left of the graceful shutdown
+	go func() {
+		<-signals
+		slog.Warn("Forced shutdown")
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if redirect != nil {
+		if err := redirect.ShutdownWithContext(ctx); err != nil {
+			slog.Error("Failed to stop the HTTPS redirect", "error", err)
+		}
+	}
+
+	if err := app.ShutdownWithContext(ctx); err != nil {
+		slog.Error("Failed to wait for in-flight requests", "error", err)
+		code = 1
+	}
+
+	if err := db.Close(ctx); err != nil {
+		slog.Error("Failed to close the database pools", "error", err)
+		code = 1
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush spans", "error", err)
+	}
+
+	slog.Info("Server stopped")
 
-func handleLogFatal(app *fiber.App) {
-	log.Fatal(app.Listen(":" + os.Getenv("PORT")))
+	return code
 }
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Handled HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time spent handling HTTP requests by method, route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// Route label of requests no route matched, their paths would make the number of series unbounded
+const unmatchedRoute = "unmatched"
+
+// Middleware counts the requests and observes their latency per route pattern, e.g. /api/admin/outbox/:id/retry.
+// It has to run before the handlers so it sees the status set by the error handler
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		err := c.Next()
+
+		// Routes are registered with and without a leading slash
+		route := c.Route().Path
+		if !strings.HasPrefix(route, "/") {
+			route = "/" + route
+		}
+
+		// Without a matching route fiber returns a 404 error and the last middleware is reported as
+		// the route; handlers answer their own 404s without an error
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) && fiberErr.Code == fiber.StatusNotFound {
+			route = unmatchedRoute
+		}
+
+		if err != nil {
+			if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+				c.Status(fiber.StatusInternalServerError)
+			}
+		}
+
+		// The method points into the request buffer reused by fasthttp, the labels outlive it
+		labels := []string{utils.CopyString(c.Method()), route, strconv.Itoa(c.Response().StatusCode())}
+		httpRequests.WithLabelValues(labels...).Inc()
+		httpRequestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+
+		return nil
+	}
+}
+
+// Handler serves the metrics of the default registry in the Prometheus text format
+func Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.Handler())
+}
@@ -0,0 +1,198 @@
+package adminRoutes
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oleksiip-aiola/go-server/db"
+	"github.com/oleksiip-aiola/go-server/jwtService"
+	"github.com/oleksiip-aiola/go-server/logger"
+	"gorm.io/gorm"
+)
+
+type adminHandlers struct {
+	admin db.AdminRepository
+}
+
+func InitAdminRoutes(app *fiber.App, admin db.AdminRepository, auth *jwtService.Service) {
+	slog.Debug("Initializing admin routes")
+	h := &adminHandlers{admin: admin}
+
+	adminGroup := app.Group(`api/admin`, auth.AuthMiddleware())
+	adminGroup.Get(`/outbox`, jwtService.RequirePermission(db.PermissionSystemRead), h.getOutbox)
+	adminGroup.Post(`/outbox/:id/retry`, jwtService.RequirePermission(db.PermissionSystemWrite), h.retryOutboxEntry)
+	adminGroup.Get(`/shards`, jwtService.RequirePermission(db.PermissionSystemRead), h.getShards)
+	adminGroup.Get(`/users`, jwtService.RequirePermission(db.PermissionUsersRead), h.listUsers)
+	adminGroup.Get(`/moods/count`, jwtService.RequirePermission(db.PermissionSystemRead), h.countMoods)
+	adminGroup.Get(`/reconcile`, jwtService.RequirePermission(db.PermissionSystemRead), h.getReconcileReport)
+	adminGroup.Post(`/reconcile`, jwtService.RequirePermission(db.PermissionSystemWrite), h.startReconcile)
+}
+
+// Time allowed for pinging and counting the users of every shard
+var SHARD_STATUS_TIMEOUT = 3 * time.Second
+
+type GetOutboxStruct struct {
+	Status string `query:"status"`
+	Limit  int    `query:"limit"`
+}
+
+func (h *adminHandlers) getOutbox(c *fiber.Ctx) error {
+	outboxDto := &GetOutboxStruct{Status: db.OutboxStatusFailed, Limit: 50}
+
+	if err := c.QueryParser(outboxDto); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid query params",
+		})
+	}
+
+	if outboxDto.Status != db.OutboxStatusPending && outboxDto.Status != db.OutboxStatusFailed && outboxDto.Status != db.OutboxStatusDelivered {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Status must be pending, failed or delivered",
+		})
+	}
+
+	if outboxDto.Limit < 1 || outboxDto.Limit > 500 {
+		outboxDto.Limit = 50
+	}
+
+	summary, err := h.admin.GetOutboxSummary(c.UserContext(), outboxDto.Status, outboxDto.Limit)
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":  "Failed to read shard outbox",
+			"detail": err.Error(),
+		})
+	}
+
+	return c.JSON(summary)
+}
+
+func (h *adminHandlers) retryOutboxEntry(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid outbox entry ID",
+		})
+	}
+
+	if err := h.admin.RetryOutboxEntry(c.UserContext(), int64(id)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Failed outbox entry not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retry outbox entry",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Outbox entry queued for retry",
+	})
+}
+
+func (h *adminHandlers) getShards(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), SHARD_STATUS_TIMEOUT)
+	defer cancel()
+
+	return c.JSON(h.admin.GetShardStatuses(ctx))
+}
+
+func (h *adminHandlers) getReconcileReport(c *fiber.Ctx) error {
+	running, err := h.admin.IsReconcileRunning(c.UserContext())
+
+	var report *db.ReconcileReport
+	if err == nil {
+		report, err = h.admin.GetLastReconcileReport(c.UserContext())
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":  "Failed to read reconcile report",
+			"detail": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"running": running,
+		"report":  report,
+	})
+}
+
+// Reconciling scans every user, so it runs in the background and the report is read with GET
+func (h *adminHandlers) startReconcile(c *fiber.Ctx) error {
+	err := h.admin.StartReconcile(c.UserContext(), c.QueryBool("dryRun", false))
+
+	if errors.Is(err, db.ErrReconcileRunning) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Reconciliation is already running",
+		})
+	}
+
+	if err != nil {
+		logger.FromCtx(c).Error("Failed to start reconciliation", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start reconciliation",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "Reconciliation started",
+	})
+}
+
+type ListUsersStruct struct {
+	Email  string `query:"email"`
+	Offset int    `query:"offset"`
+	Limit  int    `query:"limit"`
+}
+
+// Users of every shard ordered by email, shards that fail to answer are listed in "failed"
+func (h *adminHandlers) listUsers(c *fiber.Ctx) error {
+	usersDto := &ListUsersStruct{Limit: 50}
+
+	if err := c.QueryParser(usersDto); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid query params",
+		})
+	}
+
+	if usersDto.Offset < 0 {
+		usersDto.Offset = 0
+	}
+	if usersDto.Limit < 1 || usersDto.Limit > 500 {
+		usersDto.Limit = 50
+	}
+
+	return c.JSON(h.admin.ListShardUsers(c.UserContext(), usersDto.Email, usersDto.Offset, usersDto.Limit))
+}
+
+type CountMoodsStruct struct {
+	Year  int `query:"year"`
+	Month int `query:"month"`
+}
+
+func (h *adminHandlers) countMoods(c *fiber.Ctx) error {
+	now := time.Now()
+	moodsDto := &CountMoodsStruct{Year: now.Year(), Month: int(now.Month())}
+
+	if err := c.QueryParser(moodsDto); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid query params",
+		})
+	}
+
+	count, failed := h.admin.CountShardMoodScores(c.UserContext(), moodsDto.Year, moodsDto.Month)
+
+	return c.JSON(fiber.Map{
+		"year":    moodsDto.Year,
+		"month":   moodsDto.Month,
+		"count":   count,
+		"partial": len(failed) > 0,
+		"failed":  failed,
+	})
+}
@@ -2,27 +2,40 @@ package glowUpRoutes
 
 import (
 	"errors"
-	"fmt"
+	"log/slog"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/oleksiip-aiola/go-server/db"
+	"github.com/oleksiip-aiola/go-server/jwtService"
+	"gorm.io/gorm"
 )
 
-func InitGlowUpRoutes(app *fiber.App) {
-	fmt.Println("Initializing glowUp routes")
-	app.Post(`api/glowUp/rate`, handleCreateRate)
-	app.Patch(`api/glowUp/rate/:id`, handleUpdateRate)
-	app.Get(`api/glowUp/rates/:userId/:year/:month`, getMoodScores)
+type glowUpHandlers struct {
+	moods db.MoodRepository
 }
 
-func handleCreateRate(c *fiber.Ctx) error {
+func InitGlowUpRoutes(app *fiber.App, moods db.MoodRepository, auth *jwtService.Service) {
+	slog.Debug("Initializing glowUp routes")
+	h := &glowUpHandlers{moods: moods}
+
+	glowUp := app.Group(`api/glowUp`, auth.AuthMiddleware())
+	glowUp.Post(`/rate`, jwtService.RequirePermission(db.PermissionGlowUpWrite), h.handleCreateRate)
+	glowUp.Patch(`/rate/:id`, jwtService.RequirePermission(db.PermissionGlowUpWrite), h.handleUpdateRate)
+	glowUp.Get(`/rates/:year/:month`, jwtService.RequirePermission(db.PermissionGlowUpRead), h.getMoodScores)
+	// Kept for existing clients, the user id in the path has to be the authenticated user
+	glowUp.Get(`/rates/:userId/:year/:month`, jwtService.RequirePermission(db.PermissionGlowUpRead), h.getMoodScores)
+}
+
+func (h *glowUpHandlers) handleCreateRate(c *fiber.Ctx) error {
 	moodDto := &db.MoodScore{}
 
 	if err := c.BodyParser(moodDto); err != nil {
 		return errors.New("failed to parse mood score")
 	}
 
-	moodScore, err := db.CreateMoodScore(moodDto.UserId, moodDto.Year, moodDto.Month, moodDto.Day, moodDto.MoodId)
+	// The owner always comes from the token, a userId in the body is ignored
+	moodScore, err := h.moods.CreateMoodScore(c.UserContext(), jwtService.GetUserId(c), moodDto.Year, moodDto.Month, moodDto.Day, moodDto.MoodId)
 
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -38,7 +51,7 @@ type Rate struct {
 	MoodId int32
 }
 
-func handleUpdateRate(c *fiber.Ctx) error {
+func (h *glowUpHandlers) handleUpdateRate(c *fiber.Ctx) error {
 	moodDto := &Rate{}
 	id := c.Params("id")
 
@@ -46,16 +59,27 @@ func handleUpdateRate(c *fiber.Ctx) error {
 		return errors.New("failed to parse mood score")
 	}
 
-	err := db.UpdateMoodScore(id, moodDto.MoodId)
+	if _, err := uuid.Parse(id); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Mood score not found",
+		})
+	}
+
+	moodScore, err := h.moods.UpdateMoodScore(c.UserContext(), jwtService.GetUserId(c), id, moodDto.MoodId)
 
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Mood score not found",
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error":  "Failed to update mood score",
 			"detail": err.Error(),
 		})
 	}
 
-	return c.JSON(moodDto)
+	return c.JSON(moodScore)
 }
 
 type GetMoodsStruct struct {
@@ -64,14 +88,22 @@ type GetMoodsStruct struct {
 	Month  int    `json:"month"`
 }
 
-func getMoodScores(c *fiber.Ctx) error {
+func (h *glowUpHandlers) getMoodScores(c *fiber.Ctx) error {
 	moodDto := &GetMoodsStruct{}
 
 	if err := c.ParamsParser(moodDto); err != nil {
 		return errors.New("failed to parse get moods query params")
 	}
 
-	moods, err := db.GetMoodScores(moodDto.UserId, moodDto.Year, moodDto.Month)
+	userId := jwtService.GetUserId(c)
+
+	if moodDto.UserId != "" && moodDto.UserId != userId {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Mood scores not found",
+		})
+	}
+
+	moods, err := h.moods.GetMoodScores(c.UserContext(), userId, moodDto.Year, moodDto.Month)
 
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -2,22 +2,43 @@ package routes
 
 import (
 	"github.com/gofiber/fiber/v2"
+	"github.com/oleksiip-aiola/go-server/config"
+	"github.com/oleksiip-aiola/go-server/db"
+	"github.com/oleksiip-aiola/go-server/jwtService"
+	"github.com/oleksiip-aiola/go-server/metrics"
+	"github.com/oleksiip-aiola/go-server/routes/adminRoutes"
 	"github.com/oleksiip-aiola/go-server/routes/glowUpRoutes"
 	"github.com/oleksiip-aiola/go-server/routes/todoRoutes"
 	"github.com/oleksiip-aiola/go-server/routes/userRoutes"
+	"github.com/oleksiip-aiola/go-server/routes/webAuthnRoutes"
 )
 
-func SetRoutes(app *fiber.App) {
+// SetRoutes registers all endpoints, the handlers and jwtService use the given repositories for storage
+func SetRoutes(app *fiber.App, cfg config.Config, repositories db.Repositories) {
+	auth := jwtService.NewService(cfg, repositories.Users, repositories.Tokens)
 
-	initEndpoints(app)
+	initEndpoints(app, cfg)
 
-	todoRoutes.TodoRoutes(app)
-	userRoutes.UserRoutes(app)
-	glowUpRoutes.InitGlowUpRoutes(app)
+	todoRoutes.TodoRoutes(app, repositories.Todos, auth)
+	userRoutes.UserRoutes(app, repositories.Users, auth)
+	glowUpRoutes.InitGlowUpRoutes(app, repositories.Moods, auth)
+	webAuthnRoutes.InitWebAuthnRoutes(app, cfg, repositories.Users, auth)
+	adminRoutes.InitAdminRoutes(app, repositories.Admin, auth)
 }
 
-func initEndpoints(app *fiber.App) {
+func initEndpoints(app *fiber.App, cfg config.Config) {
 	app.Get("api/healthcheck", helloHandler)
+	app.Get(".well-known/jwks.json", jwksHandler)
+
+	if cfg.Metrics.Enabled {
+		app.Get(cfg.Metrics.Path, metrics.Handler())
+	}
+}
+
+func jwksHandler(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+
+	return c.JSON(jwtService.GetJWKS())
 }
 
 func helloHandler(c *fiber.Ctx) error {
@@ -0,0 +1,571 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oleksiip-aiola/go-server/config"
+	"github.com/oleksiip-aiola/go-server/db"
+	"github.com/oleksiip-aiola/go-server/jwtService"
+	"github.com/oleksiip-aiola/go-server/metrics"
+)
+
+const (
+	accessCookieName  = "test_access_token"
+	refreshCookieName = "test_refresh_token"
+)
+
+var testConfig = func() config.Config {
+	cfg := config.Default()
+	cfg.Cookies = config.CookieConfig{AccessToken: accessCookieName, RefreshToken: refreshCookieName}
+
+	return cfg
+}()
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "go-server-routes")
+	if err != nil {
+		panic(err)
+	}
+
+	code := func() int {
+		defer os.RemoveAll(dir)
+
+		if err := writeSigningKey(filepath.Join(dir, "key.pem")); err != nil {
+			panic(err)
+		}
+
+		testConfig.JWT.SigningKeys = []string{filepath.Join(dir, "key.pem")}
+
+		if err := jwtService.InitKeyRing(testConfig.JWT); err != nil {
+			panic(err)
+		}
+
+		return m.Run()
+	}()
+
+	os.Exit(code)
+}
+
+func writeSigningKey(file string) error {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// testClient sends requests to the app and keeps the cookies it sets, like a browser would
+type testClient struct {
+	t       *testing.T
+	app     *fiber.App
+	cookies map[string]string
+	headers map[string]string
+}
+
+func newTestApp() *fiber.App {
+	app := fiber.New()
+	SetRoutes(app, testConfig, db.NewMemoryRepositories())
+
+	return app
+}
+
+func newTestClient(t *testing.T, app *fiber.App) *testClient {
+	return &testClient{t: t, app: app, cookies: map[string]string{}, headers: map[string]string{}}
+}
+
+type testResponse struct {
+	status  int
+	body    []byte
+	cookies map[string]*http.Cookie
+}
+
+func (r testResponse) decode(t *testing.T, target interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(r.body, target); err != nil {
+		t.Fatalf("failed to decode %s: %v", r.body, err)
+	}
+}
+
+func (r testResponse) errorMessage(t *testing.T) string {
+	t.Helper()
+
+	body := map[string]interface{}{}
+	r.decode(t, &body)
+
+	message, _ := body["error"].(string)
+	return message
+}
+
+func (c *testClient) do(method string, path string, body interface{}) testResponse {
+	c.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	for name, value := range c.cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := c.app.Test(req, -1)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	cookies := map[string]*http.Cookie{}
+
+	for _, cookie := range resp.Cookies() {
+		cookies[cookie.Name] = cookie
+
+		if cookie.Value == "" {
+			delete(c.cookies, cookie.Name)
+		} else {
+			c.cookies[cookie.Name] = cookie.Value
+		}
+	}
+
+	return testResponse{status: resp.StatusCode, body: data, cookies: cookies}
+}
+
+func (c *testClient) expect(method string, path string, body interface{}, status int) testResponse {
+	c.t.Helper()
+
+	resp := c.do(method, path, body)
+
+	if resp.status != status {
+		c.t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, status, resp.status, resp.body)
+	}
+
+	return resp
+}
+
+func (c *testClient) register(email string) string {
+	c.t.Helper()
+
+	resp := c.expect(http.MethodPost, "/api/register", map[string]string{
+		"email":     email,
+		"password":  "secret-password",
+		"firstName": "Test",
+		"lastName":  "User",
+	}, fiber.StatusOK)
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	resp.decode(c.t, &tokens)
+
+	claims, err := jwtService.ParseAccessToken(tokens.AccessToken)
+	if err != nil {
+		c.t.Fatalf("register returned an invalid access token: %v", err)
+	}
+
+	return claims.ID
+}
+
+func TestRegisterRefreshTodosLogout(t *testing.T) {
+	client := newTestClient(t, newTestApp())
+
+	resp := client.expect(http.MethodPost, "/api/register", map[string]string{
+		"email":     "flow@example.com",
+		"password":  "secret-password",
+		"firstName": "Flow",
+		"lastName":  "User",
+	}, fiber.StatusOK)
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	resp.decode(t, &tokens)
+
+	for _, name := range []string{accessCookieName, refreshCookieName} {
+		cookie, ok := resp.cookies[name]
+		if !ok || cookie.Value == "" {
+			t.Fatalf("register did not set the %s cookie", name)
+		}
+		if !cookie.HttpOnly {
+			t.Errorf("cookie %s is not HTTP-only", name)
+		}
+	}
+
+	if resp.cookies[accessCookieName].Value != tokens.AccessToken {
+		t.Error("access token cookie does not match the returned token")
+	}
+
+	claims, err := jwtService.ParseAccessToken(tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Email != "flow@example.com" || claims.FirstName != "Flow" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if len(claims.Roles) != 1 || claims.Roles[0] != db.RoleUser {
+		t.Errorf("expected the user role, got %v", claims.Roles)
+	}
+
+	userId := claims.ID
+
+	// Registering the same email again keeps the first account
+	duplicate := newTestClient(t, client.app)
+	resp = duplicate.expect(http.MethodPost, "/api/register", map[string]string{
+		"email":    "flow@example.com",
+		"password": "other-password",
+	}, fiber.StatusInternalServerError)
+
+	if message := resp.errorMessage(t); message != "User already exists" {
+		t.Errorf("unexpected error %q", message)
+	}
+
+	duplicate.expect(http.MethodPost, "/api/login", map[string]string{
+		"email":    "flow@example.com",
+		"password": "other-password",
+	}, fiber.StatusUnauthorized)
+
+	duplicate.expect(http.MethodPost, "/api/login", map[string]string{
+		"email": "flow@example.com",
+	}, fiber.StatusBadRequest)
+
+	duplicate.expect(http.MethodPost, "/api/login", map[string]string{
+		"email":    "flow@example.com",
+		"password": "secret-password",
+	}, fiber.StatusOK)
+
+	// Refresh rotates the refresh token and issues a new access token
+	oldRefreshToken := client.cookies[refreshCookieName]
+
+	resp = client.expect(http.MethodPost, "/api/refresh-token", nil, fiber.StatusOK)
+	resp.decode(t, &tokens)
+
+	if _, err := jwtService.ParseAccessToken(tokens.AccessToken); err != nil {
+		t.Fatalf("refresh returned an invalid access token: %v", err)
+	}
+
+	if client.cookies[refreshCookieName] == oldRefreshToken {
+		t.Fatal("refresh did not rotate the refresh token")
+	}
+
+	// Todo CRUD
+	var todos []db.Todo
+
+	client.expect(http.MethodGet, "/api/todos", nil, fiber.StatusOK).decode(t, &todos)
+	if len(todos) != 0 {
+		t.Fatalf("expected no todos, got %v", todos)
+	}
+
+	client.expect(http.MethodPost, "/api/todos", map[string]interface{}{
+		"title": "Write tests",
+		"body":  "Cover the routes",
+	}, fiber.StatusOK).decode(t, &todos)
+
+	if len(todos) != 1 || todos[0].Title != "Write tests" || todos[0].Done || todos[0].UserId != userId {
+		t.Fatalf("unexpected todos after create %+v", todos)
+	}
+
+	id := todos[0].ID
+
+	client.expect(http.MethodPut, fmt.Sprintf("/api/todos/%d", id), map[string]interface{}{
+		"title": "Write more tests",
+		"body":  "Cover every route",
+	}, fiber.StatusOK).decode(t, &todos)
+
+	if todos[0].Title != "Write more tests" || todos[0].Body != "Cover every route" {
+		t.Fatalf("unexpected todos after update %+v", todos)
+	}
+
+	resp = client.expect(http.MethodPut, fmt.Sprintf("/api/todos/%d", id), map[string]interface{}{
+		"title": "No body",
+	}, fiber.StatusBadRequest)
+
+	var missing struct {
+		Fields []string `json:"fields"`
+	}
+	resp.decode(t, &missing)
+
+	if len(missing.Fields) != 1 || missing.Fields[0] != "body" {
+		t.Errorf("expected the body field to be reported missing, got %v", missing.Fields)
+	}
+
+	client.expect(http.MethodPatch, fmt.Sprintf("/api/todos/%d/status", id), nil, fiber.StatusOK).decode(t, &todos)
+	if !todos[0].Done {
+		t.Fatal("toggling did not mark the todo done")
+	}
+
+	client.expect(http.MethodPut, "/api/todos/9999", map[string]interface{}{
+		"title": "Missing",
+		"body":  "Missing",
+	}, fiber.StatusNotFound)
+	client.expect(http.MethodPut, "/api/todos/abc", nil, fiber.StatusBadRequest)
+
+	// Todos of other users are not found
+	other := newTestClient(t, client.app)
+	other.register("other@example.com")
+
+	other.expect(http.MethodPatch, fmt.Sprintf("/api/todos/%d/status", id), nil, fiber.StatusNotFound)
+	other.expect(http.MethodDelete, fmt.Sprintf("/api/todos/%d", id), nil, fiber.StatusNotFound)
+	other.expect(http.MethodGet, "/api/todos", nil, fiber.StatusOK).decode(t, &todos)
+
+	if len(todos) != 0 {
+		t.Fatalf("other user sees todos %+v", todos)
+	}
+
+	client.expect(http.MethodDelete, fmt.Sprintf("/api/todos/%d", id), nil, fiber.StatusOK).decode(t, &todos)
+	if len(todos) != 0 {
+		t.Fatalf("expected no todos after delete, got %+v", todos)
+	}
+
+	// Logging out needs a valid access token, the id in the body does not log another user out
+	anonymous := newTestClient(t, client.app)
+	anonymous.expect(http.MethodPost, "/api/logout", map[string]string{"id": userId}, fiber.StatusUnauthorized)
+	client.expect(http.MethodPost, "/api/refresh-token", nil, fiber.StatusOK)
+
+	// Logout revokes the access and refresh tokens issued so far and clears both cookies
+	accessToken := client.cookies[accessCookieName]
+	refreshToken := client.cookies[refreshCookieName]
+
+	resp = client.expect(http.MethodPost, "/api/logout", nil, fiber.StatusOK)
+
+	for _, name := range []string{accessCookieName, refreshCookieName} {
+		if cookie, ok := resp.cookies[name]; !ok || cookie.Value != "" {
+			t.Errorf("logout did not clear the %s cookie", name)
+		}
+	}
+
+	resp = client.expect(http.MethodGet, "/api/todos", nil, fiber.StatusUnauthorized)
+	if message := resp.errorMessage(t); message != "Missing access token" {
+		t.Errorf("unexpected error %q", message)
+	}
+
+	client.cookies[refreshCookieName] = refreshToken
+	client.expect(http.MethodPost, "/api/refresh-token", nil, fiber.StatusUnauthorized)
+
+	// The saved access token is still signed and unexpired, but was issued before the logout
+	client.headers[fiber.HeaderAuthorization] = "Bearer " + accessToken
+	resp = client.expect(http.MethodGet, "/api/todos", nil, fiber.StatusUnauthorized)
+	if message := resp.errorMessage(t); message != "Invalid JWT token" {
+		t.Errorf("unexpected error %q", message)
+	}
+	delete(client.headers, fiber.HeaderAuthorization)
+
+	// Tokens issued after the logout are accepted
+	client.expect(http.MethodPost, "/api/login", map[string]string{
+		"email":    "flow@example.com",
+		"password": "secret-password",
+	}, fiber.StatusOK)
+	client.expect(http.MethodGet, "/api/todos", nil, fiber.StatusOK)
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	client := newTestClient(t, newTestApp())
+	client.register("reuse@example.com")
+
+	stolen := client.cookies[refreshCookieName]
+
+	client.expect(http.MethodPost, "/api/refresh-token", nil, fiber.StatusOK)
+	rotated := client.cookies[refreshCookieName]
+
+	// Replaying the rotated token is reuse, it revokes the token the client got as well
+	attacker := newTestClient(t, client.app)
+	attacker.cookies[refreshCookieName] = stolen
+
+	resp := attacker.expect(http.MethodPost, "/api/refresh-token", nil, fiber.StatusUnauthorized)
+	if cookie, ok := resp.cookies[refreshCookieName]; !ok || cookie.Value != "" {
+		t.Error("rejected refresh did not clear the refresh cookie")
+	}
+
+	client.cookies[refreshCookieName] = rotated
+	client.expect(http.MethodPost, "/api/refresh-token", nil, fiber.StatusUnauthorized)
+}
+
+func TestRejectedAccess(t *testing.T) {
+	client := newTestClient(t, newTestApp())
+
+	client.expect(http.MethodGet, "/api/todos", nil, fiber.StatusUnauthorized)
+	client.expect(http.MethodGet, "/api/glowUp/rates/2024/5", nil, fiber.StatusUnauthorized)
+	client.expect(http.MethodPost, "/api/refresh-token", nil, fiber.StatusUnauthorized)
+
+	client.cookies[accessCookieName] = "not-a-token"
+	resp := client.expect(http.MethodGet, "/api/todos", nil, fiber.StatusUnauthorized)
+
+	if message := resp.errorMessage(t); message != "Invalid JWT token" {
+		t.Errorf("unexpected error %q", message)
+	}
+
+	// Regular users cannot manage roles
+	client = newTestClient(t, client.app)
+	client.register("roles@example.com")
+
+	resp = client.expect(http.MethodGet, "/api/users/roles", nil, fiber.StatusForbidden)
+	if message := resp.errorMessage(t); message != "Insufficient permissions" {
+		t.Errorf("unexpected error %q", message)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	repositories := db.NewMemoryRepositories()
+	app := fiber.New()
+	SetRoutes(app, testConfig, repositories)
+
+	user := newTestClient(t, app)
+	user.register("admin-user@example.com")
+	user.expect(http.MethodGet, "/api/admin/users", nil, fiber.StatusForbidden)
+
+	admin := newTestClient(t, app)
+	adminId := admin.register("admin@example.com")
+
+	if err := repositories.Users.SetUserRoles(context.Background(), adminId, []string{db.RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	// The roles are read into the access token, a refresh picks up the new one
+	admin.expect(http.MethodPost, "/api/refresh-token", nil, fiber.StatusOK)
+
+	var page db.ScatterResult[db.User]
+	admin.expect(http.MethodGet, "/api/admin/users?limit=1", nil, fiber.StatusOK).decode(t, &page)
+
+	if len(page.Items) != 1 || page.Items[0].Email != "admin-user@example.com" || !page.HasMore || page.Partial {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+
+	page = db.ScatterResult[db.User]{}
+	admin.expect(http.MethodGet, "/api/admin/users?email=admin@example.com", nil, fiber.StatusOK).decode(t, &page)
+
+	if len(page.Items) != 1 || page.Items[0].UserId != adminId || page.HasMore {
+		t.Fatalf("unexpected users by email %+v", page)
+	}
+
+	var reconcile struct {
+		Running bool                `json:"running"`
+		Report  *db.ReconcileReport `json:"report"`
+	}
+	admin.expect(http.MethodGet, "/api/admin/reconcile", nil, fiber.StatusOK).decode(t, &reconcile)
+
+	if reconcile.Running || reconcile.Report != nil {
+		t.Fatalf("unexpected reconcile state %+v", reconcile)
+	}
+
+	admin.expect(http.MethodPost, "/api/admin/outbox/1/retry", nil, fiber.StatusNotFound)
+}
+
+func TestGlowUpRates(t *testing.T) {
+	client := newTestClient(t, newTestApp())
+	userId := client.register("glow@example.com")
+
+	var created db.MoodScore
+	client.expect(http.MethodPost, "/api/glowUp/rate", map[string]interface{}{
+		"year":   2024,
+		"month":  5,
+		"day":    12,
+		"moodId": 3,
+		"userId": "00000000-0000-0000-0000-000000000000",
+	}, fiber.StatusOK).decode(t, &created)
+
+	if created.ID == "" || created.UserId != userId || created.MoodId != 3 {
+		t.Fatalf("unexpected mood score %+v", created)
+	}
+
+	var updated db.MoodScore
+	client.expect(http.MethodPatch, "/api/glowUp/rate/"+created.ID, map[string]interface{}{
+		"moodId": 5,
+	}, fiber.StatusOK).decode(t, &updated)
+
+	if updated.ID != created.ID || updated.MoodId != 5 {
+		t.Fatalf("unexpected mood score after update %+v", updated)
+	}
+
+	client.expect(http.MethodPost, "/api/glowUp/rate", map[string]interface{}{
+		"year": 2024, "month": 8, "day": 1, "moodId": 1,
+	}, fiber.StatusOK)
+
+	// The requested month and its neighbours are returned, keyed by year, month and day
+	var moods map[string]map[string]map[string]db.MoodScore
+	client.expect(http.MethodGet, "/api/glowUp/rates/2024/6", nil, fiber.StatusOK).decode(t, &moods)
+
+	if len(moods["2024"]) != 1 || moods["2024"]["5"]["12"].MoodId != 5 {
+		t.Fatalf("unexpected moods %+v", moods)
+	}
+
+	moods = nil
+	client.expect(http.MethodGet, "/api/glowUp/rates/"+userId+"/2024/5", nil, fiber.StatusOK).decode(t, &moods)
+	if moods["2024"]["5"]["12"].ID != created.ID {
+		t.Fatalf("unexpected moods %+v", moods)
+	}
+
+	// Records of other users cannot be read or changed
+	other := newTestClient(t, client.app)
+	other.register("glow-other@example.com")
+
+	other.expect(http.MethodGet, "/api/glowUp/rates/"+userId+"/2024/5", nil, fiber.StatusNotFound)
+	other.expect(http.MethodPatch, "/api/glowUp/rate/"+created.ID, map[string]interface{}{"moodId": 1}, fiber.StatusNotFound)
+	other.expect(http.MethodPatch, "/api/glowUp/rate/not-a-uuid", map[string]interface{}{"moodId": 1}, fiber.StatusNotFound)
+
+	moods = nil
+	other.expect(http.MethodGet, "/api/glowUp/rates/2024/5", nil, fiber.StatusOK).decode(t, &moods)
+	if len(moods) != 0 {
+		t.Fatalf("other user sees moods %+v", moods)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	app := fiber.New()
+	app.Use(metrics.Middleware())
+	SetRoutes(app, testConfig, db.NewMemoryRepositories())
+
+	client := newTestClient(t, app)
+	client.register("metrics@example.com")
+	client.expect(http.MethodPost, "/api/refresh-token", nil, fiber.StatusOK)
+	client.expect(http.MethodGet, "/api/missing", nil, fiber.StatusNotFound)
+
+	body := string(client.expect(http.MethodGet, testConfig.Metrics.Path, nil, fiber.StatusOK).body)
+
+	for _, series := range []string{
+		`http_requests_total{method="POST",route="/api/register",status="200"}`,
+		`http_requests_total{method="GET",route="unmatched",status="404"}`,
+		`jwt_tokens_issued_total{type="access"}`,
+		`jwt_tokens_issued_total{type="refresh"}`,
+		`jwt_token_refreshes_total{result="success"}`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("metrics do not contain %s", series)
+		}
+	}
+}
@@ -1,79 +1,81 @@
 package todoRoutes
 
 import (
-	"fmt"
+	"errors"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/oleksiip-aiola/go-server/db"
 	"github.com/oleksiip-aiola/go-server/jwtService"
-	"github.com/oleksiip-aiola/go-server/structs"
+	"gorm.io/gorm"
 )
 
-func findTodoIndexByID(id int, todos []structs.Todo) int {
-	for i, todo := range todos {
-		if todo.ID == id {
-			return i
-		}
+type TodoStruct struct {
+	Title string `json:"title"`
+	Done  bool   `json:"done"`
+	Body  string `json:"body"`
+}
+
+// Respond with the current todos of the user, the shape every todo endpoint returns
+func sendTodos(c *fiber.Ctx, repository db.TodoRepository, userId string) error {
+	todos, err := repository.GetTodos(c.UserContext(), userId)
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":  "Failed to get todos",
+			"detail": err.Error(),
+		})
 	}
-	return -1
+
+	return c.JSON(todos)
 }
 
-func TodoRoutes(app *fiber.App) {
-	todos := []structs.Todo{}
+func handleTodoError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Todo not found",
+		})
+	}
 
-	app.Get("api/todos", func(c *fiber.Ctx) error {
-		err := jwtService.VerifyTokenProtectedRoute(c)
-		fmt.Println(err)
-		if err != nil {
-			return nil
-		}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error":  "Failed to update todo",
+		"detail": err.Error(),
+	})
+}
+
+func TodoRoutes(app *fiber.App, todos db.TodoRepository, auth *jwtService.Service) {
+	todoGroup := app.Group("api/todos", auth.AuthMiddleware())
 
-		// Continue with the API logic
-		return c.JSON(todos)
+	todoGroup.Get("/", jwtService.RequirePermission(db.PermissionTodosRead), func(c *fiber.Ctx) error {
+		return sendTodos(c, todos, jwtService.GetUserId(c))
 	})
 
-	app.Post("api/todos", func(c *fiber.Ctx) error {
-		fmt.Println("POST /api/todos")
-		err := jwtService.VerifyTokenProtectedRoute(c)
-		fmt.Println(err)
-		if err != nil {
-			return nil
-		}
-		todo := &structs.Todo{}
+	todoGroup.Post("/", jwtService.RequirePermission(db.PermissionTodosWrite), func(c *fiber.Ctx) error {
+		userId := jwtService.GetUserId(c)
+		todo := &TodoStruct{}
 
 		if err := c.BodyParser(todo); err != nil {
 			return err
 		}
 
-		todo.ID = len(todos) + 1
-
-		todos = append(todos, *todo)
-		fmt.Println("POST /api/todos")
+		if _, err := todos.CreateTodo(c.UserContext(), userId, todo.Title, todo.Body, todo.Done); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":  "Failed to create todo",
+				"detail": err.Error(),
+			})
+		}
 
-		return c.JSON(todos)
+		return sendTodos(c, todos, userId)
 	})
 
-	app.Put("api/todos/:id", func(c *fiber.Ctx) error {
-		err := jwtService.VerifyTokenProtectedRoute(c)
-		fmt.Println(err)
-		if err != nil {
-			return nil
-		}
-
+	todoGroup.Put("/:id", jwtService.RequirePermission(db.PermissionTodosWrite), func(c *fiber.Ctx) error {
+		userId := jwtService.GetUserId(c)
 		id, err := c.ParamsInt("id")
 
 		if err != nil {
-			return c.Status(401).SendString("Invalid todo ID")
-		}
-
-		todoIndex := findTodoIndexByID(id, todos)
-
-		if todoIndex == -1 {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "structs.Todo not found",
-			})
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
 		}
 
-		todo := &structs.Todo{ID: id}
+		todo := &TodoStruct{}
 
 		if err := c.BodyParser(todo); err != nil {
 			return err
@@ -89,67 +91,46 @@ func TodoRoutes(app *fiber.App) {
 			}
 
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error":  "structs.Todo is missing fields",
+				"error":  "Todo is missing fields",
 				"fields": missingFields,
 			})
 		}
 
-		todos[todoIndex] = *todo
+		if err := todos.UpdateTodo(c.UserContext(), userId, id, todo.Title, todo.Body, todo.Done); err != nil {
+			return handleTodoError(c, err)
+		}
 
-		return c.JSON(todos)
+		return sendTodos(c, todos, userId)
 	})
 
-	app.Patch("api/todos/:id/status", func(c *fiber.Ctx) error {
-		err := jwtService.VerifyTokenProtectedRoute(c)
-		fmt.Println(err)
-		if err != nil {
-			return nil
-		}
-
+	todoGroup.Patch("/:id/status", jwtService.RequirePermission(db.PermissionTodosWrite), func(c *fiber.Ctx) error {
+		userId := jwtService.GetUserId(c)
 		id, err := c.ParamsInt("id")
 
 		if err != nil {
-			return c.Status(401).SendString("Invalid todo ID")
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
 		}
 
-		// Find the todo by ID
-		todoIndex := findTodoIndexByID(id, todos)
-
-		if todoIndex == -1 {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "structs.Todo not found",
-			})
+		if err := todos.ToggleTodoStatus(c.UserContext(), userId, id); err != nil {
+			return handleTodoError(c, err)
 		}
 
-		todos[todoIndex].Done = !todos[todoIndex].Done
-
-		return c.JSON(todos)
+		return sendTodos(c, todos, userId)
 	})
 
-	app.Delete("api/todos/:id", func(c *fiber.Ctx) error {
-		err := jwtService.VerifyTokenProtectedRoute(c)
-		fmt.Println(err)
-		if err != nil {
-			return nil
-		}
-
+	todoGroup.Delete("/:id", jwtService.RequirePermission(db.PermissionTodosWrite), func(c *fiber.Ctx) error {
+		userId := jwtService.GetUserId(c)
 		id, err := c.ParamsInt("id")
 
 		if err != nil {
-			return c.Status(401).SendString("Invalid todo ID")
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
 		}
 
-		todoIndex := findTodoIndexByID(id, todos)
-
-		if todoIndex == -1 {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "structs.Todo not found",
-			})
+		if err := todos.DeleteTodo(c.UserContext(), userId, id); err != nil {
+			return handleTodoError(c, err)
 		}
 
-		todos = append(todos[:todoIndex], todos[todoIndex+1:]...)
-
-		return c.JSON(todos)
+		return sendTodos(c, todos, userId)
 	})
 
 }
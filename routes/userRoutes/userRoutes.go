@@ -1,12 +1,15 @@
 package userRoutes
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"log/slog"
 
+	"connectrpc.com/connect"
 	"github.com/gofiber/fiber/v2"
 	"github.com/oleksiip-aiola/go-server/db"
 	"github.com/oleksiip-aiola/go-server/jwtService"
-	"github.com/oleksiip-aiola/go-server/structs"
+	"github.com/oleksiip-aiola/go-server/logger"
 	"gorm.io/gorm"
 )
 
@@ -17,28 +20,50 @@ type User struct {
 	LastName  string `json:"lastName"`
 }
 
-func Auth(user User) (string, error) {
+func Auth(ctx context.Context, auth *jwtService.Service, users db.UserRepository, user User) (string, string, error) {
 	var err error
 
-	gormUser := db.User{}
-	id, err := gormUser.CreateAdmin(user.Email, user.Password, user.FirstName, user.LastName)
+	id, err := users.CreateUser(ctx, user.Email, user.Password, user.FirstName, user.LastName)
 
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	token, err := jwtService.GenerateJWTPair(id)
+	token, refreshToken, err := auth.GenerateJWTPair(ctx, id)
 
 	if err != nil {
-		fmt.Println("Error generating JWT:", err)
-		return "", err
+		slog.Error("Failed to generate JWT", "user_id", id, "error", err)
+		return "", "", err
 	}
 
-	return token, err
+	return token, refreshToken, err
 }
 
-func UserRoutes(app *fiber.App) {
-	fmt.Println("user routes")
+type LoginStruct struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// Login checks the credentials and issues a new token pair
+func Login(ctx context.Context, auth *jwtService.Service, users db.UserRepository, credentials LoginStruct) (string, string, error) {
+	user, err := users.Authenticate(ctx, credentials.Email, credentials.Password)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	return auth.GenerateJWTPair(ctx, user.UserId)
+}
+
+type userHandlers struct {
+	users db.UserRepository
+	auth  *jwtService.Service
+}
+
+func UserRoutes(app *fiber.App, users db.UserRepository, auth *jwtService.Service) {
+	slog.Debug("Initializing user routes")
+	h := &userHandlers{users: users, auth: auth}
+
 	app.Post("api/register", func(c *fiber.Ctx) error {
 
 		user := &User{}
@@ -47,7 +72,7 @@ func UserRoutes(app *fiber.App) {
 			return err
 		}
 
-		token, err := Auth(*user)
+		token, refreshToken, err := Auth(c.UserContext(), auth, users, *user)
 
 		if err != nil {
 			if err == gorm.ErrDuplicatedKey {
@@ -61,7 +86,8 @@ func UserRoutes(app *fiber.App) {
 			})
 		}
 
-		jwtService.SetAccessTokenCookie(c, token)
+		auth.SetAccessTokenCookie(c, token)
+		auth.SetRefreshCookie(c, refreshToken)
 
 		return c.JSON(fiber.Map{
 			"access_token": token,
@@ -70,50 +96,86 @@ func UserRoutes(app *fiber.App) {
 
 	// // Optionally handle OPTIONS for CORS requests
 
-	app.Post("api/refresh-token", handleRefreshToken)
-	app.Post("api/verify", handleRefreshToken)
-	app.Post("api/logout", handleLogout)
+	app.Post("api/login", h.handleLogin)
+	app.Post("api/refresh-token", h.handleRefreshToken)
+	app.Post("api/verify", h.handleRefreshToken)
+	app.Post("api/logout", auth.AuthMiddleware(), h.handleLogout)
 
-	app.Post("api/")
+	usersGroup := app.Group("api/users", auth.AuthMiddleware())
+	usersGroup.Get("/roles", jwtService.RequirePermission(db.PermissionUsersRead), h.handleGetRoles)
+	usersGroup.Get("/:id/roles", jwtService.RequirePermission(db.PermissionUsersRead), h.handleGetUserRoles)
+	usersGroup.Put("/:id/roles", jwtService.RequirePermission(db.PermissionUsersWrite), h.handleSetUserRoles)
 }
 
-type LogoutStruct struct {
-	ID string `json:"id"`
-}
+func (h *userHandlers) handleLogin(c *fiber.Ctx) error {
+	credentials := &LoginStruct{}
 
-func handleLogout(c *fiber.Ctx) error {
-	fmt.Println("LOGOUT")
+	if err := c.BodyParser(credentials); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
 
-	user := &LogoutStruct{}
-	if err := c.BodyParser(user); err != nil {
-		fmt.Println(err)
-		return err
+	if credentials.Email == "" || credentials.Password == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Email and password are required",
+		})
 	}
 
-	err := jwtService.HandleInvalidateUserSession(user.ID)
+	token, refreshToken, err := Login(c.UserContext(), h.auth, h.users, *credentials)
 
 	if err != nil {
+		// Unknown user and wrong password share the same response so the caller
+		// cannot tell which one failed
+		if connect.CodeOf(err) == connect.CodeUnauthenticated {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid email or password",
+			})
+		}
+		logger.FromCtx(c).Error("Failed to login", "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to Invalidate User session",
+			"error": "Failed to login",
 		})
 	}
 
-	jwtService.DeleteAccessTokenCookie(c)
+	h.auth.SetAccessTokenCookie(c, token)
+	h.auth.SetRefreshCookie(c, refreshToken)
 
 	return c.JSON(fiber.Map{
-		"message": "Successfully logged out",
+		"access_token": token,
 	})
 }
 
-func handleRefreshToken(c *fiber.Ctx) error {
-	user := &structs.User{}
+// handleLogout ends the sessions of the user the access token was issued to
+func (h *userHandlers) handleLogout(c *fiber.Ctx) error {
+	err := h.auth.HandleInvalidateUserSession(c.UserContext(), jwtService.GetUserId(c))
 
-	if err := c.BodyParser(user); err != nil {
-		return err
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to Invalidate User session",
+		})
 	}
-	accessToken, err := jwtService.RefreshAccessToken(c, user.ID)
+
+	h.auth.DeleteAccessTokenCookie(c)
+	h.auth.DeleteRefreshCookie(c)
+
+	return c.JSON(fiber.Map{
+		"message": "Successfully logged out",
+	})
+}
+
+func (h *userHandlers) handleRefreshToken(c *fiber.Ctx) error {
+	accessToken, err := h.auth.RefreshAccessToken(c)
 
 	if err != nil {
+		if errors.Is(err, jwtService.ErrRefreshTokenInvalid) || errors.Is(err, jwtService.ErrRefreshTokenReused) {
+			h.auth.DeleteAccessTokenCookie(c)
+			h.auth.DeleteRefreshCookie(c)
+
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid refresh token",
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate JWT",
 		})
@@ -123,3 +185,65 @@ func handleRefreshToken(c *fiber.Ctx) error {
 		"access_token": accessToken,
 	})
 }
+
+func (h *userHandlers) handleGetRoles(c *fiber.Ctx) error {
+	roles, err := h.users.GetRoles(c.UserContext())
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get roles",
+		})
+	}
+
+	return c.JSON(roles)
+}
+
+func (h *userHandlers) handleGetUserRoles(c *fiber.Ctx) error {
+	roles, permissions, err := h.users.GetUserRolesAndPermissions(c.UserContext(), c.Params("id"))
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user roles",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"roles":       roles,
+		"permissions": permissions,
+	})
+}
+
+type UserRolesStruct struct {
+	Roles []string `json:"roles"`
+}
+
+func (h *userHandlers) handleSetUserRoles(c *fiber.Ctx) error {
+	rolesDto := &UserRolesStruct{}
+
+	if err := c.BodyParser(rolesDto); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	userId := c.Params("id")
+
+	if _, err := h.users.GetUserById(c.UserContext(), userId); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if err := h.users.SetUserRoles(c.UserContext(), userId, rolesDto.Roles); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Unknown role",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to set user roles",
+		})
+	}
+
+	return h.handleGetUserRoles(c)
+}
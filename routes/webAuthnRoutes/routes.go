@@ -0,0 +1,367 @@
+package webAuthnRoutes
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/oleksiip-aiola/go-server/config"
+	"github.com/oleksiip-aiola/go-server/db"
+	"github.com/oleksiip-aiola/go-server/jwtService"
+	"github.com/oleksiip-aiola/go-server/logger"
+	"github.com/oleksiip-aiola/go-server/webAuthnService"
+	"gorm.io/gorm"
+)
+
+const sessionCookieName = "webauthn_session"
+
+type webAuthnHandlers struct {
+	users         db.UserRepository
+	auth          *jwtService.Service
+	secureCookies bool
+}
+
+func InitWebAuthnRoutes(app *fiber.App, cfg config.Config, users db.UserRepository, auth *jwtService.Service) {
+	slog.Debug("Initializing webauthn routes")
+	h := &webAuthnHandlers{users: users, auth: auth, secureCookies: cfg.PublicURL != ""}
+
+	app.Post(`api/webauthn/register/begin`, h.handleRegisterBegin)
+	app.Post(`api/webauthn/register/finish`, h.handleRegisterFinish)
+	app.Post(`api/webauthn/login/begin`, h.handleLoginBegin)
+	app.Post(`api/webauthn/login/finish`, h.handleLoginFinish)
+
+	credentials := app.Group(`api/webauthn/credentials`, auth.AuthMiddleware())
+	credentials.Get(`/`, h.handleListCredentials)
+	credentials.Post(`/begin`, h.handleAddCredentialBegin)
+	credentials.Post(`/finish`, h.handleAddCredentialFinish)
+	credentials.Patch(`/:id`, h.handleRenameCredential)
+	credentials.Delete(`/:id`, h.handleDeleteCredential)
+}
+
+// Store the ceremony session id in HTTP-only cookie
+func (h *webAuthnHandlers) setSessionCookie(c *fiber.Ctx, sessionId string) {
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionId,
+		Expires:  time.Now().Add(webAuthnService.SESSION_EXPIRATION),
+		HTTPOnly: true,
+		Secure:   h.secureCookies,
+		SameSite: "Strict",
+	})
+}
+
+func clearSessionCookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Expires:  time.Now().Add(-time.Hour),
+		HTTPOnly: true,
+	})
+}
+
+type RegisterBeginStruct struct {
+	Email          string `json:"email"`
+	FirstName      string `json:"firstName"`
+	LastName       string `json:"lastName"`
+	CredentialName string `json:"credentialName"`
+}
+
+func (h *webAuthnHandlers) handleRegisterBegin(c *fiber.Ctx) error {
+	registerDto := &RegisterBeginStruct{}
+
+	if err := c.BodyParser(registerDto); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if registerDto.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Email is required",
+		})
+	}
+
+	if _, err := h.users.GetUserByEmail(c.UserContext(), registerDto.Email); err == nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "User already exists",
+		})
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to begin registration",
+		})
+	}
+
+	// The user is persisted only after the ceremony succeeds, so the id is generated up front
+	// to be used as the WebAuthn user handle
+	user := db.User{
+		UserId:    uuid.New().String(),
+		Email:     registerDto.Email,
+		FirstName: registerDto.FirstName,
+		LastName:  registerDto.LastName,
+	}
+
+	options, sessionId, err := webAuthnService.BeginRegistration(user, registerDto.CredentialName)
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":  "Failed to begin registration",
+			"detail": err.Error(),
+		})
+	}
+
+	h.setSessionCookie(c, sessionId)
+
+	return c.JSON(options)
+}
+
+func (h *webAuthnHandlers) handleRegisterFinish(c *fiber.Ctx) error {
+	user, credential, err := webAuthnService.FinishRegistration(c.Cookies(sessionCookieName), c.Body())
+	clearSessionCookie(c)
+
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":  "Failed to finish registration",
+			"detail": err.Error(),
+		})
+	}
+
+	id, err := h.users.CreateWebAuthnUser(c.UserContext(), user, *credential)
+
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "User already exists",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to register",
+		})
+	}
+
+	return h.issueTokens(c, id)
+}
+
+type LoginBeginStruct struct {
+	Email string `json:"email"`
+}
+
+func (h *webAuthnHandlers) handleLoginBegin(c *fiber.Ctx) error {
+	loginDto := &LoginBeginStruct{}
+
+	if err := c.BodyParser(loginDto); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	user, err := h.users.GetUserByEmail(c.UserContext(), loginDto.Email)
+
+	if err == nil {
+		user.Credentials, err = h.users.GetWebAuthnCredentials(c.UserContext(), user.UserId)
+	}
+
+	if err != nil || len(user.Credentials) == 0 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "No passkey registered for this user",
+		})
+	}
+
+	options, sessionId, err := webAuthnService.BeginLogin(user)
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":  "Failed to begin login",
+			"detail": err.Error(),
+		})
+	}
+
+	h.setSessionCookie(c, sessionId)
+
+	return c.JSON(options)
+}
+
+func (h *webAuthnHandlers) handleLoginFinish(c *fiber.Ctx) error {
+	session, err := webAuthnService.TakeSession(c.Cookies(sessionCookieName))
+	clearSessionCookie(c)
+
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Login session expired",
+		})
+	}
+
+	// Reload the user so the sign count is compared with the latest stored values
+	user, err := h.users.GetWebAuthnUser(c.UserContext(), session.User.UserId)
+
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Failed to login",
+		})
+	}
+
+	credential, err := webAuthnService.ValidateLogin(user, session, c.Body())
+
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":  "Failed to login",
+			"detail": err.Error(),
+		})
+	}
+
+	if err := h.users.UpdateWebAuthnCredentialUsage(c.UserContext(), credential); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to login",
+		})
+	}
+
+	return h.issueTokens(c, user.UserId)
+}
+
+func (h *webAuthnHandlers) handleListCredentials(c *fiber.Ctx) error {
+	userId := jwtService.GetUserId(c)
+
+	credentials, err := h.users.GetWebAuthnCredentials(c.UserContext(), userId)
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":  "Failed to list passkeys",
+			"detail": err.Error(),
+		})
+	}
+
+	return c.JSON(credentials)
+}
+
+type CredentialNameStruct struct {
+	Name string `json:"name"`
+}
+
+func (h *webAuthnHandlers) handleAddCredentialBegin(c *fiber.Ctx) error {
+	userId := jwtService.GetUserId(c)
+
+	credentialDto := &CredentialNameStruct{}
+
+	if err := c.BodyParser(credentialDto); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	user, err := h.users.GetWebAuthnUser(c.UserContext(), userId)
+
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	options, sessionId, err := webAuthnService.BeginRegistration(*user, credentialDto.Name)
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":  "Failed to begin passkey registration",
+			"detail": err.Error(),
+		})
+	}
+
+	h.setSessionCookie(c, sessionId)
+
+	return c.JSON(options)
+}
+
+func (h *webAuthnHandlers) handleAddCredentialFinish(c *fiber.Ctx) error {
+	userId := jwtService.GetUserId(c)
+
+	user, credential, err := webAuthnService.FinishRegistration(c.Cookies(sessionCookieName), c.Body())
+	clearSessionCookie(c)
+
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":  "Failed to finish passkey registration",
+			"detail": err.Error(),
+		})
+	}
+
+	if user.UserId != userId {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Passkey registration belongs to another user",
+		})
+	}
+
+	if err := h.users.CreateWebAuthnCredential(c.UserContext(), credential); err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Passkey already registered",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store passkey",
+		})
+	}
+
+	return c.JSON(credential)
+}
+
+func (h *webAuthnHandlers) handleRenameCredential(c *fiber.Ctx) error {
+	userId := jwtService.GetUserId(c)
+
+	credentialDto := &CredentialNameStruct{}
+
+	if err := c.BodyParser(credentialDto); err != nil || credentialDto.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name is required",
+		})
+	}
+
+	if err := h.users.RenameWebAuthnCredential(c.UserContext(), userId, c.Params("id"), credentialDto.Name); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Passkey not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rename passkey",
+		})
+	}
+
+	return c.JSON(credentialDto)
+}
+
+func (h *webAuthnHandlers) handleDeleteCredential(c *fiber.Ctx) error {
+	userId := jwtService.GetUserId(c)
+
+	if err := h.users.DeleteWebAuthnCredential(c.UserContext(), userId, c.Params("id")); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Passkey not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete passkey",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Passkey deleted",
+	})
+}
+
+func (h *webAuthnHandlers) issueTokens(c *fiber.Ctx, userId string) error {
+	token, refreshToken, err := h.auth.GenerateJWTPair(c.UserContext(), userId)
+
+	if err != nil {
+		logger.FromCtx(c).Error("Failed to generate JWT", "user_id", userId, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate JWT",
+		})
+	}
+
+	h.auth.SetAccessTokenCookie(c, token)
+	h.auth.SetRefreshCookie(c, refreshToken)
+
+	return c.JSON(fiber.Map{
+		"access_token": token,
+	})
+}
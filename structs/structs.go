@@ -1,12 +1,5 @@
 package structs
 
-type Todo struct {
-	ID    int    `json:"id"`
-	Title string `json:"title"`
-	Done  bool   `json:"done"`
-	Body  string `json:"body"`
-}
-
 type User struct {
 	ID        string `json:"id"`
 	Email     string `json:"email"`
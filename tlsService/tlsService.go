@@ -0,0 +1,163 @@
+package tlsService
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oleksiip-aiola/go-server/config"
+)
+
+// CertReloader serves the certificate of the configured files and picks up a new one written over them,
+// so a renewed certificate is used without a restart
+type CertReloader struct {
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+	// Modification times of the loaded files, a reload is skipped while they are unchanged
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// NewCertReloader loads the certificate and key, failing when they do not form a valid pair
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload loads the files again when either of them changed since the last load, reloaded is false otherwise.
+// On an error, e.g. the certificate renewed but not its key yet, the previous certificate stays in use
+func (r *CertReloader) Reload() (reloaded bool, err error) {
+	certModTime, err := modTime(r.certFile)
+	if err != nil {
+		return false, err
+	}
+
+	keyModTime, err := modTime(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mutex.RLock()
+	unchanged := r.cert != nil && certModTime.Equal(r.certModTime) && keyModTime.Equal(r.keyModTime)
+	r.mutex.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load TLS certificate %s: %w", r.certFile, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.cert = &cert
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+
+	return true, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate, every handshake gets the latest certificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.cert, nil
+}
+
+// StartWatching checks the files for changes every interval
+func (r *CertReloader) StartWatching(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			reloaded, err := r.Reload()
+			if err != nil {
+				slog.Error("Failed to reload TLS certificate, keeping the current one", "error", err)
+			} else if reloaded {
+				slog.Info("Reloaded TLS certificate", "file", r.certFile)
+			}
+		}
+	}()
+}
+
+func modTime(file string) (time.Time, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read TLS file %s: %w", file, err)
+	}
+
+	return info.ModTime(), nil
+}
+
+// NewConfig returns the server TLS configuration with the minimum version and cipher suites of cfg,
+// and starts watching the certificate files
+func NewConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	reloader, err := NewCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader.StartWatching(cfg.ReloadInterval)
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     config.TLSVersions[cfg.MinVersion],
+	}
+
+	for _, name := range cfg.CipherSuites {
+		id, _ := config.TLSCipherSuite(name)
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	return tlsConfig, nil
+}
+
+// RedirectApp answers every plain HTTP request with a permanent redirect to the same URL on the HTTPS port
+func RedirectApp(httpsPort string) *fiber.App {
+	app := fiber.New(fiber.Config{
+		DisableStartupMessage: true,
+		ReadTimeout:           10 * time.Second,
+	})
+
+	app.Use(func(c *fiber.Ctx) error {
+		host := c.Hostname()
+		if host == "" {
+			return fiber.ErrBadRequest
+		}
+
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		// 308 so the method and body are kept, unlike a 301
+		return c.Redirect("https://"+host+c.OriginalURL(), fiber.StatusPermanentRedirect)
+	})
+
+	return app
+}
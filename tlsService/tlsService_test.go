@@ -0,0 +1,167 @@
+package tlsService
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oleksiip-aiola/go-server/config"
+)
+
+// writeCertificate writes a self-signed certificate for commonName and its key, dated modified
+func writeCertificate(t *testing.T, certFile string, keyFile string, commonName string, modified time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "PRIVATE KEY", Bytes: keyDer},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.Subject.CommonName
+}
+
+func TestReloadPicksUpRenewedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+
+	loaded := time.Now().Add(-time.Minute)
+	writeCertificate(t, certFile, keyFile, "old", loaded)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reloaded, err := reloader.Reload(); err != nil || reloaded {
+		t.Fatalf("expected unchanged files to be skipped, got %v, %v", reloaded, err)
+	}
+
+	// Only the certificate written so far, the pair does not match
+	writeCertificate(t, certFile, filepath.Join(dir, "other.key"), "new", time.Now())
+
+	if _, err := reloader.Reload(); err == nil {
+		t.Fatal("expected a certificate not matching its key to fail")
+	}
+
+	cert, _ := reloader.GetCertificate(nil)
+	if commonName(t, cert) != "old" {
+		t.Error("expected the previous certificate to stay in use after a failed reload")
+	}
+
+	writeCertificate(t, certFile, keyFile, "new", time.Now())
+
+	if reloaded, err := reloader.Reload(); err != nil || !reloaded {
+		t.Fatalf("expected the renewed certificate to be loaded, got %v, %v", reloaded, err)
+	}
+
+	cert, _ = reloader.GetCertificate(nil)
+	if commonName(t, cert) != "new" {
+		t.Errorf("expected the renewed certificate, got %q", commonName(t, cert))
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeCertificate(t, certFile, keyFile, "localhost", time.Now())
+
+	tlsConfig, err := NewConfig(config.TLSConfig{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		MinVersion:     "1.3",
+		CipherSuites:   []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		ReloadInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3 as minimum, got %x", tlsConfig.MinVersion)
+	}
+	if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("expected the configured cipher suite, got %v", tlsConfig.CipherSuites)
+	}
+
+	if _, err := NewConfig(config.TLSConfig{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.key")}); err == nil {
+		t.Error("expected a missing key to fail")
+	}
+}
+
+func TestRedirectApp(t *testing.T) {
+	cases := []struct {
+		port     string
+		host     string
+		expected string
+	}{
+		{"8443", "example.com:8080", "https://example.com:8443/api/todos?page=2"},
+		{"443", "example.com", "https://example.com/api/todos?page=2"},
+		{"443", "[::1]:8080", "https://[::1]/api/todos?page=2"},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest("POST", "/api/todos?page=2", nil)
+		req.Host = tc.host
+
+		resp, err := RedirectApp(tc.port).Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != fiber.StatusPermanentRedirect {
+			t.Errorf("expected a permanent redirect, got %d", resp.StatusCode)
+		}
+		if location := resp.Header.Get("Location"); location != tc.expected {
+			t.Errorf("expected a redirect to %s, got %s", tc.expected, location)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	gormSpanKey          = "tracing:span"
+	gormParentContextKey = "tracing:parent_context"
+)
+
+// gormPlugin starts a client span for every query run with a traced context, see GormPlugin
+type gormPlugin struct {
+	database string
+}
+
+// GormPlugin traces the queries of a connection, database names it in the spans (primary or the shard name).
+// Queries without a span in their context, e.g. of the shard map refresh, are not traced
+func GormPlugin(database string) gorm.Plugin {
+	return gormPlugin{database: database}
+}
+
+func (p gormPlugin) Name() string {
+	return "tracing:" + p.database
+}
+
+func (p gormPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+
+	return errors.Join(
+		callbacks.Create().Before("gorm:create").Register("tracing:before_create", p.before("create")),
+		callbacks.Create().After("gorm:create").Register("tracing:after_create", p.after),
+		callbacks.Query().Before("gorm:query").Register("tracing:before_query", p.before("select")),
+		callbacks.Query().After("gorm:query").Register("tracing:after_query", p.after),
+		callbacks.Update().Before("gorm:update").Register("tracing:before_update", p.before("update")),
+		callbacks.Update().After("gorm:update").Register("tracing:after_update", p.after),
+		callbacks.Delete().Before("gorm:delete").Register("tracing:before_delete", p.before("delete")),
+		callbacks.Delete().After("gorm:delete").Register("tracing:after_delete", p.after),
+		callbacks.Row().Before("gorm:row").Register("tracing:before_row", p.before("row")),
+		callbacks.Row().After("gorm:row").Register("tracing:after_row", p.after),
+		callbacks.Raw().Before("gorm:raw").Register("tracing:before_raw", p.before("raw")),
+		callbacks.Raw().After("gorm:raw").Register("tracing:after_raw", p.after),
+	)
+}
+
+func (p gormPlugin) before(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx := db.Statement.Context
+
+		if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+			return
+		}
+
+		ctx, span := Tracer().Start(ctx, "gorm."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationName(operation),
+			attribute.String("db.instance", p.database),
+		))
+
+		// Restored once the query is done, a reused statement must not nest its next query in this span
+		db.InstanceSet(gormParentContextKey, db.Statement.Context)
+		db.InstanceSet(gormSpanKey, span)
+		db.Statement.Context = ctx
+	}
+}
+
+func (p gormPlugin) after(db *gorm.DB) {
+	value, _ := db.InstanceGet(gormSpanKey)
+
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	defer span.End()
+
+	db.InstanceSet(gormSpanKey, nil)
+
+	if parent, ok := db.InstanceGet(gormParentContextKey); ok {
+		db.Statement.Context = parent.(context.Context)
+	}
+
+	// Parameterized, the values never reach the span
+	span.SetAttributes(
+		semconv.DBQueryText(db.Statement.SQL.String()),
+		semconv.DBCollectionName(db.Statement.Table),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		RecordError(span, db.Error)
+	}
+}
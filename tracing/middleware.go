@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/oleksiip-aiola/go-server/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// headerCarrier reads the trace context sent by the caller from the request headers
+type headerCarrier struct {
+	c *fiber.Ctx
+}
+
+func (h headerCarrier) Get(key string) string {
+	return h.c.Get(key)
+}
+
+func (h headerCarrier) Set(key string, value string) {
+	h.c.Request().Header.Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := []string{}
+
+	h.c.Request().Header.VisitAll(func(key []byte, _ []byte) {
+		keys = append(keys, string(key))
+	})
+
+	return keys
+}
+
+// Middleware starts a server span per request, continuing the trace of the caller, and makes it the parent
+// of the spans started from c.UserContext() by the handlers. It has to run after logger.RequestID
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), headerCarrier{c})
+
+		// The method points into the request buffer reused by fasthttp, the span outlives it
+		method := utils.CopyString(c.Method())
+
+		ctx, span := Tracer().Start(ctx, method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(method),
+			semconv.URLPath(utils.CopyString(c.Path())),
+			semconv.ClientAddress(c.IP()),
+			attribute.String("request.id", logger.GetRequestID(c)),
+		))
+		defer span.End()
+
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+
+		// Let the error handler set the status before it is recorded
+		if err != nil {
+			RecordError(span, err)
+
+			if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+				c.Status(fiber.StatusInternalServerError)
+			}
+		}
+
+		route := c.Route().Path
+		if !strings.HasPrefix(route, "/") {
+			route = "/" + route
+		}
+
+		status := c.Response().StatusCode()
+
+		span.SetName(method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPResponseStatusCode(status))
+
+		if status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, utils.StatusMessage(status))
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const incomingTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	return recorder
+}
+
+func TestMiddlewareContinuesTrace(t *testing.T) {
+	recorder := recordSpans(t)
+
+	app := fiber.New()
+	app.Use(Middleware())
+	app.Get("/api/todos/:id", func(c *fiber.Ctx) error {
+		_, span := Tracer().Start(c.UserContext(), "handler")
+		span.End()
+
+		return fiber.NewError(fiber.StatusInternalServerError, "failed")
+	})
+
+	req := httptest.NewRequest("GET", "/api/todos/7", nil)
+	req.Header.Set("traceparent", incomingTraceParent)
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusInternalServerError {
+		t.Fatalf("expected the error handler to set the status, got %d", resp.StatusCode)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected the handler and server spans, got %d", len(spans))
+	}
+
+	handler, server := spans[0], spans[1]
+
+	if server.Name() != "GET /api/todos/:id" {
+		t.Errorf("expected the span to be named after the route, got %q", server.Name())
+	}
+	if server.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the trace of the caller to be continued, got %s", server.Parent().TraceID())
+	}
+	if handler.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("expected the handler span to be a child of the server span")
+	}
+	if server.Status().Code.String() != "Error" {
+		t.Errorf("expected a failed request to mark the span, got %v", server.Status())
+	}
+}
+
+func TestTraceParentLink(t *testing.T) {
+	recordSpans(t)
+
+	ctx, span := Tracer().Start(context.Background(), "request")
+	defer span.End()
+
+	traceParent := TraceParent(ctx)
+	if traceParent == "" {
+		t.Fatal("expected a traceparent for a recording span")
+	}
+
+	links := LinkTo(traceParent)
+	if len(links) != 1 || links[0].SpanContext.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("expected a link to the original span, got %v", links)
+	}
+
+	if TraceParent(context.Background()) != "" || LinkTo("") != nil || LinkTo("garbage") != nil {
+		t.Error("expected no traceparent and no link without a span")
+	}
+}
@@ -0,0 +1,201 @@
+package webAuthnService
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/oleksiip-aiola/go-server/config"
+	"github.com/oleksiip-aiola/go-server/db"
+)
+
+var WebAuthn *webauthn.WebAuthn
+
+var SESSION_EXPIRATION = 5 * time.Minute
+
+var ErrSessionNotFound = errors.New("webauthn session not found or expired")
+var ErrSignCountInvalid = errors.New("authenticator sign count did not increase")
+
+// Challenge state kept between begin and finish of a ceremony
+type Session struct {
+	Data           webauthn.SessionData
+	User           db.User
+	CredentialName string
+	Expires        time.Time
+}
+
+var sessions = make(map[string]Session)
+var sessionsMutex sync.Mutex
+
+func InitWebAuthn(cfg config.WebAuthnConfig) error {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: cfg.RPDisplayName,
+		RPOrigins:     cfg.RPOrigins,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	WebAuthn = w
+
+	return nil
+}
+
+// Generate random session id for the ceremony cookie
+func generateSessionId() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+func storeSession(data *webauthn.SessionData, user db.User, credentialName string) (string, error) {
+	sessionId, err := generateSessionId()
+
+	if err != nil {
+		return "", err
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	// Drop expired sessions so abandoned ceremonies don't pile up
+	now := time.Now()
+	for id, session := range sessions {
+		if now.After(session.Expires) {
+			delete(sessions, id)
+		}
+	}
+
+	sessions[sessionId] = Session{
+		Data:           *data,
+		User:           user,
+		CredentialName: credentialName,
+		Expires:        now.Add(SESSION_EXPIRATION),
+	}
+
+	return sessionId, nil
+}
+
+// TakeSession returns the session and removes it, so every challenge can be answered only once
+func TakeSession(sessionId string) (Session, error) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	session, ok := sessions[sessionId]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+
+	delete(sessions, sessionId)
+
+	if time.Now().After(session.Expires) {
+		return Session{}, ErrSessionNotFound
+	}
+
+	return session, nil
+}
+
+// BeginRegistration starts a ceremony for a new passkey, excluding authenticators the user already registered
+func BeginRegistration(user db.User, credentialName string) (*protocol.CredentialCreation, string, error) {
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	options, sessionData, err := WebAuthn.BeginRegistration(&user, webauthn.WithExclusions(exclusions))
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if credentialName == "" {
+		credentialName = "Passkey"
+	}
+
+	sessionId, err := storeSession(sessionData, user, credentialName)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return options, sessionId, nil
+}
+
+// FinishRegistration verifies the attestation and returns the user of the session with the new, not yet stored, credential
+func FinishRegistration(sessionId string, body []byte) (*db.User, *db.WebAuthnCredential, error) {
+	session, err := TakeSession(sessionId)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parsedResponse, err := protocol.ParseCredentialCreationResponseBytes(body)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := session.User
+
+	credential, err := WebAuthn.CreateCredential(&user, session.Data, parsedResponse)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	webAuthnCredential := db.NewWebAuthnCredential(user.UserId, session.CredentialName, credential)
+
+	return &user, &webAuthnCredential, nil
+}
+
+func BeginLogin(user db.User) (*protocol.CredentialAssertion, string, error) {
+	options, sessionData, err := WebAuthn.BeginLogin(&user)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	sessionId, err := storeSession(sessionData, user, "")
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return options, sessionId, nil
+}
+
+// ValidateLogin verifies the assertion against the stored credential of the user and
+// rejects responses whose sign count did not increase past the stored one
+func ValidateLogin(user *db.User, session Session, body []byte) (*webauthn.Credential, error) {
+	if user.UserId != session.User.UserId {
+		return nil, fmt.Errorf("webauthn session belongs to another user")
+	}
+
+	parsedResponse, err := protocol.ParseCredentialRequestResponseBytes(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := WebAuthn.ValidateLogin(user, session.Data, parsedResponse)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if credential.Authenticator.CloneWarning {
+		return nil, ErrSignCountInvalid
+	}
+
+	return credential, nil
+}
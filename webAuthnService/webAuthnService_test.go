@@ -0,0 +1,220 @@
+package webAuthnService
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/google/uuid"
+	"github.com/oleksiip-aiola/go-server/config"
+	"github.com/oleksiip-aiola/go-server/db"
+)
+
+const testOrigin = "http://localhost:3000"
+
+var testConfig = config.WebAuthnConfig{RPID: "localhost", RPDisplayName: "go-server", RPOrigins: []string{testOrigin}}
+
+// softwareAuthenticator is a minimal ES256 authenticator producing "none" attestations
+type softwareAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	counter      uint32
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialId := make([]byte, 16)
+	if _, err := rand.Read(credentialId); err != nil {
+		t.Fatal(err)
+	}
+
+	return &softwareAuthenticator{key: key, credentialId: credentialId}
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func clientData(t *testing.T, ceremony string, challenge string) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func (a *softwareAuthenticator) authData(flags byte) []byte {
+	rpIdHash := sha256.Sum256([]byte("localhost"))
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags)
+	return binary.BigEndian.AppendUint32(data, a.counter)
+}
+
+func (a *softwareAuthenticator) register(t *testing.T, challenge string) []byte {
+	x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+
+	publicKey, err := webauthncbor.Marshal(map[int]interface{}{1: 2, 3: -7, -1: 1, -2: x, -3: y})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags: user present, user verified, attested credential data included
+	authData := a.authData(0x45)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialId)))
+	authData = append(authData, a.credentialId...)
+	authData = append(authData, publicKey...)
+
+	attestationObject, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    encode(a.credentialId),
+		"rawId": encode(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientData(t, "webauthn.create", challenge)),
+			"attestationObject": encode(attestationObject),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func (a *softwareAuthenticator) login(t *testing.T, challenge string, userHandle string) []byte {
+	authData := a.authData(0x05)
+	clientDataJSON := clientData(t, "webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    encode(a.credentialId),
+		"rawId": encode(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientDataJSON),
+			"authenticatorData": encode(authData),
+			"signature":         encode(signature),
+			"userHandle":        encode([]byte(userHandle)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func beginLogin(t *testing.T, user db.User) (string, string) {
+	options, sessionId, err := BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessionId, options.Response.Challenge.String()
+}
+
+func TestExclusionOfRegisteredCredentials(t *testing.T) {
+	if err := InitWebAuthn(testConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	user := db.User{
+		UserId:      uuid.New().String(),
+		Email:       "second@example.com",
+		Credentials: []db.WebAuthnCredential{{CredentialID: []byte("first")}, {CredentialID: []byte("second")}},
+	}
+
+	options, _, err := BeginRegistration(user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(options.Response.CredentialExcludeList) != 2 {
+		t.Fatalf("expected both passkeys to be excluded, got %d", len(options.Response.CredentialExcludeList))
+	}
+}
+
+func TestRegistrationAndLoginCeremonies(t *testing.T) {
+	if err := InitWebAuthn(testConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator := newSoftwareAuthenticator(t)
+	pending := db.User{UserId: uuid.New().String(), Email: "passkey@example.com"}
+
+	options, sessionId, err := BeginRegistration(pending, "Laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, credential, err := FinishRegistration(sessionId, authenticator.register(t, options.Response.Challenge.String()))
+	if err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+
+	if string(credential.CredentialID) != string(authenticator.credentialId) || credential.Name != "Laptop" {
+		t.Fatalf("unexpected credential %+v", credential)
+	}
+	user.Credentials = []db.WebAuthnCredential{*credential}
+
+	// A registration challenge can only be answered once
+	if _, _, err := FinishRegistration(sessionId, authenticator.register(t, options.Response.Challenge.String())); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected session to be consumed, got %v", err)
+	}
+
+	authenticator.counter = 1
+	sessionId, challenge := beginLogin(t, *user)
+	session, err := TakeSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validated, err := ValidateLogin(user, session, authenticator.login(t, challenge, user.UserId))
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	if validated.Authenticator.SignCount != 1 {
+		t.Fatalf("expected sign count 1, got %d", validated.Authenticator.SignCount)
+	}
+	user.Credentials[0].SignCount = validated.Authenticator.SignCount
+
+	// An authenticator reusing a sign count looks cloned and must be rejected
+	sessionId, challenge = beginLogin(t, *user)
+	session, err = TakeSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ValidateLogin(user, session, authenticator.login(t, challenge, user.UserId)); !errors.Is(err, ErrSignCountInvalid) {
+		t.Fatalf("expected sign count error, got %v", err)
+	}
+}